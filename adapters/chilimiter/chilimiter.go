@@ -0,0 +1,13 @@
+package chilimiter
+
+import (
+  "net/http"
+
+  "rate-limiter/middleware"
+)
+
+// New returns a chi middleware that rate limits requests, chi middlewares
+// share the net/http signature so the core middleware is used as is
+func New(m *middleware.RateLimiterMiddleware) func(http.Handler) http.Handler {
+  return m.Middleware
+}
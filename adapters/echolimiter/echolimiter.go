@@ -0,0 +1,47 @@
+package echolimiter
+
+import (
+  "errors"
+  "net/http"
+
+  "github.com/labstack/echo/v4"
+  "rate-limiter/middleware"
+)
+
+// New returns an echo middleware that rate limits requests, the client IP is
+// resolved by echo so its IP extractor settings apply
+func New(m *middleware.RateLimiterMiddleware) echo.MiddlewareFunc {
+  return func(next echo.HandlerFunc) echo.HandlerFunc {
+    return func(c echo.Context) error {
+      admission, err := m.Admit(c.Request(), c.RealIP(), c.Request().Header.Get(middleware.TokenHeader))
+      if err != nil {
+        return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+      }
+      for name, values := range admission.Headers() {
+        c.Response().Header().Set(name, values[0])
+      }
+      if !admission.Allowed {
+        m.WriteDenial(c.Response(), c.Request(), admission.Result)
+        return nil
+      }
+      defer admission.Release()
+
+      err = next(c)
+      admission.Finish(c.Request().Context(), responseStatus(c, err), c.Response().Header())
+      return err
+    }
+  }
+}
+
+// responseStatus returns the status of the response, which the error handler
+// of echo only writes once the middleware returns the handler's error
+func responseStatus(c echo.Context, err error) int {
+  if err == nil || c.Response().Committed {
+    return c.Response().Status
+  }
+  var httpErr *echo.HTTPError
+  if errors.As(err, &httpErr) {
+    return httpErr.Code
+  }
+  return http.StatusInternalServerError
+}
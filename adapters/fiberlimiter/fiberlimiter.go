@@ -0,0 +1,64 @@
+package fiberlimiter
+
+import (
+  "errors"
+  "net/http"
+
+  "github.com/gofiber/fiber/v2"
+  "github.com/gofiber/fiber/v2/middleware/adaptor"
+  "rate-limiter/middleware"
+)
+
+// New returns a fiber middleware that rate limits requests, the client IP is
+// resolved by fiber so its proxy header settings apply
+func New(m *middleware.RateLimiterMiddleware) fiber.Handler {
+  return func(c *fiber.Ctx) error {
+    // Costs are computed on a net/http view of the request
+    r, err := adaptor.ConvertRequest(c, false)
+    if err != nil {
+      return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Internal server error"})
+    }
+    r = r.WithContext(c.UserContext())
+
+    admission, err := m.Admit(r, c.IP(), c.Get(middleware.TokenHeader))
+    if err != nil {
+      return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Internal server error"})
+    }
+    for name, values := range admission.Headers() {
+      c.Set(name, values[0])
+    }
+    if !admission.Allowed {
+      // The denial is rendered by the shared net/http writer
+      return adaptor.HTTPHandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+        m.WriteDenial(w, r, admission.Result)
+      })(c)
+    }
+    defer admission.Release()
+
+    err = c.Next()
+    admission.Finish(r.Context(), responseStatus(c, err), responseHeader(c))
+    return err
+  }
+}
+
+// responseStatus returns the status of the response, which the error handler
+// of fiber only writes once the middleware returns the handler's error
+func responseStatus(c *fiber.Ctx, err error) int {
+  if err == nil {
+    return c.Response().StatusCode()
+  }
+  var fiberErr *fiber.Error
+  if errors.As(err, &fiberErr) {
+    return fiberErr.Code
+  }
+  return fiber.StatusInternalServerError
+}
+
+// responseHeader returns the headers of the response in their net/http form
+func responseHeader(c *fiber.Ctx) http.Header {
+  header := make(http.Header)
+  c.Response().Header.VisitAll(func(key, value []byte) {
+    header.Add(string(key), string(value))
+  })
+  return header
+}
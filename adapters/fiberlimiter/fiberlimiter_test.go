@@ -0,0 +1,96 @@
+package fiberlimiter
+
+import (
+  "context"
+  "encoding/json"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+
+  "io"
+
+  "github.com/gofiber/fiber/v2"
+  "rate-limiter/interfaces"
+  "rate-limiter/middleware"
+)
+
+// MockRateLimiter allows or denies every request and records the checked keys
+type MockRateLimiter struct {
+  allow bool
+  keys  []string
+}
+
+// CheckIP records the IP and returns the configured result
+func (m *MockRateLimiter) CheckIP(ctx context.Context, ip string, cost int) (interfaces.Result, error) {
+  m.keys = append(m.keys, "ip:"+ip)
+  return interfaces.Result{Allowed: m.allow, Limit: 10, Remaining: 9}, nil
+}
+
+// CheckToken records the token and returns the configured result
+func (m *MockRateLimiter) CheckToken(ctx context.Context, token string, cost int) (interfaces.Result, error) {
+  m.keys = append(m.keys, "token:"+token)
+  return interfaces.Result{Allowed: m.allow, Limit: 10, Remaining: 9}, nil
+}
+
+// Close mocks the close method
+func (m *MockRateLimiter) Close() error {
+  return nil
+}
+
+// serve sends a request through the adapter and returns the response
+func serve(t *testing.T, limiter *MockRateLimiter, token string) (int, http.Header, string) {
+  app := fiber.New()
+  app.Use(New(middleware.NewRateLimiterMiddleware(limiter)))
+  app.Get("/api/test", func(c *fiber.Ctx) error {
+    return c.SendString("ok")
+  })
+
+  req := httptest.NewRequest("GET", "/api/test", nil)
+  if token != "" {
+    req.Header.Set(middleware.TokenHeader, token)
+  }
+  resp, err := app.Test(req)
+  if err != nil {
+    t.Fatalf("Error sending request: %v", err)
+  }
+  defer resp.Body.Close()
+  body, _ := io.ReadAll(resp.Body)
+  return resp.StatusCode, resp.Header, string(body)
+}
+
+// TestAllowed tests that allowed requests reach the handler with RateLimit headers
+func TestAllowed(t *testing.T) {
+  limiter := &MockRateLimiter{allow: true}
+
+  status, header, body := serve(t, limiter, "")
+  if status != http.StatusOK || body != "ok" {
+    t.Errorf("Unexpected response: %d %q", status, body)
+  }
+  if header.Get(middleware.RemainingHeader) != "9" {
+    t.Errorf("Expected %s header, got %q", middleware.RemainingHeader, header.Get(middleware.RemainingHeader))
+  }
+  if len(limiter.keys) != 1 || limiter.keys[0] == "ip:" {
+    t.Errorf("Expected the client IP to be checked, got %v", limiter.keys)
+  }
+}
+
+// TestDenied tests that denied requests get the rate limit exceeded response
+func TestDenied(t *testing.T) {
+  limiter := &MockRateLimiter{allow: false}
+
+  status, header, body := serve(t, limiter, "test-token")
+  if status != http.StatusTooManyRequests {
+    t.Errorf("Wrong status code: got %v want %v", status, http.StatusTooManyRequests)
+  }
+  if header.Get(middleware.LimitHeader) != "10" {
+    t.Errorf("Expected %s header, got %q", middleware.LimitHeader, header.Get(middleware.LimitHeader))
+  }
+
+  var response map[string]string
+  if err := json.Unmarshal([]byte(body), &response); err != nil || response["error"] != "Rate limit exceeded" {
+    t.Errorf("Unexpected body %q", body)
+  }
+  if len(limiter.keys) != 1 || limiter.keys[0] != "token:test-token" {
+    t.Errorf("Expected the token to be checked, got %v", limiter.keys)
+  }
+}
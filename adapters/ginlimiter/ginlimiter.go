@@ -0,0 +1,32 @@
+package ginlimiter
+
+import (
+  "net/http"
+
+  "github.com/gin-gonic/gin"
+  "rate-limiter/middleware"
+)
+
+// New returns a gin middleware that rate limits requests, the client IP is
+// resolved by gin so its trusted proxy settings apply
+func New(m *middleware.RateLimiterMiddleware) gin.HandlerFunc {
+  return func(c *gin.Context) {
+    admission, err := m.Admit(c.Request, c.ClientIP(), c.GetHeader(middleware.TokenHeader))
+    if err != nil {
+      c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+      return
+    }
+    for name, values := range admission.Headers() {
+      c.Header(name, values[0])
+    }
+    if !admission.Allowed {
+      m.WriteDenial(c.Writer, c.Request, admission.Result)
+      c.Abort()
+      return
+    }
+    defer admission.Release()
+
+    c.Next()
+    admission.Finish(c.Request.Context(), c.Writer.Status(), c.Writer.Header())
+  }
+}
@@ -0,0 +1,130 @@
+package ginlimiter
+
+import (
+  "context"
+  "encoding/json"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+
+  "github.com/gin-gonic/gin"
+  "rate-limiter/interfaces"
+  "rate-limiter/middleware"
+)
+
+// MockRateLimiter allows or denies every request and records the checked keys
+type MockRateLimiter struct {
+  allow bool
+  keys  []string
+}
+
+// CheckIP records the IP and returns the configured result
+func (m *MockRateLimiter) CheckIP(ctx context.Context, ip string, cost int) (interfaces.Result, error) {
+  m.keys = append(m.keys, "ip:"+ip)
+  return interfaces.Result{Allowed: m.allow, Limit: 10, Remaining: 9}, nil
+}
+
+// CheckToken records the token and returns the configured result
+func (m *MockRateLimiter) CheckToken(ctx context.Context, token string, cost int) (interfaces.Result, error) {
+  m.keys = append(m.keys, "token:"+token)
+  return interfaces.Result{Allowed: m.allow, Limit: 10, Remaining: 9}, nil
+}
+
+// Close mocks the close method
+func (m *MockRateLimiter) Close() error {
+  return nil
+}
+
+// serve sends a request through the adapter and returns the response
+func serve(t *testing.T, limiter *MockRateLimiter, token string) (int, http.Header, string) {
+  gin.SetMode(gin.TestMode)
+  router := gin.New()
+  router.Use(New(middleware.NewRateLimiterMiddleware(limiter)))
+  router.GET("/api/test", func(c *gin.Context) {
+    c.String(http.StatusOK, "ok")
+  })
+
+  req := httptest.NewRequest("GET", "/api/test", nil)
+  req.RemoteAddr = "192.168.1.1:12345"
+  if token != "" {
+    req.Header.Set(middleware.TokenHeader, token)
+  }
+  rr := httptest.NewRecorder()
+  router.ServeHTTP(rr, req)
+  return rr.Code, rr.Header(), rr.Body.String()
+}
+
+// TestAllowed tests that allowed requests reach the handler with RateLimit headers
+func TestAllowed(t *testing.T) {
+  limiter := &MockRateLimiter{allow: true}
+
+  status, header, body := serve(t, limiter, "")
+  if status != http.StatusOK || body != "ok" {
+    t.Errorf("Unexpected response: %d %q", status, body)
+  }
+  if header.Get(middleware.RemainingHeader) != "9" {
+    t.Errorf("Expected %s header, got %q", middleware.RemainingHeader, header.Get(middleware.RemainingHeader))
+  }
+  if len(limiter.keys) != 1 || limiter.keys[0] == "ip:" {
+    t.Errorf("Expected the client IP to be checked, got %v", limiter.keys)
+  }
+}
+
+// TestDenied tests that denied requests get the rate limit exceeded response
+func TestDenied(t *testing.T) {
+  limiter := &MockRateLimiter{allow: false}
+
+  status, _, body := serve(t, limiter, "test-token")
+  if status != http.StatusTooManyRequests {
+    t.Errorf("Wrong status code: got %v want %v", status, http.StatusTooManyRequests)
+  }
+
+  var response map[string]string
+  if err := json.Unmarshal([]byte(body), &response); err != nil || response["error"] != "Rate limit exceeded" {
+    t.Errorf("Unexpected body %q", body)
+  }
+  if len(limiter.keys) != 1 || limiter.keys[0] != "token:test-token" {
+    t.Errorf("Expected the token to be checked, got %v", limiter.keys)
+  }
+}
+
+// MockRefunder records the refunds made through the adapter
+type MockRefunder struct {
+  refunds map[string]int
+}
+
+// RefundIP mocks the IP refund
+func (m *MockRefunder) RefundIP(ctx context.Context, ip string, cost int) error {
+  m.refunds["ip:"+ip] += cost
+  return nil
+}
+
+// RefundToken mocks the token refund
+func (m *MockRefunder) RefundToken(ctx context.Context, token string, cost int) error {
+  m.refunds["token:"+token] += cost
+  return nil
+}
+
+// TestRefund tests that responses matching the refund rule give back their units
+func TestRefund(t *testing.T) {
+  gin.SetMode(gin.TestMode)
+  refunder := &MockRefunder{refunds: make(map[string]int)}
+  router := gin.New()
+  router.Use(New(middleware.NewRateLimiterMiddleware(&MockRateLimiter{allow: true},
+    middleware.WithRefunds(refunder, middleware.RefundOnStatus("5xx")))))
+  router.GET("/api/test", func(c *gin.Context) {
+    c.String(http.StatusBadGateway, "unavailable")
+  })
+  router.GET("/api/ok", func(c *gin.Context) {
+    c.String(http.StatusOK, "ok")
+  })
+
+  for _, path := range []string{"/api/test", "/api/ok"} {
+    req := httptest.NewRequest("GET", path, nil)
+    req.Header.Set(middleware.TokenHeader, "abc")
+    router.ServeHTTP(httptest.NewRecorder(), req)
+  }
+  if len(refunder.refunds) != 1 || refunder.refunds["token:abc"] != 1 {
+    t.Errorf("Expected only the failed request to be refunded, got %v", refunder.refunds)
+  }
+}
@@ -0,0 +1,178 @@
+package admin
+
+import (
+  "crypto/subtle"
+  "encoding/json"
+  "errors"
+  "expvar"
+  "net/http"
+  "strings"
+
+  "github.com/gorilla/mux"
+  "rate-limiter/interfaces"
+  "rate-limiter/metrics"
+  "rate-limiter/storage"
+  "rate-limiter/usage"
+)
+
+const (
+  // TokenHeader is the header name for the admin token
+  TokenHeader = "X-Admin-Token"
+)
+
+// Handler exposes administrative operations over HTTP
+type Handler struct {
+  blocks interfaces.BlockManager
+  token  string
+
+  // tenantTokens maps each tenant to the token of its admin routes
+  tenantTokens map[string]string
+
+  // usage holds the usage totals served by the usage routes
+  usage storage.UsageStorage
+}
+
+// NewHandler creates a new admin handler protected by the given token
+func NewHandler(blocks interfaces.BlockManager, token string) *Handler {
+  return &Handler{
+    blocks: blocks,
+    token:  token,
+  }
+}
+
+// Register registers the admin routes on the given router
+func (h *Handler) Register(router *mux.Router) {
+  router.Handle("/blocks/{key}", h.authenticate(http.HandlerFunc(h.unblock))).Methods("DELETE")
+  router.Handle("/metrics", h.authenticate(expvar.Handler())).Methods("GET")
+}
+
+// RegisterTenants registers the tenant scoped admin routes on the given
+// router, each accepting the admin token or the token of its tenant
+func (h *Handler) RegisterTenants(router *mux.Router, tokens map[string]string) {
+  h.tenantTokens = tokens
+  tenants := router.PathPrefix("/tenants/{tenant}").Subrouter()
+  tenants.Use(h.authenticateTenant)
+  tenants.HandleFunc("/blocks/{key}", h.unblockTenant).Methods("DELETE")
+  tenants.HandleFunc("/metrics", h.tenantMetrics).Methods("GET")
+}
+
+// RegisterUsage registers the usage export routes on the given router, the
+// tenant scoped route only exports the keys of its tenant
+func (h *Handler) RegisterUsage(router *mux.Router, store storage.UsageStorage) {
+  h.usage = store
+  router.Handle("/usage", h.authenticate(http.HandlerFunc(h.exportUsage))).Methods("GET")
+  router.Handle("/tenants/{tenant}/usage", h.authenticateTenant(http.HandlerFunc(h.exportUsage))).Methods("GET")
+}
+
+// authenticate rejects requests that do not carry the admin token
+func (h *Handler) authenticate(next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if !validToken(r.Header.Get(TokenHeader), h.token) {
+      writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+      return
+    }
+    next.ServeHTTP(w, r)
+  })
+}
+
+// authenticateTenant rejects requests that carry neither the admin token nor
+// the token of the tenant
+func (h *Handler) authenticateTenant(next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    tenantToken, ok := h.tenantTokens[mux.Vars(r)["tenant"]]
+    if !ok {
+      writeJSON(w, http.StatusNotFound, map[string]string{"error": "Unknown tenant"})
+      return
+    }
+
+    token := r.Header.Get(TokenHeader)
+    if !validToken(token, h.token) && !validToken(token, tenantToken) {
+      writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+      return
+    }
+    next.ServeHTTP(w, r)
+  })
+}
+
+// unblock lifts a block or permanent ban on a key
+func (h *Handler) unblock(w http.ResponseWriter, r *http.Request) {
+  h.unblockKey(w, r, mux.Vars(r)["key"])
+}
+
+// unblockTenant lifts a block on a key of a tenant, given without the tenant
+func (h *Handler) unblockTenant(w http.ResponseWriter, r *http.Request) {
+  vars := mux.Vars(r)
+  h.unblockKey(w, r, vars["tenant"]+":"+vars["key"])
+}
+
+// tenantMetrics returns the decision counters of a tenant
+func (h *Handler) tenantMetrics(w http.ResponseWriter, r *http.Request) {
+  w.Header().Set("Content-Type", "application/json")
+  w.Write([]byte(metrics.Tenant(mux.Vars(r)["tenant"]).String()))
+}
+
+// exportUsage writes the usage totals within the from and to query
+// parameters in the format given by the format parameter, CSV by default
+func (h *Handler) exportUsage(w http.ResponseWriter, r *http.Request) {
+  query := r.URL.Query()
+  from, to, err := usage.ParseRange(query.Get("from"), query.Get("to"))
+  if err != nil {
+    writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+    return
+  }
+
+  format, contentType := usage.FormatCSV, "text/csv"
+  switch query.Get("format") {
+  case "", usage.FormatCSV:
+  case usage.FormatJSONLines:
+    format, contentType = usage.FormatJSONLines, "application/x-ndjson"
+  default:
+    writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Unknown format"})
+    return
+  }
+
+  totals, err := h.usage.Usage(r.Context(), from, to)
+  if err != nil {
+    writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+    return
+  }
+  if name, ok := mux.Vars(r)["tenant"]; ok {
+    filtered := totals[:0]
+    for _, u := range totals {
+      if strings.HasPrefix(u.Key, name+":") {
+        filtered = append(filtered, u)
+      }
+    }
+    totals = filtered
+  }
+
+  w.Header().Set("Content-Type", contentType)
+  usage.Write(w, format, totals)
+}
+
+// unblockKey lifts a block or permanent ban on a key
+func (h *Handler) unblockKey(w http.ResponseWriter, r *http.Request, key string) {
+  err := h.blocks.Unblock(r.Context(), key)
+  if errors.Is(err, interfaces.ErrInvalidKey) {
+    writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+    return
+  }
+  if err != nil {
+    writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+    return
+  }
+  writeJSON(w, http.StatusOK, map[string]string{"key": key, "status": "unblocked"})
+}
+
+// Helper function to compare a token with the expected one in constant time,
+// an empty expected token never matches
+func validToken(token, expected string) bool {
+  return expected != "" && subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+// Helper function to write a JSON response
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(status)
+  json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,146 @@
+package admin
+
+import (
+  "context"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+  "time"
+
+  "github.com/gorilla/mux"
+  "rate-limiter/storage"
+)
+
+// MockBlockManager records the keys it was asked to unblock
+type MockBlockManager struct {
+  unblocked []string
+}
+
+// Unblock records the key
+func (m *MockBlockManager) Unblock(ctx context.Context, key string) error {
+  m.unblocked = append(m.unblocked, key)
+  return nil
+}
+
+// TestUnblockRequiresToken tests that requests without the admin token are rejected
+func TestUnblockRequiresToken(t *testing.T) {
+  manager := &MockBlockManager{}
+  router := mux.NewRouter()
+  NewHandler(manager, "secret").Register(router.PathPrefix("/admin").Subrouter())
+
+  req := httptest.NewRequest("DELETE", "/admin/blocks/192.168.1.1", nil)
+  rr := httptest.NewRecorder()
+  router.ServeHTTP(rr, req)
+
+  if status := rr.Code; status != http.StatusUnauthorized {
+    t.Errorf("Handler returned wrong status code: got %v want %v", status, http.StatusUnauthorized)
+  }
+  if len(manager.unblocked) != 0 {
+    t.Error("Key should not be unblocked without the admin token")
+  }
+}
+
+// TestUnblock tests that the admin token lifts a block
+func TestUnblock(t *testing.T) {
+  manager := &MockBlockManager{}
+  router := mux.NewRouter()
+  NewHandler(manager, "secret").Register(router.PathPrefix("/admin").Subrouter())
+
+  req := httptest.NewRequest("DELETE", "/admin/blocks/192.168.1.1", nil)
+  req.Header.Set(TokenHeader, "secret")
+  rr := httptest.NewRecorder()
+  router.ServeHTTP(rr, req)
+
+  if status := rr.Code; status != http.StatusOK {
+    t.Errorf("Handler returned wrong status code: got %v want %v", status, http.StatusOK)
+  }
+  if len(manager.unblocked) != 1 || manager.unblocked[0] != "192.168.1.1" {
+    t.Errorf("Unexpected unblocked keys: %v", manager.unblocked)
+  }
+}
+
+// TestUnblockTenant tests that tenant tokens only reach their own tenant
+func TestUnblockTenant(t *testing.T) {
+  manager := &MockBlockManager{}
+  router := mux.NewRouter()
+  handler := NewHandler(manager, "secret")
+  handler.Register(router.PathPrefix("/admin").Subrouter())
+  handler.RegisterTenants(router.PathPrefix("/admin").Subrouter(), map[string]string{"acme": "acme-secret", "globex": ""})
+
+  tests := []struct {
+    path   string
+    token  string
+    status int
+  }{
+    {path: "/admin/tenants/acme/blocks/ip:ip:192.168.1.1", token: "acme-secret", status: http.StatusOK},
+    {path: "/admin/tenants/acme/blocks/ip:ip:192.168.1.2", token: "secret", status: http.StatusOK},
+    {path: "/admin/tenants/globex/blocks/ip:ip:192.168.1.1", token: "acme-secret", status: http.StatusUnauthorized},
+    {path: "/admin/tenants/globex/blocks/ip:ip:192.168.1.1", token: "", status: http.StatusUnauthorized},
+    {path: "/admin/tenants/initech/blocks/ip:ip:192.168.1.1", token: "secret", status: http.StatusNotFound},
+    {path: "/admin/blocks/default:ip:ip:192.168.1.1", token: "acme-secret", status: http.StatusUnauthorized},
+  }
+
+  for _, tt := range tests {
+    req := httptest.NewRequest("DELETE", tt.path, nil)
+    req.Header.Set(TokenHeader, tt.token)
+    rr := httptest.NewRecorder()
+    router.ServeHTTP(rr, req)
+
+    if rr.Code != tt.status {
+      t.Errorf("%s: got status %d want %d", tt.path, rr.Code, tt.status)
+    }
+  }
+
+  want := []string{"acme:ip:ip:192.168.1.1", "acme:ip:ip:192.168.1.2"}
+  if len(manager.unblocked) != len(want) || manager.unblocked[0] != want[0] || manager.unblocked[1] != want[1] {
+    t.Errorf("Unexpected unblocked keys: %v", manager.unblocked)
+  }
+}
+
+// TestExportUsage tests the usage export and its tenant scoped variant
+func TestExportUsage(t *testing.T) {
+  store := storage.NewMemoryStorage()
+  start := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+  store.AddUsage(context.Background(), []storage.Usage{
+    {Start: start, Key: "acme:token:token:abc", Allowed: 10, Units: 10},
+    {Start: start, Key: "globex:token:token:def", Allowed: 3, Denied: 1, Units: 3},
+  }, 24*time.Hour*365*100)
+
+  router := mux.NewRouter()
+  handler := NewHandler(&MockBlockManager{}, "secret")
+  handler.Register(router.PathPrefix("/admin").Subrouter())
+  handler.RegisterTenants(router.PathPrefix("/admin").Subrouter(), map[string]string{"acme": "acme-secret"})
+  handler.RegisterUsage(router.PathPrefix("/admin").Subrouter(), store)
+
+  tests := []struct {
+    path   string
+    token  string
+    status int
+    body   string
+  }{
+    {path: "/admin/usage?from=2024-03-01&to=2024-03-01", token: "secret", status: http.StatusOK,
+      body: "start,key,allowed,denied,units\n2024-03-01T10:00:00Z,acme:token:token:abc,10,0,10\n" +
+        "2024-03-01T10:00:00Z,globex:token:token:def,3,1,3\n"},
+    {path: "/admin/usage?from=2024-03-02&to=2024-03-31", token: "secret", status: http.StatusOK,
+      body: "start,key,allowed,denied,units\n"},
+    {path: "/admin/tenants/acme/usage?from=2024-03-01&format=jsonl", token: "acme-secret", status: http.StatusOK,
+      body: `{"start":"2024-03-01T10:00:00Z","key":"acme:token:token:abc","allowed":10,"denied":0,"units":10}` + "\n"},
+    {path: "/admin/usage", token: "acme-secret", status: http.StatusUnauthorized},
+    {path: "/admin/usage?from=march", token: "secret", status: http.StatusBadRequest},
+    {path: "/admin/usage?format=xml", token: "secret", status: http.StatusBadRequest},
+  }
+
+  for _, tt := range tests {
+    req := httptest.NewRequest("GET", tt.path, nil)
+    req.Header.Set(TokenHeader, tt.token)
+    rr := httptest.NewRecorder()
+    router.ServeHTTP(rr, req)
+
+    if rr.Code != tt.status {
+      t.Errorf("%s: got status %d want %d", tt.path, rr.Code, tt.status)
+    }
+    if tt.body != "" && rr.Body.String() != tt.body {
+      t.Errorf("%s: got body %q want %q", tt.path, rr.Body.String(), tt.body)
+    }
+  }
+}
@@ -4,6 +4,7 @@ import (
   "log"
   "os"
   "strconv"
+  "strings"
 
   "github.com/joho/godotenv"
 )
@@ -27,17 +28,127 @@ type Config struct {
   TokenExpiration   int
   BlockDuration     int
 
+  // Block configuration, an empty mode blocks. MaxWait overrides both modes
+  // with reject and skips denials, warning when block was set explicitly.
+  IPMode       string
+  TokenMode    string
+  SkipDenied   bool
+  ExtendBlocks bool
+
+  // Dry-run configuration
+  DryRun      bool
+  IPDryRun    bool
+  TokenDryRun bool
+
+  // Burst configuration
+  IPBurst     int
+  TokenBurst  int
+  BurstWindow int
+
+  // Warm-up configuration
+  IPWarmUp    int
+  TokenWarmUp int
+  WarmUpStart int
+
+  // Cost configuration
+  RouteCosts map[string]int
+  CostHeader string
+  MaxCost    int
+
+  // Hierarchy configuration
+  HierarchyFile string
+
+  // Priority configuration
+  PrioritiesFile string
+
+  // Quota configuration
+  Quotas        map[string]int
+  QuotaTimezone string
+
+  // Usage configuration
+  UsageInterval      int
+  UsageFlushInterval int
+  UsageRetentionDays int
+
+  // Tenant configuration
+  TenantsFile  string
+  TenantHeader string
+
+  // Denial response configuration
+  DenialResponsesFile string
+
+  // Token hashing configuration
+  TokenHashSecret          string
+  TokenHashPreviousSecrets []string
+
+  // Refund configuration
+  RefundStatuses []string
+  RefundHeader   string
+
+  // Failure mode configuration
+  FailurePaths          []string
+  FailureStatuses       []string
+  FailureLimit          int
+  FailureWindow         int
+  FailureLockout        int
+  FailureUsernameField  string
+  FailureResetOnSuccess bool
+
+  // Concurrency configuration
+  MaxConcurrentPerKey int
+  MaxConcurrent       int
+  LeaseTTL            int
+
+  // Adaptive limits configuration
+  AdaptiveLimits        bool
+  AdaptiveTargetLatency int
+  AdaptiveMaxErrorRate  int
+  AdaptiveDecrease      int
+  AdaptiveIncrease      int
+  AdaptiveMin           int
+  AdaptiveMax           int
+  AdaptiveInterval      int
+  AdaptiveMinSamples    int
+
+  // Wait mode configuration, MaxWait forces the IP and token rules, and those
+  // of every tenant, to reject without counting denials
+  MaxWait  int
+  MaxQueue int
+
+  // Penalty configuration
+  PenaltyMultiplier  int
+  PenaltyMaxDuration int
+  PenaltyWindow      int
+  BanThreshold       int
+
   // Storage configuration
   StorageType StorageType
 
   // Redis configuration
-  RedisHost     string
-  RedisPort     string
-  RedisPassword string
-  RedisDB       int
+  RedisHost      string
+  RedisPort      string
+  RedisPassword  string
+  RedisDB        int
+  RedisKeyPrefix string
 
   // Server configuration
-  ServerPort string
+  ServerPort     string
+  TrustedProxies []string
+
+  // Check endpoint configuration
+  CheckPath       string
+  CheckDenyStatus int
+
+  // Envoy rate limit service configuration
+  RLSPort       string
+  RLSConfigFile string
+
+  // Gateway configuration
+  GatewayRoutesFile     string
+  GatewayHealthInterval int
+
+  // Admin configuration
+  AdminToken string
 }
 
 // LoadConfig loads the configuration from environment variables or .env file
@@ -52,6 +163,13 @@ func LoadConfig() *Config {
     storageType = StorageTypeRedis
   }
 
+  // Keys without a prefix would land in the legacy flat namespace
+  keyPrefix := getEnv("REDIS_KEY_PREFIX", "ratelimiter")
+  if keyPrefix == "" || strings.Contains(keyPrefix, ":") {
+    log.Printf("Warning: Invalid Redis key prefix '%s', using 'ratelimiter'", keyPrefix)
+    keyPrefix = "ratelimiter"
+  }
+
   return &Config{
     // Rate limiter configuration
     IPLimit:         getEnvAsInt("RATE_LIMITER_IP_LIMIT", 10),
@@ -60,17 +178,125 @@ func LoadConfig() *Config {
     TokenExpiration: getEnvAsInt("RATE_LIMITER_TOKEN_EXPIRATION", 300),
     BlockDuration:   getEnvAsInt("RATE_LIMITER_BLOCK_DURATION", 300),
 
+    // Block configuration
+    IPMode:       getEnv("RATE_LIMITER_IP_MODE", ""),
+    TokenMode:    getEnv("RATE_LIMITER_TOKEN_MODE", ""),
+    SkipDenied:   getEnvAsBool("RATE_LIMITER_SKIP_DENIED", false),
+    ExtendBlocks: getEnvAsBool("RATE_LIMITER_EXTEND_BLOCKS", false),
+
+    // Dry-run configuration
+    DryRun:      getEnvAsBool("RATE_LIMITER_DRY_RUN", false),
+    IPDryRun:    getEnvAsBool("RATE_LIMITER_IP_DRY_RUN", false),
+    TokenDryRun: getEnvAsBool("RATE_LIMITER_TOKEN_DRY_RUN", false),
+
+    // Burst configuration
+    IPBurst:     getEnvAsInt("RATE_LIMITER_IP_BURST", 0),
+    TokenBurst:  getEnvAsInt("RATE_LIMITER_TOKEN_BURST", 0),
+    BurstWindow: getEnvAsInt("RATE_LIMITER_BURST_WINDOW", 3600),
+
+    // Warm-up configuration
+    IPWarmUp:    getEnvAsInt("RATE_LIMITER_IP_WARMUP", 0),
+    TokenWarmUp: getEnvAsInt("RATE_LIMITER_TOKEN_WARMUP", 0),
+    WarmUpStart: getEnvAsInt("RATE_LIMITER_WARMUP_START", 10),
+
+    // Cost configuration
+    RouteCosts: getEnvAsIntMap("RATE_LIMITER_ROUTE_COSTS"),
+    CostHeader: getEnv("RATE_LIMITER_COST_HEADER", ""),
+    MaxCost:    getEnvAsInt("RATE_LIMITER_MAX_COST", 1000),
+
+    // Hierarchy configuration
+    HierarchyFile: getEnv("RATE_LIMITER_HIERARCHY_FILE", ""),
+
+    // Priority configuration
+    PrioritiesFile: getEnv("RATE_LIMITER_PRIORITIES_FILE", ""),
+
+    // Quota configuration
+    Quotas:        getEnvAsIntMap("RATE_LIMITER_QUOTAS"),
+    QuotaTimezone: getEnv("RATE_LIMITER_QUOTA_TIMEZONE", "UTC"),
+
+    // Usage configuration
+    UsageInterval:      getEnvAsInt("RATE_LIMITER_USAGE_INTERVAL", 0),
+    UsageFlushInterval: getEnvAsInt("RATE_LIMITER_USAGE_FLUSH_INTERVAL", 60),
+    UsageRetentionDays: getEnvAsInt("RATE_LIMITER_USAGE_RETENTION_DAYS", 400),
+
+    // Tenant configuration
+    TenantsFile:  getEnv("TENANTS_FILE", ""),
+    TenantHeader: getEnv("TENANT_HEADER", ""),
+
+    // Denial response configuration
+    DenialResponsesFile: getEnv("RATE_LIMITER_DENIAL_RESPONSES_FILE", ""),
+
+    // Token hashing configuration
+    TokenHashSecret:          getEnv("RATE_LIMITER_TOKEN_HASH_SECRET", ""),
+    TokenHashPreviousSecrets: getEnvAsList("RATE_LIMITER_TOKEN_HASH_PREVIOUS_SECRETS"),
+
+    // Refund configuration
+    RefundStatuses: getEnvAsList("RATE_LIMITER_REFUND_STATUSES"),
+    RefundHeader:   getEnv("RATE_LIMITER_REFUND_HEADER", ""),
+
+    // Failure mode configuration
+    FailurePaths:          getEnvAsList("RATE_LIMITER_FAILURE_PATHS"),
+    FailureStatuses:       getEnvAsList("RATE_LIMITER_FAILURE_STATUSES"),
+    FailureLimit:          getEnvAsInt("RATE_LIMITER_FAILURE_LIMIT", 5),
+    FailureWindow:         getEnvAsInt("RATE_LIMITER_FAILURE_WINDOW", 900),
+    FailureLockout:        getEnvAsInt("RATE_LIMITER_FAILURE_LOCKOUT", 900),
+    FailureUsernameField:  getEnv("RATE_LIMITER_FAILURE_USERNAME_FIELD", "username"),
+    FailureResetOnSuccess: getEnvAsBool("RATE_LIMITER_FAILURE_RESET_ON_SUCCESS", true),
+
+    // Concurrency configuration
+    MaxConcurrentPerKey: getEnvAsInt("RATE_LIMITER_MAX_CONCURRENT_PER_KEY", 0),
+    MaxConcurrent:       getEnvAsInt("RATE_LIMITER_MAX_CONCURRENT", 0),
+    LeaseTTL:            getEnvAsInt("RATE_LIMITER_LEASE_TTL", 60),
+
+    // Adaptive limits configuration
+    AdaptiveLimits:        getEnvAsBool("RATE_LIMITER_ADAPTIVE", false),
+    AdaptiveTargetLatency: getEnvAsInt("RATE_LIMITER_ADAPTIVE_TARGET_LATENCY", 500),
+    AdaptiveMaxErrorRate:  getEnvAsInt("RATE_LIMITER_ADAPTIVE_MAX_ERROR_RATE", 5),
+    AdaptiveDecrease:      getEnvAsInt("RATE_LIMITER_ADAPTIVE_DECREASE", 50),
+    AdaptiveIncrease:      getEnvAsInt("RATE_LIMITER_ADAPTIVE_INCREASE", 10),
+    AdaptiveMin:           getEnvAsInt("RATE_LIMITER_ADAPTIVE_MIN", 10),
+    AdaptiveMax:           getEnvAsInt("RATE_LIMITER_ADAPTIVE_MAX", 100),
+    AdaptiveInterval:      getEnvAsInt("RATE_LIMITER_ADAPTIVE_INTERVAL", 10),
+    AdaptiveMinSamples:    getEnvAsInt("RATE_LIMITER_ADAPTIVE_MIN_SAMPLES", 20),
+
+    // Wait mode configuration
+    MaxWait:  getEnvAsInt("RATE_LIMITER_MAX_WAIT", 0),
+    MaxQueue: getEnvAsInt("RATE_LIMITER_MAX_QUEUE", 10),
+
+    // Penalty configuration
+    PenaltyMultiplier:  getEnvAsInt("RATE_LIMITER_PENALTY_MULTIPLIER", 1),
+    PenaltyMaxDuration: getEnvAsInt("RATE_LIMITER_PENALTY_MAX_DURATION", 86400),
+    PenaltyWindow:      getEnvAsInt("RATE_LIMITER_PENALTY_WINDOW", 3600),
+    BanThreshold:       getEnvAsInt("RATE_LIMITER_BAN_THRESHOLD", 0),
+
     // Storage configuration
     StorageType: storageType,
 
     // Redis configuration
-    RedisHost:     getEnv("REDIS_HOST", "localhost"),
-    RedisPort:     getEnv("REDIS_PORT", "6379"),
-    RedisPassword: getEnv("REDIS_PASSWORD", ""),
-    RedisDB:       getEnvAsInt("REDIS_DB", 0),
+    RedisHost:      getEnv("REDIS_HOST", "localhost"),
+    RedisPort:      getEnv("REDIS_PORT", "6379"),
+    RedisPassword:  getEnv("REDIS_PASSWORD", ""),
+    RedisDB:        getEnvAsInt("REDIS_DB", 0),
+    RedisKeyPrefix: keyPrefix,
 
     // Server configuration
-    ServerPort: getEnv("SERVER_PORT", "8080"),
+    ServerPort:     getEnv("SERVER_PORT", "8080"),
+    TrustedProxies: getEnvAsList("TRUSTED_PROXIES"),
+
+    // Check endpoint configuration
+    CheckPath:       getEnv("CHECK_PATH", ""),
+    CheckDenyStatus: getEnvAsInt("CHECK_DENY_STATUS", 403),
+
+    // Envoy rate limit service configuration
+    RLSPort:       getEnv("RLS_GRPC_PORT", ""),
+    RLSConfigFile: getEnv("RLS_CONFIG_FILE", ""),
+
+    // Gateway configuration
+    GatewayRoutesFile:     getEnv("GATEWAY_ROUTES_FILE", ""),
+    GatewayHealthInterval: getEnvAsInt("GATEWAY_HEALTH_INTERVAL", 10),
+
+    // Admin configuration
+    AdminToken: getEnv("ADMIN_TOKEN", ""),
   }
 }
 
@@ -93,3 +319,48 @@ func getEnvAsInt(key string, defaultValue int) int {
   }
   return defaultValue
 }
+
+// Helper function to get an environment variable as a boolean
+func getEnvAsBool(key string, defaultValue bool) bool {
+  if valueStr, exists := os.LookupEnv(key); exists {
+    if value, err := strconv.ParseBool(valueStr); err == nil {
+      return value
+    } else {
+      log.Printf("Warning: Invalid value for %s, using default: %t", key, defaultValue)
+    }
+  }
+  return defaultValue
+}
+
+// Helper function to get an environment variable as a list of comma
+// separated values
+func getEnvAsList(key string) []string {
+  var values []string
+  for _, value := range strings.Split(getEnv(key, ""), ",") {
+    if value = strings.TrimSpace(value); value != "" {
+      values = append(values, value)
+    }
+  }
+  return values
+}
+
+// Helper function to get an environment variable as a map of integers, given
+// as comma separated key=value pairs
+func getEnvAsIntMap(key string) map[string]int {
+  values := make(map[string]int)
+  valueStr, exists := os.LookupEnv(key)
+  if !exists || valueStr == "" {
+    return values
+  }
+
+  for _, pair := range strings.Split(valueStr, ",") {
+    name, number, found := strings.Cut(strings.TrimSpace(pair), "=")
+    value, err := strconv.Atoi(strings.TrimSpace(number))
+    if !found || err != nil {
+      log.Printf("Warning: Invalid entry '%s' for %s, ignoring it", pair, key)
+      continue
+    }
+    values[strings.TrimSpace(name)] = value
+  }
+  return values
+}
@@ -0,0 +1,135 @@
+package grpclimit
+
+import (
+  "context"
+  "sync"
+  "time"
+
+  "google.golang.org/genproto/googleapis/rpc/errdetails"
+  "google.golang.org/grpc"
+  "google.golang.org/grpc/codes"
+  "google.golang.org/grpc/status"
+)
+
+// ClientLimiter holds back calls to methods the server rejected with retry
+// info until the retry delay has passed
+type ClientLimiter struct {
+  maxRetries int
+  mutex      sync.Mutex
+  retryAt    map[string]time.Time
+}
+
+// NewClientLimiter creates a new client limiter that retries rejected unary
+// calls up to maxRetries times
+func NewClientLimiter(maxRetries int) *ClientLimiter {
+  return &ClientLimiter{
+    maxRetries: maxRetries,
+    retryAt:    make(map[string]time.Time),
+  }
+}
+
+// UnaryClientInterceptor returns an interceptor that waits out and retries
+// rate limited unary calls
+func (c *ClientLimiter) UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+  return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+    for attempt := 0; ; attempt++ {
+      if err := c.wait(ctx, method); err != nil {
+        return err
+      }
+
+      err := invoker(ctx, method, req, reply, cc, opts...)
+      if !c.record(method, err) || attempt >= c.maxRetries {
+        return err
+      }
+    }
+  }
+}
+
+// StreamClientInterceptor returns an interceptor that waits out the retry
+// delay before opening streams to rate limited methods
+func (c *ClientLimiter) StreamClientInterceptor() grpc.StreamClientInterceptor {
+  return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+    if err := c.wait(ctx, method); err != nil {
+      return nil, err
+    }
+
+    stream, err := streamer(ctx, desc, cc, method, opts...)
+    if err != nil {
+      c.record(method, err)
+      return nil, err
+    }
+    return &clientStream{ClientStream: stream, limiter: c, method: method}, nil
+  }
+}
+
+// wait blocks until the method may be called again, failing fast when the
+// context would expire first
+func (c *ClientLimiter) wait(ctx context.Context, method string) error {
+  c.mutex.Lock()
+  retryAt := c.retryAt[method]
+  c.mutex.Unlock()
+
+  delay := time.Until(retryAt)
+  if delay <= 0 {
+    return nil
+  }
+  if deadline, ok := ctx.Deadline(); ok && deadline.Before(retryAt) {
+    return status.Errorf(codes.ResourceExhausted, "rate limited by server, retry in %v", delay)
+  }
+
+  timer := time.NewTimer(delay)
+  defer timer.Stop()
+
+  select {
+  case <-ctx.Done():
+    return status.FromContextError(ctx.Err()).Err()
+  case <-timer.C:
+    return nil
+  }
+}
+
+// record remembers the retry delay of a rate limited call and reports
+// whether the call may be retried
+func (c *ClientLimiter) record(method string, err error) bool {
+  delay, ok := RetryDelay(err)
+  if !ok {
+    return false
+  }
+
+  c.mutex.Lock()
+  defer c.mutex.Unlock()
+
+  c.retryAt[method] = time.Now().Add(delay)
+  return true
+}
+
+// RetryDelay returns the retry delay carried by a rate limit error
+func RetryDelay(err error) (time.Duration, bool) {
+  st, ok := status.FromError(err)
+  if !ok || st.Code() != codes.ResourceExhausted {
+    return 0, false
+  }
+
+  for _, detail := range st.Details() {
+    if info, ok := detail.(*errdetails.RetryInfo); ok && info.GetRetryDelay() != nil {
+      return info.GetRetryDelay().AsDuration(), true
+    }
+  }
+  return 0, false
+}
+
+// clientStream records rate limit errors received on an open stream
+type clientStream struct {
+  grpc.ClientStream
+  limiter *ClientLimiter
+  method  string
+}
+
+// RecvMsg receives a message and records any rate limit error
+func (s *clientStream) RecvMsg(m interface{}) error {
+  err := s.ClientStream.RecvMsg(m)
+  if err != nil {
+    s.limiter.record(s.method, err)
+  }
+  return err
+}
@@ -0,0 +1,205 @@
+package grpclimit
+
+import (
+  "context"
+  "net"
+  "testing"
+  "time"
+
+  "google.golang.org/grpc"
+  "google.golang.org/grpc/codes"
+  "google.golang.org/grpc/credentials/insecure"
+  "google.golang.org/grpc/health"
+  healthpb "google.golang.org/grpc/health/grpc_health_v1"
+  "google.golang.org/grpc/metadata"
+  "google.golang.org/grpc/status"
+  "google.golang.org/grpc/test/bufconn"
+  "rate-limiter/config"
+  "rate-limiter/interfaces"
+  "rate-limiter/limiter"
+  "rate-limiter/storage"
+)
+
+// MockRateLimiter denies the first calls and records the keys it checked
+type MockRateLimiter struct {
+  deny       int
+  retryAfter time.Duration
+  keys       []string
+}
+
+// CheckIP records the key and denies while denials are left
+func (m *MockRateLimiter) CheckIP(ctx context.Context, ip string, cost int) (interfaces.Result, error) {
+  m.keys = append(m.keys, "ip:"+ip)
+  if m.deny > 0 {
+    m.deny--
+    return interfaces.Result{RetryAfter: m.retryAfter}, nil
+  }
+  return interfaces.Result{Allowed: true}, nil
+}
+
+// CheckToken records the key and denies while denials are left
+func (m *MockRateLimiter) CheckToken(ctx context.Context, token string, cost int) (interfaces.Result, error) {
+  m.keys = append(m.keys, "token:"+token)
+  if m.deny > 0 {
+    m.deny--
+    return interfaces.Result{RetryAfter: m.retryAfter}, nil
+  }
+  return interfaces.Result{Allowed: true}, nil
+}
+
+// Close mocks the close method
+func (m *MockRateLimiter) Close() error {
+  return nil
+}
+
+// startServer serves the health service behind the server interceptors and
+// returns a client using the given dial options
+func startServer(t *testing.T, limiter *ServerLimiter, opts ...grpc.DialOption) healthpb.HealthClient {
+  listener := bufconn.Listen(1024 * 1024)
+  server := grpc.NewServer(
+    grpc.UnaryInterceptor(limiter.UnaryServerInterceptor()),
+    grpc.StreamInterceptor(limiter.StreamServerInterceptor()),
+  )
+  healthpb.RegisterHealthServer(server, health.NewServer())
+  go server.Serve(listener)
+  t.Cleanup(server.Stop)
+
+  opts = append(opts,
+    grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+    grpc.WithTransportCredentials(insecure.NewCredentials()),
+  )
+  conn, err := grpc.Dial("bufnet", opts...)
+  if err != nil {
+    t.Fatalf("Error dialing server: %v", err)
+  }
+  t.Cleanup(func() { conn.Close() })
+
+  return healthpb.NewHealthClient(conn)
+}
+
+// TestUnaryServerInterceptorDenied tests that denied calls carry the retry delay
+func TestUnaryServerInterceptorDenied(t *testing.T) {
+  mockLimiter := &MockRateLimiter{deny: 1, retryAfter: 30 * time.Second}
+  client := startServer(t, NewServerLimiter(mockLimiter))
+
+  _, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{})
+  if status.Code(err) != codes.ResourceExhausted {
+    t.Fatalf("Expected ResourceExhausted, got %v", err)
+  }
+  if delay, ok := RetryDelay(err); !ok || delay != 30*time.Second {
+    t.Errorf("Retry delay = %v (%t), want 30s", delay, ok)
+  }
+}
+
+// TestServerInterceptorKeys tests how the key of a call is extracted
+func TestServerInterceptorKeys(t *testing.T) {
+  mockLimiter := &MockRateLimiter{}
+  client := startServer(t, NewServerLimiter(mockLimiter, WithMethodKeys()))
+
+  ctx := metadata.AppendToOutgoingContext(context.Background(), TokenMetadata, "test-token")
+  if _, err := client.Check(ctx, &healthpb.HealthCheckRequest{}); err != nil {
+    t.Fatalf("Error calling server: %v", err)
+  }
+  if _, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{}); err != nil {
+    t.Fatalf("Error calling server: %v", err)
+  }
+
+  want := []string{
+    "token:/grpc.health.v1.Health/Check|test-token",
+    "ip:/grpc.health.v1.Health/Check|bufconn",
+  }
+  if len(mockLimiter.keys) != len(want) {
+    t.Fatalf("Checked keys %v, want %v", mockLimiter.keys, want)
+  }
+  for i := range want {
+    if mockLimiter.keys[i] != want[i] {
+      t.Errorf("Checked key %q, want %q", mockLimiter.keys[i], want[i])
+    }
+  }
+}
+
+// TestServerInterceptorMethodOnlyKeys tests that all callers of a method share
+// its budget under a rule of its own, which never blocks the method
+func TestServerInterceptorMethodOnlyKeys(t *testing.T) {
+  mockLimiter := &MockRateLimiter{}
+  store := storage.NewMemoryStorage()
+  rl := limiter.NewRateLimiter(&config.Config{BlockDuration: 300}, store)
+  rule := limiter.Rule{Name: "grpc", Limit: 2, Expiration: time.Minute, Mode: limiter.ModeBlock}
+  client := startServer(t, NewServerLimiter(mockLimiter, WithMethodOnlyKeys(rl, rule)))
+
+  ctx := metadata.AppendToOutgoingContext(context.Background(), TokenMetadata, "test-token")
+  if _, err := client.Check(ctx, &healthpb.HealthCheckRequest{}); err != nil {
+    t.Fatalf("Error calling server: %v", err)
+  }
+  if _, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{}); err != nil {
+    t.Fatalf("Error calling server: %v", err)
+  }
+  if _, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{}); status.Code(err) != codes.ResourceExhausted {
+    t.Errorf("Expected the method budget to be used up, got %v", err)
+  }
+
+  if len(mockLimiter.keys) != 0 {
+    t.Errorf("Expected the address and token limits to be skipped, got %v", mockLimiter.keys)
+  }
+  key := "default:grpc:method:/grpc.health.v1.Health/Check"
+  if count, _ := store.Get(context.Background(), key); count != 2 {
+    t.Errorf("Expected 2 calls counted for the method, got %d", count)
+  }
+  if blocked, _ := store.IsBlocked(context.Background(), key); blocked {
+    t.Error("Expected the method not to be blocked")
+  }
+}
+
+// TestStreamServerInterceptorDenied tests that denied streams fail with ResourceExhausted
+func TestStreamServerInterceptorDenied(t *testing.T) {
+  mockLimiter := &MockRateLimiter{deny: 1, retryAfter: time.Second}
+  client := startServer(t, NewServerLimiter(mockLimiter))
+
+  stream, err := client.Watch(context.Background(), &healthpb.HealthCheckRequest{})
+  if err != nil {
+    t.Fatalf("Error opening stream: %v", err)
+  }
+  if _, err := stream.Recv(); status.Code(err) != codes.ResourceExhausted {
+    t.Errorf("Expected ResourceExhausted, got %v", err)
+  }
+}
+
+// TestUnaryClientInterceptorRetry tests that the client waits out the retry delay and retries
+func TestUnaryClientInterceptorRetry(t *testing.T) {
+  mockLimiter := &MockRateLimiter{deny: 1, retryAfter: 20 * time.Millisecond}
+  clientLimiter := NewClientLimiter(1)
+  client := startServer(t, NewServerLimiter(mockLimiter), grpc.WithUnaryInterceptor(clientLimiter.UnaryClientInterceptor()))
+
+  start := time.Now()
+  if _, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{}); err != nil {
+    t.Fatalf("Call should succeed after retrying: %v", err)
+  }
+  if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+    t.Errorf("Client should wait for the retry delay, took %v", elapsed)
+  }
+  if len(mockLimiter.keys) != 2 {
+    t.Errorf("Expected 2 calls, got %d", len(mockLimiter.keys))
+  }
+}
+
+// TestUnaryClientInterceptorDeadline tests that the client fails fast when the delay exceeds the deadline
+func TestUnaryClientInterceptorDeadline(t *testing.T) {
+  mockLimiter := &MockRateLimiter{deny: 1, retryAfter: time.Minute}
+  clientLimiter := NewClientLimiter(3)
+  client := startServer(t, NewServerLimiter(mockLimiter), grpc.WithUnaryInterceptor(clientLimiter.UnaryClientInterceptor()))
+
+  ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+  defer cancel()
+
+  start := time.Now()
+  _, err := client.Check(ctx, &healthpb.HealthCheckRequest{})
+  if status.Code(err) != codes.ResourceExhausted {
+    t.Errorf("Expected ResourceExhausted, got %v", err)
+  }
+  if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+    t.Errorf("Client should fail fast, took %v", elapsed)
+  }
+  if len(mockLimiter.keys) != 1 {
+    t.Errorf("Expected 1 call, got %d", len(mockLimiter.keys))
+  }
+}
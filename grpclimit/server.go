@@ -0,0 +1,154 @@
+package grpclimit
+
+import (
+  "context"
+  "net"
+
+  "google.golang.org/genproto/googleapis/rpc/errdetails"
+  "google.golang.org/grpc"
+  "google.golang.org/grpc/codes"
+  "google.golang.org/grpc/metadata"
+  "google.golang.org/grpc/peer"
+  "google.golang.org/grpc/status"
+  "google.golang.org/protobuf/types/known/durationpb"
+  "rate-limiter/interfaces"
+  "rate-limiter/limiter"
+)
+
+const (
+  // TokenMetadata is the metadata key for the API token
+  TokenMetadata = "api_key"
+)
+
+// ServerOption configures a ServerLimiter
+type ServerOption func(s *ServerLimiter)
+
+// ServerLimiter rate limits incoming gRPC calls
+type ServerLimiter struct {
+  limiter    interfaces.RateLimiter
+  methodKeys bool
+  methods    *limiter.RateLimiter
+  methodRule limiter.Rule
+}
+
+// NewServerLimiter creates a new server limiter
+func NewServerLimiter(limiter interfaces.RateLimiter, opts ...ServerOption) *ServerLimiter {
+  s := &ServerLimiter{
+    limiter: limiter,
+  }
+  for _, opt := range opts {
+    opt(s)
+  }
+  return s
+}
+
+// WithMethodKeys gives every method its own budget per token or address
+func WithMethodKeys() ServerOption {
+  return func(s *ServerLimiter) {
+    s.methodKeys = true
+  }
+}
+
+// WithMethodOnlyKeys gives every method a single budget shared by all
+// callers, counted by its own rule under the method dimension. The rule only
+// rejects, since a block or penalty would deny the method to every caller.
+func WithMethodOnlyKeys(rl *limiter.RateLimiter, rule limiter.Rule) ServerOption {
+  rule.Mode = limiter.ModeReject
+  rule.SkipDenied = true
+  return func(s *ServerLimiter) {
+    s.methods = rl
+    s.methodRule = rule
+  }
+}
+
+// UnaryServerInterceptor returns an interceptor that rate limits unary calls
+func (s *ServerLimiter) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+  return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+    if err := s.check(ctx, info.FullMethod); err != nil {
+      return nil, err
+    }
+    return handler(ctx, req)
+  }
+}
+
+// StreamServerInterceptor returns an interceptor that rate limits streams
+// when they are opened
+func (s *ServerLimiter) StreamServerInterceptor() grpc.StreamServerInterceptor {
+  return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+    if err := s.check(ss.Context(), info.FullMethod); err != nil {
+      return err
+    }
+    return handler(srv, ss)
+  }
+}
+
+// check runs the rate limit check for a call, token-based limiting takes
+// precedence over the peer address like in the HTTP middleware unless calls
+// are only keyed by method
+func (s *ServerLimiter) check(ctx context.Context, method string) error {
+  var result interfaces.Result
+  var err error
+
+  if s.methods != nil {
+    result, err = s.methods.CheckMethod(ctx, s.methodRule, method, 1)
+  } else if token := tokenFromMetadata(ctx); token != "" {
+    result, err = s.limiter.CheckToken(ctx, s.key(method, token), 1)
+  } else {
+    result, err = s.limiter.CheckIP(ctx, s.key(method, peerIP(ctx)), 1)
+  }
+  if err != nil {
+    return status.Error(codes.Internal, "internal server error")
+  }
+  if !result.Allowed {
+    return rateLimitExceededError(result)
+  }
+  return nil
+}
+
+// key returns the limiter key for a call
+func (s *ServerLimiter) key(method, key string) string {
+  if s.methodKeys {
+    return method + "|" + key
+  }
+  return key
+}
+
+// Helper function to get the API token from the incoming metadata
+func tokenFromMetadata(ctx context.Context) string {
+  md, ok := metadata.FromIncomingContext(ctx)
+  if !ok {
+    return ""
+  }
+  if values := md.Get(TokenMetadata); len(values) > 0 {
+    return values[0]
+  }
+  return ""
+}
+
+// Helper function to get the IP address of the peer
+func peerIP(ctx context.Context) string {
+  p, ok := peer.FromContext(ctx)
+  if !ok || p.Addr == nil {
+    return ""
+  }
+  ip, _, err := net.SplitHostPort(p.Addr.String())
+  if err != nil {
+    return p.Addr.String()
+  }
+  return ip
+}
+
+// Helper function to build the error for a denied call, carrying the retry
+// delay in the status details
+func rateLimitExceededError(result interfaces.Result) error {
+  st := status.New(codes.ResourceExhausted, "rate limit exceeded")
+  if result.RetryAfter <= 0 {
+    return st.Err()
+  }
+
+  detailed, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(result.RetryAfter)})
+  if err != nil {
+    return st.Err()
+  }
+  return detailed.Err()
+}
@@ -2,16 +2,165 @@ package interfaces
 
 import (
   "context"
+  "errors"
+  "time"
 )
 
+// ErrInvalidKey is returned for keys that do not follow the key scheme
+var ErrInvalidKey = errors.New("invalid key")
+
+// retryKey is the context key marking the retries of a denied request
+type retryKey struct{}
+
+// WithRetry returns a context marking a check as the retry of a request
+// already denied once, such as in wait mode, so its denial is not counted
+// again in usage
+func WithRetry(ctx context.Context) context.Context {
+  return context.WithValue(ctx, retryKey{}, true)
+}
+
+// IsRetry reports whether the context marks the retry of a denied request
+func IsRetry(ctx context.Context) bool {
+  retry, _ := ctx.Value(retryKey{}).(bool)
+  return retry
+}
+
+// Result describes the outcome of a rate limit check
+type Result struct {
+  // Allowed reports whether the request may proceed
+  Allowed bool
+
+  // OverLimit reports whether the request exceeded its limit, which in
+  // dry-run mode is recorded without denying the request
+  OverLimit bool
+
+  // Rule is the name of the rule that evaluated the request
+  Rule string
+
+  // Limit is the number of units allowed per window
+  Limit int
+
+  // Remaining is the number of units left in the current window
+  Remaining int
+
+  // Reset is how long until the current window frees up
+  Reset time.Duration
+
+  // RetryAfter is how long a denied request should wait before retrying,
+  // zero when unknown such as for permanent bans
+  RetryAfter time.Duration
+
+  // Class is the priority class of the request, empty without priorities
+  Class string
+
+  // ClassRemaining is the number of units of the global capacity left to
+  // the priority class of the request
+  ClassRemaining int
+}
+
 // RateLimiter defines the interface for rate limiters
 type RateLimiter interface {
-  // CheckIP checks if an IP address has exceeded its rate limit
-  CheckIP(ctx context.Context, ip string) (bool, error)
+  // CheckIP checks if an IP address has exceeded its rate limit, charging
+  // cost units against its budget
+  CheckIP(ctx context.Context, ip string, cost int) (Result, error)
 
-  // CheckToken checks if a token has exceeded its rate limit
-  CheckToken(ctx context.Context, token string) (bool, error)
+  // CheckToken checks if a token has exceeded its rate limit, charging cost
+  // units against its budget
+  CheckToken(ctx context.Context, token string, cost int) (Result, error)
 
   // Close closes the rate limiter
   Close() error
 }
+
+// Level is one limit of a hierarchy checked in a single decision, such as a
+// user within an organization within a global ceiling
+type Level struct {
+  // Name identifies the level, it is reported as the rule of the result
+  Name string
+
+  // Dimension and Value identify the limited key within the level, tokens
+  // use the "token" dimension so they are hashed
+  Dimension string
+  Value     string
+
+  // Limit is the number of cost units allowed per Expiration
+  Limit      int
+  Expiration time.Duration
+}
+
+// HierarchicalLimiter defines the interface for checking a request against a
+// chain of limits at once
+type HierarchicalLimiter interface {
+  // CheckLevels charges cost units to every level only if all of them allow
+  // it, the result reports the denying level
+  CheckLevels(ctx context.Context, levels []Level, cost int) (Result, error)
+
+  // RefundLevels gives back cost units charged to every level
+  RefundLevels(ctx context.Context, levels []Level, cost int) error
+}
+
+// CapacityLimiter defines the interface for charging a capacity shared by
+// every client, which is not a client itself so only its own counter counts
+type CapacityLimiter interface {
+  // CheckCapacity charges cost units to the level if it allows them
+  CheckCapacity(ctx context.Context, level Level, cost int) (Result, error)
+
+  // RefundCapacity gives back cost units charged to the level
+  RefundCapacity(ctx context.Context, level Level, cost int) error
+}
+
+// ConcurrencyLimiter defines the interface for limiting in-flight requests
+type ConcurrencyLimiter interface {
+  // AcquireIP takes a concurrency slot for an IP address, the returned
+  // function must be called once the request completes
+  AcquireIP(ctx context.Context, ip string) (func(), bool, error)
+
+  // AcquireToken takes a concurrency slot for a token, the returned function
+  // must be called once the request completes
+  AcquireToken(ctx context.Context, token string) (func(), bool, error)
+}
+
+// LoadObserver defines the interface for reporting how the backend copes
+// with the requests it was handed
+type LoadObserver interface {
+  // Observe reports the latency of a request and whether it failed
+  Observe(latency time.Duration, failed bool)
+}
+
+// Refunder defines the interface for giving back units consumed by a request
+type Refunder interface {
+  // RefundIP gives back cost units charged to an IP address
+  RefundIP(ctx context.Context, ip string, cost int) error
+
+  // RefundToken gives back cost units charged to a token
+  RefundToken(ctx context.Context, token string, cost int) error
+}
+
+// FailureLimiter defines the interface for limiting failed attempts, such as
+// logins, where only failures count towards the limit
+type FailureLimiter interface {
+  // Locked reports whether a key is locked out after too many failures
+  Locked(ctx context.Context, key string) (Result, error)
+
+  // RecordFailure counts a failed attempt for a key and locks it out once the
+  // limit is reached
+  RecordFailure(ctx context.Context, key string) (Result, error)
+
+  // ReserveAttempt counts an attempt as failed before it is made, so parallel
+  // attempts cannot all pass the lockout check. It is denied if the key is
+  // locked out or its pending and failed attempts already reach the limit.
+  ReserveAttempt(ctx context.Context, key string) (Result, error)
+
+  // SettleAttempt settles a reserved attempt, giving it back if it did not
+  // fail or locking the key out once its failures reach the limit
+  SettleAttempt(ctx context.Context, key string, failed bool) (Result, error)
+
+  // ResetFailures forgets the failed attempts of a key
+  ResetFailures(ctx context.Context, key string) error
+}
+
+// BlockManager defines the interface for managing blocked keys
+type BlockManager interface {
+  // Unblock lifts any block or permanent ban on a key
+  Unblock(ctx context.Context, key string) error
+}
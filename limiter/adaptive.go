@@ -0,0 +1,149 @@
+package limiter
+
+import (
+  "expvar"
+  "sync"
+  "time"
+
+  "rate-limiter/interfaces"
+  "rate-limiter/metrics"
+)
+
+// Ensure Adaptive implements the interfaces.LoadObserver interface
+var _ interfaces.LoadObserver = (*Adaptive)(nil)
+
+// AdaptiveConfig sets when and how far adaptive limits move
+type AdaptiveConfig struct {
+  // TargetLatency is the highest mean latency of a healthy backend
+  TargetLatency time.Duration
+
+  // MaxErrorRate is the highest share of failed requests of a healthy
+  // backend, between 0 and 1
+  MaxErrorRate float64
+
+  // Decrease is the factor limits are multiplied by when the backend is
+  // unhealthy, between 0 and 1
+  Decrease float64
+
+  // Increase is the share of the configured limits added back after every
+  // healthy interval
+  Increase float64
+
+  // Min and Max bound the share of the configured limits in effect
+  Min float64
+  Max float64
+
+  // Interval is how often the backend health is evaluated
+  Interval time.Duration
+
+  // MinSamples is the number of requests an interval needs before limits
+  // are lowered, so a single slow request does not shed traffic
+  MinSamples int
+}
+
+// Adaptive scales limits with the health of the backend: they are lowered
+// multiplicatively when latency or errors exceed their targets and raised
+// additively while the backend recovers
+type Adaptive struct {
+  cfg AdaptiveConfig
+  now func() time.Time
+
+  mutex       sync.Mutex
+  factor      float64
+  windowStart time.Time
+  samples     int
+  failures    int
+  latency     time.Duration
+}
+
+// NewAdaptive creates an adaptive scale starting at the upper bound
+func NewAdaptive(cfg AdaptiveConfig) *Adaptive {
+  a := &Adaptive{cfg: cfg, now: time.Now, factor: cfg.Max}
+  a.windowStart = a.now()
+  metrics.Adaptive.Set("factor", floatVar(a.factor))
+  return a
+}
+
+// Observe records the latency and outcome of a request handed to the backend
+func (a *Adaptive) Observe(latency time.Duration, failed bool) {
+  a.mutex.Lock()
+  defer a.mutex.Unlock()
+
+  a.evaluate()
+  a.samples++
+  a.latency += latency
+  if failed {
+    a.failures++
+  }
+}
+
+// Factor returns the share of the configured limits currently in effect
+func (a *Adaptive) Factor() float64 {
+  a.mutex.Lock()
+  defer a.mutex.Unlock()
+
+  a.evaluate()
+  return a.factor
+}
+
+// evaluate adjusts the factor once the current interval is over
+func (a *Adaptive) evaluate() {
+  now := a.now()
+  if now.Sub(a.windowStart) < a.cfg.Interval {
+    return
+  }
+
+  var latency time.Duration
+  var errorRate float64
+  if a.samples > 0 {
+    latency = a.latency / time.Duration(a.samples)
+    errorRate = float64(a.failures) / float64(a.samples)
+  }
+
+  unhealthy := a.samples >= a.cfg.MinSamples && (latency > a.cfg.TargetLatency || errorRate > a.cfg.MaxErrorRate)
+  if unhealthy {
+    a.factor *= a.cfg.Decrease
+  } else {
+    a.factor += a.cfg.Increase
+  }
+  if a.factor < a.cfg.Min {
+    a.factor = a.cfg.Min
+  }
+  if a.factor > a.cfg.Max {
+    a.factor = a.cfg.Max
+  }
+
+  metrics.Adaptive.Set("factor", floatVar(a.factor))
+  metrics.Adaptive.Set("latency_ms", floatVar(float64(latency)/float64(time.Millisecond)))
+  metrics.Adaptive.Set("error_rate", floatVar(errorRate))
+
+  a.windowStart = now
+  a.samples, a.failures, a.latency = 0, 0, 0
+}
+
+// adapt returns the rule with its limit scaled by the adaptive factor, rules
+// keep at least one unit
+func (rl *RateLimiter) adapt(rule Rule) Rule {
+  if rl.adaptive == nil || rule.Limit <= 0 {
+    return rule
+  }
+  limit := int(float64(rule.Limit) * rl.adaptive.Factor())
+  if limit < 1 {
+    limit = 1
+  }
+  rule.Limit = limit
+  return rule
+}
+
+// Adaptive returns the adaptive scale of the limits, nil when limits are
+// fixed
+func (rl *RateLimiter) Adaptive() *Adaptive {
+  return rl.adaptive
+}
+
+// Helper function to build a float metric
+func floatVar(value float64) *expvar.Float {
+  v := new(expvar.Float)
+  v.Set(value)
+  return v
+}
@@ -0,0 +1,96 @@
+package limiter
+
+import (
+  "context"
+  "testing"
+  "time"
+
+  "rate-limiter/config"
+)
+
+func TestAdaptive(t *testing.T) {
+  a := NewAdaptive(AdaptiveConfig{
+    TargetLatency: 100 * time.Millisecond,
+    MaxErrorRate:  0.1,
+    Decrease:      0.5,
+    Increase:      0.2,
+    Min:           0.2,
+    Max:           1,
+    Interval:      time.Second,
+    MinSamples:    2,
+  })
+  now := time.Unix(1000, 0)
+  a.now = func() time.Time { return now }
+  a.windowStart = now
+
+  steps := []struct {
+    latency time.Duration
+    failed  bool
+    samples int
+    want    float64
+  }{
+    // Slow responses halve the limits down to the lower bound
+    {latency: 300 * time.Millisecond, samples: 5, want: 0.5},
+    {latency: 300 * time.Millisecond, samples: 5, want: 0.25},
+    {latency: 300 * time.Millisecond, samples: 5, want: 0.2},
+    // Too few requests are not enough to lower the limits
+    {latency: 300 * time.Millisecond, samples: 1, want: 0.4},
+    // Healthy intervals raise them additively up to the upper bound
+    {latency: 50 * time.Millisecond, samples: 5, want: 0.6},
+    // Errors lower them as well
+    {latency: 50 * time.Millisecond, failed: true, samples: 5, want: 0.3},
+    {samples: 0, want: 0.5},
+    {samples: 0, want: 0.7},
+    {samples: 0, want: 0.9},
+    {samples: 0, want: 1},
+  }
+
+  for i, step := range steps {
+    for j := 0; j < step.samples; j++ {
+      a.Observe(step.latency, step.failed)
+    }
+    now = now.Add(time.Second)
+    if factor := a.Factor(); factor < step.want-1e-9 || factor > step.want+1e-9 {
+      t.Errorf("Step %d: expected factor %.2f, got %.2f", i+1, step.want, factor)
+    }
+  }
+}
+
+func TestRateLimiterAdaptive(t *testing.T) {
+  ctx := context.Background()
+  cfg := &config.Config{
+    IPLimit:               10,
+    IPExpiration:          60,
+    BlockDuration:         300,
+    AdaptiveLimits:        true,
+    AdaptiveTargetLatency: 100,
+    AdaptiveDecrease:      50,
+    AdaptiveIncrease:      10,
+    AdaptiveMin:           10,
+    AdaptiveMax:           100,
+    AdaptiveInterval:      1,
+    AdaptiveMinSamples:    1,
+  }
+  limiter := NewRateLimiter(cfg, NewMockStorage())
+  now := time.Unix(1000, 0)
+  limiter.Adaptive().now = func() time.Time { return now }
+  limiter.Adaptive().windowStart = now
+
+  // The backend slows down and the effective limit is halved
+  limiter.Adaptive().Observe(time.Second, false)
+  now = now.Add(time.Second)
+
+  for i := 0; i < 5; i++ {
+    result, err := limiter.CheckIP(ctx, "192.168.1.1", 1)
+    if err != nil {
+      t.Fatalf("Unexpected error: %v", err)
+    }
+    if !result.Allowed || result.Limit != 5 {
+      t.Errorf("Expected request %d to be allowed with a limit of 5, got %+v", i+1, result)
+    }
+  }
+  result, _ := limiter.CheckIP(ctx, "192.168.1.1", 1)
+  if result.Allowed {
+    t.Errorf("Expected the request over the halved limit to be denied")
+  }
+}
@@ -0,0 +1,67 @@
+package limiter
+
+import (
+  "context"
+  "time"
+)
+
+// seenMemory is how long a key is remembered after its last request, keys
+// unseen for longer warm up again
+const seenMemory = 30 * 24 * time.Hour
+
+// warmUp scales the limit and burst of a rule for keys first seen less than
+// its warm-up ago, ramping linearly from the start fraction up to the full rule
+func (rl *RateLimiter) warmUp(ctx context.Context, rule Rule, k Key) (Rule, error) {
+  if rule.WarmUp <= 0 || rule.Limit <= 0 {
+    return rule, nil
+  }
+
+  first, err := rl.storage.FirstSeen(ctx, k.seen().String(), seenMemory)
+  if err != nil {
+    return rule, err
+  }
+  age := rl.now().Sub(first)
+  if age >= rule.WarmUp {
+    return rule, nil
+  }
+  if age < 0 {
+    age = 0
+  }
+
+  factor := rule.WarmUpStart + (1-rule.WarmUpStart)*float64(age)/float64(rule.WarmUp)
+  limit := int(float64(rule.Limit) * factor)
+  if limit < 1 {
+    limit = 1
+  }
+  rule.Limit = limit
+  rule.Burst = int(float64(rule.Burst) * factor)
+  return rule, nil
+}
+
+// burst charges the units of a request above the rule's limit to the key's
+// burst allowance, reporting whether the allowance covered them
+func (rl *RateLimiter) burst(ctx context.Context, rule Rule, k Key, count, cost int) (bool, error) {
+  if rule.Burst <= 0 {
+    return false, nil
+  }
+
+  // Only the part of the request past the limit spends the allowance
+  excess := count - rule.Limit
+  if excess > cost {
+    excess = cost
+  }
+
+  window := rule.BurstWindow
+  if window <= 0 {
+    window = rule.Expiration
+  }
+  key := k.burst().String()
+  spent, err := rl.storage.IncrementBy(ctx, key, excess, window)
+  if err != nil || spent <= rule.Burst {
+    return err == nil, err
+  }
+
+  // Denied requests do not eat into the allowance
+  _, err = rl.storage.Decrement(ctx, key, excess)
+  return false, err
+}
@@ -0,0 +1,105 @@
+package limiter
+
+import (
+  "context"
+  "testing"
+  "time"
+
+  "rate-limiter/config"
+)
+
+func TestRateLimiterBurst(t *testing.T) {
+  ctx := context.Background()
+  mockStorage := NewMockStorage()
+
+  cfg := &config.Config{
+    IPLimit:       2,
+    IPExpiration:  60,
+    IPBurst:       3,
+    BurstWindow:   3600,
+    BlockDuration: 300,
+  }
+  limiter := NewRateLimiter(cfg, mockStorage)
+
+  ip := "192.168.1.1"
+
+  // Should allow the limit and then the burst, with nothing remaining
+  for i := 0; i < 4; i++ {
+    result, err := limiter.CheckIP(ctx, ip, 1)
+    if err != nil {
+      t.Fatalf("Unexpected error: %v", err)
+    }
+    if !result.Allowed || result.OverLimit {
+      t.Errorf("Expected request %d to be allowed, got %+v", i+1, result)
+    }
+  }
+  if mockStorage.lastExpiration != time.Hour {
+    t.Errorf("Expected the burst to refill after an hour, got %v", mockStorage.lastExpiration)
+  }
+
+  // Only the units past the limit spend the burst
+  result, err := limiter.CheckIP(ctx, ip, 2)
+  if err != nil {
+    t.Fatalf("Unexpected error: %v", err)
+  }
+  if result.Allowed {
+    t.Error("Expected request over the burst to be denied")
+  }
+  if mockStorage.counters["default:ip:ip.burst:"+ip] != 2 {
+    t.Errorf("Expected the denied request not to spend the burst, got %d", mockStorage.counters["default:ip:ip.burst:"+ip])
+  }
+  if !mockStorage.blockedKeys["default:ip:ip:"+ip] {
+    t.Error("Expected the IP to be blocked once the burst is spent")
+  }
+}
+
+func TestRateLimiterWarmUp(t *testing.T) {
+  ctx := context.Background()
+  mockStorage := NewMockStorage()
+
+  cfg := &config.Config{
+    TokenLimit:      100,
+    TokenExpiration: 60,
+    TokenBurst:      20,
+    TokenWarmUp:     600,
+    WarmUpStart:     10,
+    BlockDuration:   300,
+  }
+  limiter := NewRateLimiter(cfg, mockStorage)
+  now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+  limiter.now = func() time.Time { return now }
+
+  token := "new-token"
+  seen := "default:token:token.seen:" + limiter.tokenHasher.Hash(token)
+
+  tests := []struct {
+    age          time.Duration
+    limit, burst int
+  }{
+    {0, 10, 2},
+    {5 * time.Minute, 55, 11},
+    {10 * time.Minute, 100, 20},
+    {time.Hour, 100, 20},
+  }
+
+  for _, tt := range tests {
+    mockStorage.firstSeen[seen] = now.Add(-tt.age)
+    rule, err := limiter.warmUp(ctx, limiter.tokenRule, limiter.tokenKey(token))
+    if err != nil {
+      t.Fatalf("Unexpected error: %v", err)
+    }
+    if rule.Limit != tt.limit || rule.Burst != tt.burst {
+      t.Errorf("After %v: expected limit %d and burst %d, got %d and %d", tt.age, tt.limit, tt.burst, rule.Limit, rule.Burst)
+    }
+  }
+
+  // A brand-new token only gets the start of the ramp
+  mockStorage.firstSeen[seen] = now
+  result, err := limiter.CheckToken(ctx, token, 1)
+  if err != nil {
+    t.Fatalf("Unexpected error: %v", err)
+  }
+  if !result.Allowed || result.Limit != 10 || result.Remaining != 9 {
+    t.Errorf("Expected a new token to be allowed with a limit of 10, got %+v", result)
+  }
+}
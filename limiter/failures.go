@@ -0,0 +1,111 @@
+package limiter
+
+import (
+  "context"
+  "time"
+
+  "rate-limiter/interfaces"
+)
+
+// Locked reports whether a key is locked out after too many failures
+func (rl *RateLimiter) Locked(ctx context.Context, key string) (interfaces.Result, error) {
+  key = rl.failureKey(key).String()
+  result := interfaces.Result{Rule: rl.failureRule.Name, Limit: rl.failureRule.Limit, Allowed: true}
+
+  blocked, err := rl.storage.IsBlocked(ctx, key)
+  if err != nil || !blocked {
+    return result, err
+  }
+
+  result.Allowed = false
+  result.RetryAfter, err = rl.storage.BlockTTL(ctx, key)
+  result.Reset = result.RetryAfter
+  return result, err
+}
+
+// RecordFailure counts a failed attempt for a key and locks it out for the
+// lockout duration once the failure limit is reached inside the window
+func (rl *RateLimiter) RecordFailure(ctx context.Context, key string) (interfaces.Result, error) {
+  key = rl.failureKey(key).String()
+  rule := rl.failureRule
+  result := interfaces.Result{Rule: rule.Name, Limit: rule.Limit, Allowed: true, Reset: rule.Expiration}
+
+  failures, err := rl.storage.Increment(ctx, key, rule.Expiration)
+  if err != nil {
+    return result, err
+  }
+  return rl.lockOut(ctx, key, failures, result)
+}
+
+// ReserveAttempt counts an attempt as failed before it is made, denying it if
+// the key is locked out or its pending and failed attempts reach the limit
+func (rl *RateLimiter) ReserveAttempt(ctx context.Context, key string) (interfaces.Result, error) {
+  result, err := rl.Locked(ctx, key)
+  if err != nil || !result.Allowed {
+    return result, err
+  }
+
+  key = rl.failureKey(key).String()
+  rule := rl.failureRule
+  counts, denied, err := rl.storage.IncrementAll(ctx, []string{key}, 1, []int{rule.Limit}, []time.Duration{rule.Expiration})
+  if err != nil {
+    return result, err
+  }
+  if denied >= 0 {
+    result.Allowed = false
+    result.RetryAfter, err = rl.storage.TTL(ctx, key)
+    result.Reset = result.RetryAfter
+    return result, err
+  }
+  result.Remaining = rule.Limit - counts[0]
+  result.Reset = rule.Expiration
+  return result, nil
+}
+
+// SettleAttempt gives back a reserved attempt that did not fail, or locks the
+// key out once its failures reach the limit
+func (rl *RateLimiter) SettleAttempt(ctx context.Context, key string, failed bool) (interfaces.Result, error) {
+  key = rl.failureKey(key).String()
+  rule := rl.failureRule
+  result := interfaces.Result{Rule: rule.Name, Limit: rule.Limit, Allowed: true, Reset: rule.Expiration}
+
+  if !failed {
+    failures, err := rl.storage.Decrement(ctx, key, 1)
+    result.Remaining = rule.Limit - failures
+    return result, err
+  }
+
+  failures, err := rl.storage.Get(ctx, key)
+  if err != nil {
+    return result, err
+  }
+  return rl.lockOut(ctx, key, failures, result)
+}
+
+// lockOut locks a key out for the lockout duration once its failures reach
+// the limit
+func (rl *RateLimiter) lockOut(ctx context.Context, key string, failures int, result interfaces.Result) (interfaces.Result, error) {
+  if failures < rl.failureRule.Limit {
+    result.Remaining = rl.failureRule.Limit - failures
+    return result, nil
+  }
+
+  // The lockout starts a fresh window once it is lifted
+  if err := rl.storage.Reset(ctx, key); err != nil {
+    return result, err
+  }
+  result.Allowed = false
+  result.RetryAfter = rl.failureLockout
+  result.Reset = rl.failureLockout
+  return result, rl.storage.Block(ctx, key, rl.failureLockout)
+}
+
+// ResetFailures forgets the failed attempts of a key
+func (rl *RateLimiter) ResetFailures(ctx context.Context, key string) error {
+  return rl.storage.Reset(ctx, rl.failureKey(key).String())
+}
+
+// failureKey namespaces a key by the failure rule
+func (rl *RateLimiter) failureKey(key string) Key {
+  return rl.key(rl.failureRule.Name, "login", key)
+}
@@ -0,0 +1,104 @@
+package limiter
+
+import (
+  "context"
+  "testing"
+  "time"
+
+  "rate-limiter/config"
+)
+
+// TestRateLimiterFailures tests the lockout after repeated failures
+func TestRateLimiterFailures(t *testing.T) {
+  mockStorage := NewMockStorage()
+
+  cfg := &config.Config{
+    FailureLimit:   3,
+    FailureWindow:  900,
+    FailureLockout: 600,
+  }
+
+  limiter := NewRateLimiter(cfg, mockStorage)
+
+  key := "192.168.1.1:alice"
+  ctx := context.Background()
+
+  // Failures below the limit only count
+  for i := 0; i < 2; i++ {
+    result, err := limiter.RecordFailure(ctx, key)
+    if err != nil {
+      t.Errorf("Error recording failure: %v", err)
+    }
+    if !result.Allowed {
+      t.Errorf("Failure %d should not lock the key out", i+1)
+    }
+  }
+
+  // A success forgets them
+  if err := limiter.ResetFailures(ctx, key); err != nil {
+    t.Errorf("Error resetting failures: %v", err)
+  }
+  for i := 0; i < 2; i++ {
+    limiter.RecordFailure(ctx, key)
+  }
+  result, _ := limiter.Locked(ctx, key)
+  if !result.Allowed {
+    t.Error("Key should not be locked out after a reset")
+  }
+
+  // Reaching the limit locks the key out
+  result, err := limiter.RecordFailure(ctx, key)
+  if err != nil {
+    t.Errorf("Error recording failure: %v", err)
+  }
+  if result.Allowed || result.RetryAfter != 600*time.Second {
+    t.Errorf("Expected a lockout of 600s, got %+v", result)
+  }
+  if mockStorage.lastBlockDuration != 600*time.Second {
+    t.Errorf("Expected a block of 600s, got %v", mockStorage.lastBlockDuration)
+  }
+
+  result, _ = limiter.Locked(ctx, key)
+  if result.Allowed {
+    t.Error("Key should be locked out")
+  }
+}
+
+// TestRateLimiterReserveAttempt tests that pending attempts count towards the limit until settled
+func TestRateLimiterReserveAttempt(t *testing.T) {
+  mockStorage := NewMockStorage()
+  limiter := NewRateLimiter(&config.Config{FailureLimit: 2, FailureWindow: 900, FailureLockout: 600}, mockStorage)
+
+  key := "192.168.1.1:alice"
+  ctx := context.Background()
+
+  // Pending attempts hold the remaining failures
+  for i := 0; i < 2; i++ {
+    if result, err := limiter.ReserveAttempt(ctx, key); err != nil || !result.Allowed {
+      t.Fatalf("Attempt %d should be reserved: %+v, %v", i+1, result, err)
+    }
+  }
+  if result, _ := limiter.ReserveAttempt(ctx, key); result.Allowed {
+    t.Error("Attempts over the limit should be denied while others are pending")
+  }
+
+  // A successful attempt is given back
+  if _, err := limiter.SettleAttempt(ctx, key, false); err != nil {
+    t.Fatalf("Error settling attempt: %v", err)
+  }
+  if result, _ := limiter.ReserveAttempt(ctx, key); !result.Allowed {
+    t.Error("A given back attempt should free a reservation")
+  }
+
+  // A failure locks the key out once it and the pending attempts reach the limit
+  result, err := limiter.SettleAttempt(ctx, key, true)
+  if err != nil {
+    t.Fatalf("Error settling attempt: %v", err)
+  }
+  if result.Allowed || result.RetryAfter != 600*time.Second {
+    t.Errorf("Expected a lockout of 600s, got %+v", result)
+  }
+  if result, _ := limiter.Locked(ctx, key); result.Allowed {
+    t.Error("Key should be locked out")
+  }
+}
@@ -0,0 +1,104 @@
+package limiter
+
+import (
+  "context"
+  "crypto/hmac"
+  "crypto/sha256"
+  "encoding/hex"
+
+  "rate-limiter/interfaces"
+)
+
+// tokenHashSize is the number of HMAC bytes kept in token identifiers
+const tokenHashSize = 16
+
+// TokenHasher derives the identifiers of API tokens used in storage keys,
+// logs and metrics with HMAC-SHA256, so raw tokens never leave the process.
+// Previous secrets keep the state of tokens while a secret is rotated.
+type TokenHasher struct {
+  secrets [][]byte
+}
+
+// NewTokenHasher creates a token hasher with the current secret and the
+// secrets it replaces, or nil when no secret is configured
+func NewTokenHasher(secret string, previous ...string) *TokenHasher {
+  if secret == "" {
+    return nil
+  }
+
+  h := &TokenHasher{secrets: [][]byte{[]byte(secret)}}
+  for _, s := range previous {
+    if s != "" && s != secret {
+      h.secrets = append(h.secrets, []byte(s))
+    }
+  }
+  return h
+}
+
+// Hash returns the identifier of a token under the current secret, a nil
+// hasher returns the token unchanged
+func (h *TokenHasher) Hash(token string) string {
+  if h == nil {
+    return token
+  }
+  return hashWith(h.secrets[0], token)
+}
+
+// Hashes returns the identifiers of a token under the current secret and then
+// under each previous one, so lists of identifiers still match during a
+// rotation. A nil hasher returns the token unchanged.
+func (h *TokenHasher) Hashes(token string) []string {
+  if h == nil {
+    return []string{token}
+  }
+  return append([]string{h.Hash(token)}, h.previous(token)...)
+}
+
+// previous returns the identifiers of a token under the previous secrets
+func (h *TokenHasher) previous(token string) []string {
+  if h == nil {
+    return nil
+  }
+
+  hashes := make([]string, 0, len(h.secrets)-1)
+  for _, secret := range h.secrets[1:] {
+    hashes = append(hashes, hashWith(secret, token))
+  }
+  return hashes
+}
+
+// Helper function to compute the identifier of a token with a secret
+func hashWith(secret []byte, token string) string {
+  mac := hmac.New(sha256.New, secret)
+  mac.Write([]byte(token))
+  return hex.EncodeToString(mac.Sum(nil)[:tokenHashSize])
+}
+
+// rotate carries the state a token gathered under previous secrets over to
+// its current key k. Blocks stored under previous identifiers still apply,
+// while counters, penalties, first sightings and quotas are moved to k so a
+// rotation starts no fresh windows or quotas.
+func (rl *RateLimiter) rotate(ctx context.Context, rule Rule, k Key, token string) (interfaces.Result, bool, error) {
+  for _, previous := range rl.tokenHasher.previous(token) {
+    old := k
+    old.Value = previous
+    if result, blocked, err := rl.blocked(ctx, rule, old); err != nil || blocked {
+      return result, blocked, err
+    }
+    if _, err := rl.storage.Merge(ctx, rl.stateKeys(old), rl.stateKeys(k)); err != nil {
+      return interfaces.Result{}, false, err
+    }
+  }
+  return interfaces.Result{}, false, nil
+}
+
+// stateKeys lists the keys holding the state of a client key
+func (rl *RateLimiter) stateKeys(k Key) []string {
+  keys := []string{k.String(), k.burst().String(), k.offenses().String(), k.seen().String()}
+  now := rl.now()
+  for _, quota := range rl.quotas {
+    start, _ := quota.Period.window(now, rl.quotaLocation)
+    keys = append(keys, rl.quotaKey(quota, k, start).String())
+  }
+  return keys
+}
@@ -0,0 +1,154 @@
+package limiter
+
+import (
+  "context"
+  "strings"
+  "testing"
+
+  "rate-limiter/config"
+)
+
+// TestTokenHasher tests that token identifiers depend on the secret only
+func TestTokenHasher(t *testing.T) {
+  h := NewTokenHasher("secret")
+
+  if h.Hash("token") != h.Hash("token") {
+    t.Error("Expected the hash to be stable")
+  }
+  if h.Hash("token") == NewTokenHasher("other").Hash("token") {
+    t.Error("Expected the hash to depend on the secret")
+  }
+  if len(h.Hash("token")) != 2*tokenHashSize {
+    t.Errorf("Expected %d hex characters, got %q", 2*tokenHashSize, h.Hash("token"))
+  }
+
+  // Without a secret tokens are used as they are
+  if NewTokenHasher("").Hash("token") != "token" {
+    t.Error("Expected a nil hasher to keep the token")
+  }
+
+  // Identifiers under previous secrets follow the current one
+  hashes := NewTokenHasher("secret", "old").Hashes("token")
+  if len(hashes) != 2 || hashes[0] != h.Hash("token") || hashes[1] != NewTokenHasher("old").Hash("token") {
+    t.Errorf("Expected the identifiers under both secrets, got %v", hashes)
+  }
+}
+
+// TestRateLimiterTokenHashing tests that raw tokens never reach storage
+func TestRateLimiterTokenHashing(t *testing.T) {
+  mockStorage := NewMockStorage()
+
+  cfg := &config.Config{
+    TokenLimit:      1,
+    TokenExpiration: 300,
+    BlockDuration:   300,
+    TokenHashSecret: "secret",
+  }
+
+  limiter := NewRateLimiter(cfg, mockStorage)
+
+  token := "customer-credential"
+  ctx := context.Background()
+
+  for i := 0; i < 2; i++ {
+    limiter.CheckToken(ctx, token, 1)
+  }
+
+  for key := range mockStorage.counters {
+    if strings.Contains(key, token) {
+      t.Errorf("Raw token stored in counter %q", key)
+    }
+  }
+  for key := range mockStorage.blockedKeys {
+    if strings.Contains(key, token) {
+      t.Errorf("Raw token stored in block %q", key)
+    }
+  }
+  if !mockStorage.blockedKeys["default:token:token:"+NewTokenHasher("secret").Hash(token)] {
+    t.Error("Token should be blocked under its hash")
+  }
+}
+
+// TestRateLimiterTokenHashRotation tests that blocks survive a secret rotation
+func TestRateLimiterTokenHashRotation(t *testing.T) {
+  mockStorage := NewMockStorage()
+
+  cfg := &config.Config{
+    TokenLimit:      1,
+    TokenExpiration: 300,
+    BlockDuration:   300,
+    TokenHashSecret: "old",
+  }
+
+  token := "customer-credential"
+  ctx := context.Background()
+
+  // Block the token under the old secret
+  limiter := NewRateLimiter(cfg, mockStorage)
+  for i := 0; i < 2; i++ {
+    limiter.CheckToken(ctx, token, 1)
+  }
+
+  // During the rotation the block still applies
+  cfg.TokenHashSecret = "new"
+  cfg.TokenHashPreviousSecrets = []string{"old"}
+  limiter = NewRateLimiter(cfg, mockStorage)
+
+  result, err := limiter.CheckToken(ctx, token, 1)
+  if err != nil {
+    t.Errorf("Error checking token: %v", err)
+  }
+  if result.Allowed {
+    t.Error("Token blocked under the previous secret should stay blocked")
+  }
+
+  // Once the old secret is dropped it no longer applies
+  cfg.TokenHashPreviousSecrets = nil
+  limiter = NewRateLimiter(cfg, mockStorage)
+
+  result, _ = limiter.CheckToken(ctx, token, 1)
+  if !result.Allowed {
+    t.Error("Token should be allowed once the previous secret is dropped")
+  }
+}
+
+// TestRateLimiterTokenHashRotationState tests that counters carry over a secret rotation
+func TestRateLimiterTokenHashRotationState(t *testing.T) {
+  mockStorage := NewMockStorage()
+
+  cfg := &config.Config{
+    TokenLimit:      3,
+    TokenExpiration: 300,
+    BlockDuration:   300,
+    TokenHashSecret: "old",
+  }
+
+  token := "customer-credential"
+  ctx := context.Background()
+
+  limiter := NewRateLimiter(cfg, mockStorage)
+  for i := 0; i < 2; i++ {
+    limiter.CheckToken(ctx, token, 1)
+  }
+
+  // The window used under the old secret goes on under the new one
+  cfg.TokenHashSecret = "new"
+  cfg.TokenHashPreviousSecrets = []string{"old"}
+  limiter = NewRateLimiter(cfg, mockStorage)
+
+  result, err := limiter.CheckToken(ctx, token, 1)
+  if err != nil {
+    t.Fatalf("Error checking token: %v", err)
+  }
+  if !result.Allowed || result.Remaining != 0 {
+    t.Errorf("Expected the last unit of the window to be allowed, got %+v", result)
+  }
+  if result, _ := limiter.CheckToken(ctx, token, 1); result.Allowed {
+    t.Error("Rotating the secret should not start a fresh window")
+  }
+
+  oldKey := "default:token:token:" + NewTokenHasher("old").Hash(token)
+  if _, exists := mockStorage.counters[oldKey]; exists {
+    t.Error("The counter under the old secret should be moved")
+  }
+}
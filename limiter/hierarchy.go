@@ -0,0 +1,169 @@
+package limiter
+
+import (
+  "context"
+  "log"
+  "time"
+
+  "rate-limiter/interfaces"
+  "rate-limiter/metrics"
+)
+
+// CheckLevels checks a request against a chain of limits at once. Cost units
+// are charged to every level only if all of them allow the request, so no
+// quota is consumed when one level denies. Denials only reject, levels are
+// never blocked, and the result reports the denying level, or the level with
+// the least room left when the request is allowed. The ceiling and quotas
+// then apply like for IP addresses and tokens, with the first, narrowest
+// level as the client.
+func (rl *RateLimiter) CheckLevels(ctx context.Context, levels []interfaces.Level, cost int) (interfaces.Result, error) {
+  if len(levels) == 0 {
+    return interfaces.Result{Allowed: true}, nil
+  }
+
+  // Requests always cost at least one unit
+  if cost < 1 {
+    cost = 1
+  }
+
+  levelKeys := make([]Key, len(levels))
+  keys := make([]string, len(levels))
+  limits := make([]int, len(levels))
+  expirations := make([]time.Duration, len(levels))
+  for i, level := range levels {
+    k := rl.levelKey(level)
+    levelKeys[i] = k
+
+    // Blocks set on a level, such as by the admin or a throttle, still apply
+    rule := Rule{Name: level.Name, Limit: level.Limit}
+    if result, blocked, err := rl.blocked(ctx, rule, k); err != nil || blocked {
+      return result, err
+    }
+    if level.Dimension == "token" {
+      if result, blocked, err := rl.rotate(ctx, rule, k, level.Value); err != nil || blocked {
+        return result, err
+      }
+    }
+
+    keys[i] = k.String()
+    limits[i] = rl.adapt(Rule{Limit: level.Limit}).Limit
+    expirations[i] = level.Expiration
+  }
+
+  counts, denied, err := rl.storage.IncrementAll(ctx, keys, cost, limits, expirations)
+  if err != nil {
+    return interfaces.Result{}, err
+  }
+
+  overLimit := denied >= 0
+  if overLimit {
+    level := levels[denied]
+    if !rl.dryRun {
+      return interfaces.Result{
+        Rule:       level.Name,
+        Limit:      limits[denied],
+        OverLimit:  true,
+        Reset:      level.Expiration,
+        RetryAfter: level.Expiration,
+      }, nil
+    }
+
+    // In dry-run mode the denial is only reported, and the request is
+    // charged like every request served
+    log.Printf("Dry run: %s level would deny %s (limit %d)", level.Name, levelKeys[denied].Value, limits[denied])
+    metrics.DryRunDenials.Add(level.Name, 1)
+    for i, key := range keys {
+      if counts[i], err = rl.storage.IncrementBy(ctx, key, cost, expirations[i]); err != nil {
+        return interfaces.Result{}, err
+      }
+    }
+  }
+
+  // Report the level closest to its limit
+  tightest := 0
+  for i := range levels {
+    if limits[i]-counts[i] < limits[tightest]-counts[tightest] {
+      tightest = i
+    }
+  }
+  level := levels[tightest]
+  result := interfaces.Result{
+    Allowed:   true,
+    OverLimit: overLimit,
+    Rule:      level.Name,
+    Limit:     limits[tightest],
+    Reset:     level.Expiration,
+  }
+  if remaining := limits[tightest] - counts[tightest]; remaining > 0 {
+    result.Remaining = remaining
+  }
+  return rl.checkShared(ctx, levelKeys[0], cost, result, levelKeys)
+}
+
+// RefundLevels gives back cost units charged to every level of a chain, to
+// the ceiling and to the quotas of its narrowest level
+func (rl *RateLimiter) RefundLevels(ctx context.Context, levels []interfaces.Level, cost int) error {
+  if len(levels) == 0 {
+    return nil
+  }
+  for _, level := range levels[1:] {
+    if err := rl.refund(ctx, rl.levelKey(level), cost); err != nil {
+      return err
+    }
+  }
+  return rl.refundClient(ctx, rl.levelKey(levels[0]), cost)
+}
+
+// CheckCapacity charges cost units to a capacity shared by every client. Only
+// its own counter is charged, the ceiling, quotas and adaptive limits belong
+// to clients, and denials only reject.
+func (rl *RateLimiter) CheckCapacity(ctx context.Context, level interfaces.Level, cost int) (interfaces.Result, error) {
+  // Requests always cost at least one unit
+  if cost < 1 {
+    cost = 1
+  }
+
+  k := rl.levelKey(level)
+  counts, denied, err := rl.storage.IncrementAll(ctx, []string{k.String()}, cost, []int{level.Limit}, []time.Duration{level.Expiration})
+  if err != nil {
+    return interfaces.Result{}, err
+  }
+
+  result := interfaces.Result{Allowed: true, Rule: level.Name, Limit: level.Limit, Reset: level.Expiration}
+  if denied >= 0 {
+    if !rl.dryRun {
+      return interfaces.Result{
+        Rule:       level.Name,
+        Limit:      level.Limit,
+        OverLimit:  true,
+        Reset:      level.Expiration,
+        RetryAfter: level.Expiration,
+      }, nil
+    }
+
+    log.Printf("Dry run: %s would shed a request (limit %d)", level.Name, level.Limit)
+    metrics.DryRunDenials.Add(level.Name, 1)
+    if counts[0], err = rl.storage.IncrementBy(ctx, k.String(), cost, level.Expiration); err != nil {
+      return interfaces.Result{}, err
+    }
+    result.OverLimit = true
+  }
+  if remaining := level.Limit - counts[0]; remaining > 0 {
+    result.Remaining = remaining
+  }
+  return result, nil
+}
+
+// RefundCapacity gives back cost units charged to a shared capacity
+func (rl *RateLimiter) RefundCapacity(ctx context.Context, level interfaces.Level, cost int) error {
+  return rl.refund(ctx, rl.levelKey(level), cost)
+}
+
+// levelKey builds the key of a level, hashing tokens like CheckToken
+func (rl *RateLimiter) levelKey(level interfaces.Level) Key {
+  value := level.Value
+  if level.Dimension == "token" {
+    value = rl.tokenHasher.Hash(value)
+  }
+  return rl.key(level.Name, level.Dimension, value)
+}
@@ -0,0 +1,117 @@
+package limiter
+
+import (
+  "context"
+  "testing"
+  "time"
+
+  "rate-limiter/config"
+  "rate-limiter/interfaces"
+)
+
+func TestRateLimiterCheckLevels(t *testing.T) {
+  ctx := context.Background()
+  mockStorage := NewMockStorage()
+  limiter := NewRateLimiter(&config.Config{}, mockStorage)
+
+  levels := func(user string) []interfaces.Level {
+    return []interfaces.Level{
+      {Name: "user", Dimension: "token", Value: user, Limit: 3, Expiration: time.Minute},
+      {Name: "org", Dimension: "header", Value: "acme", Limit: 5, Expiration: time.Minute},
+    }
+  }
+
+  // Should charge every level and report the tightest
+  result, err := limiter.CheckLevels(ctx, levels("alice"), 2)
+  if err != nil {
+    t.Fatalf("Unexpected error: %v", err)
+  }
+  if !result.Allowed || result.Rule != "user" || result.Remaining != 1 {
+    t.Errorf("Expected the user level with 1 remaining, got %+v", result)
+  }
+
+  // Should deny at the user level without charging the organization
+  result, _ = limiter.CheckLevels(ctx, levels("alice"), 2)
+  if result.Allowed || result.Rule != "user" || !result.OverLimit {
+    t.Errorf("Expected a denial by the user level, got %+v", result)
+  }
+  if count := mockStorage.counters["default:org:header:acme"]; count != 2 {
+    t.Errorf("Expected the organization to keep 2 units, got %d", count)
+  }
+
+  // Should deny at the organization level without charging the user
+  result, _ = limiter.CheckLevels(ctx, levels("bob"), 3)
+  if !result.Allowed || result.Remaining != 0 {
+    t.Fatalf("Expected bob to use up the organization, got %+v", result)
+  }
+  result, _ = limiter.CheckLevels(ctx, levels("carol"), 1)
+  if result.Allowed || result.Rule != "org" {
+    t.Errorf("Expected a denial by the organization level, got %+v", result)
+  }
+  if count := mockStorage.counters["default:user:token:carol"]; count != 0 {
+    t.Errorf("Expected carol to keep 0 units, got %d", count)
+  }
+
+  // Should give back the units to every level
+  if err := limiter.RefundLevels(ctx, levels("alice"), 2); err != nil {
+    t.Fatalf("Unexpected error: %v", err)
+  }
+  if count := mockStorage.counters["default:org:header:acme"]; count != 3 {
+    t.Errorf("Expected the organization to have 3 units after the refund, got %d", count)
+  }
+}
+
+func TestRateLimiterCheckLevelsQuota(t *testing.T) {
+  ctx := context.Background()
+  mockStorage := NewMockStorage()
+  limiter := NewRateLimiter(&config.Config{Quotas: map[string]int{"monthly": 2}}, mockStorage)
+  now := time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC)
+  limiter.now = func() time.Time { return now }
+
+  levels := []interfaces.Level{
+    {Name: "user", Dimension: "token", Value: "alice", Limit: 10, Expiration: time.Minute},
+    {Name: "org", Dimension: "header", Value: "acme", Limit: 10, Expiration: time.Minute},
+  }
+
+  // The quota of the narrowest level applies alongside the levels
+  for i := 0; i < 2; i++ {
+    result, err := limiter.CheckLevels(ctx, levels, 1)
+    if err != nil {
+      t.Fatalf("Unexpected error: %v", err)
+    }
+    if !result.Allowed || result.Remaining != 1-i {
+      t.Errorf("Expected request %d to be allowed with %d remaining, got %+v", i+1, 1-i, result)
+    }
+  }
+
+  result, err := limiter.CheckLevels(ctx, levels, 1)
+  if err != nil {
+    t.Fatalf("Unexpected error: %v", err)
+  }
+  if result.Allowed || result.Rule != "monthly" {
+    t.Errorf("Expected a denial by the monthly quota, got %+v", result)
+  }
+  if count := mockStorage.counters["default:org:header:acme"]; count != 2 {
+    t.Errorf("Expected the denied request to be given back to the levels, got %d units", count)
+  }
+}
+
+func TestRateLimiterCheckLevelsDryRun(t *testing.T) {
+  ctx := context.Background()
+  mockStorage := NewMockStorage()
+  limiter := NewRateLimiter(&config.Config{DryRun: true}, mockStorage)
+
+  levels := []interfaces.Level{{Name: "user", Dimension: "token", Value: "alice", Limit: 1, Expiration: time.Minute}}
+  limiter.CheckLevels(ctx, levels, 1)
+
+  result, err := limiter.CheckLevels(ctx, levels, 1)
+  if err != nil {
+    t.Fatalf("Unexpected error: %v", err)
+  }
+  if !result.Allowed || !result.OverLimit {
+    t.Errorf("Expected the request over the level to be allowed and reported, got %+v", result)
+  }
+  if count := mockStorage.counters["default:user:token:alice"]; count != 2 {
+    t.Errorf("Expected the served request to be charged, got %d units", count)
+  }
+}
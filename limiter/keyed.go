@@ -0,0 +1,154 @@
+package limiter
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "math"
+  "sync"
+  "time"
+
+  "rate-limiter/storage"
+)
+
+// InfDuration is the delay of a reservation that can never be satisfied
+const InfDuration = time.Duration(math.MaxInt64)
+
+// ErrExceedsLimit is returned by Wait when n is larger than the rule limit
+var ErrExceedsLimit = errors.New("limiter: n exceeds the rule limit")
+
+// Limiter is a general purpose limiter for arbitrary keys, in the spirit of
+// golang.org/x/time/rate but shared through storage. Windows are aligned to
+// the rule expiration so every instance agrees on when they free up.
+type Limiter struct {
+  storage storage.Storage
+  rule    Rule
+  now     func() time.Time
+}
+
+// NewLimiter creates a limiter that allows rule.Limit units per key in every
+// window of rule.Expiration, both of which must be positive
+func NewLimiter(store storage.Storage, rule Rule) (*Limiter, error) {
+  // A zero expiration would start a new window on every call and a zero
+  // limit would never allow anything
+  if rule.Limit <= 0 {
+    return nil, fmt.Errorf("limiter: rule %s: limit must be positive, got %d", rule.Name, rule.Limit)
+  }
+  if rule.Expiration <= 0 {
+    return nil, fmt.Errorf("limiter: rule %s: expiration must be positive, got %v", rule.Name, rule.Expiration)
+  }
+  return &Limiter{storage: store, rule: rule, now: time.Now}, nil
+}
+
+// Allow reports whether n units may be consumed for key now, consuming them
+// if so
+func (l *Limiter) Allow(ctx context.Context, key string, n int) (bool, error) {
+  r, err := l.Reserve(ctx, key, n)
+  if err != nil {
+    return false, err
+  }
+  return r.OK(), nil
+}
+
+// Wait blocks until n units may be consumed for key, or until ctx is done
+func (l *Limiter) Wait(ctx context.Context, key string, n int) error {
+  for {
+    r, err := l.Reserve(ctx, key, n)
+    if err != nil {
+      return err
+    }
+    if r.OK() {
+      return nil
+    }
+    if r.Delay() == InfDuration {
+      return fmt.Errorf("%w: %d > %d", ErrExceedsLimit, n, l.rule.Limit)
+    }
+
+    // Give up early if the window frees up after the deadline
+    if deadline, ok := ctx.Deadline(); ok && l.now().Add(r.Delay()).After(deadline) {
+      return context.DeadlineExceeded
+    }
+
+    timer := time.NewTimer(r.Delay())
+    select {
+    case <-ctx.Done():
+      timer.Stop()
+      return ctx.Err()
+    case <-timer.C:
+    }
+  }
+}
+
+// Reserve consumes n units for key if the current window has room for them.
+// A reservation that is not OK consumed nothing and reports how long until
+// the window frees up; an OK reservation may be cancelled to refund it.
+func (l *Limiter) Reserve(ctx context.Context, key string, n int) (*Reservation, error) {
+  if n < 1 {
+    n = 1
+  }
+  if n > l.rule.Limit {
+    return &Reservation{delay: InfDuration}, nil
+  }
+
+  // Units are only added if they fit, so denials never eat into the window
+  counterKey, reset := l.window(key)
+  _, denied, err := l.storage.IncrementAll(ctx, []string{counterKey}, n, []int{l.rule.Limit}, []time.Duration{reset})
+  if err != nil {
+    return nil, err
+  }
+  if denied >= 0 {
+    return &Reservation{delay: reset}, nil
+  }
+
+  return &Reservation{
+    ok:      true,
+    storage: l.storage,
+    key:     counterKey,
+    n:       n,
+  }, nil
+}
+
+// window returns the counter key for the current window of key and the time
+// left until the window ends
+func (l *Limiter) window(key string) (string, time.Duration) {
+  now := l.now()
+  start := now.Truncate(l.rule.Expiration)
+  counterKey := Key{Rule: l.rule.Name, Dimension: "window", Value: fmt.Sprintf("%d:%s", start.Unix(), key)}
+  return counterKey.String(), start.Add(l.rule.Expiration).Sub(now)
+}
+
+// Reservation holds units consumed by Reserve
+type Reservation struct {
+  ok    bool
+  delay time.Duration
+
+  storage storage.Storage
+  key     string
+  n       int
+  once    sync.Once
+}
+
+// OK reports whether the units were consumed
+func (r *Reservation) OK() bool {
+  return r.ok
+}
+
+// Delay returns how long until the window frees up for a reservation that is
+// not OK, or InfDuration if it never will
+func (r *Reservation) Delay() time.Duration {
+  return r.delay
+}
+
+// Cancel refunds the units of an OK reservation, it is a no-op if the
+// reservation is not OK, was already cancelled or its window has ended
+func (r *Reservation) Cancel(ctx context.Context) error {
+  if !r.ok {
+    return nil
+  }
+
+  var err error
+  r.once.Do(func() {
+    _, err = r.storage.Decrement(ctx, r.key, r.n)
+  })
+  return err
+}
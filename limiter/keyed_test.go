@@ -0,0 +1,167 @@
+package limiter
+
+import (
+  "context"
+  "errors"
+  "sync"
+  "testing"
+  "time"
+
+  "rate-limiter/storage"
+)
+
+// newLimiter creates a keyed limiter for a valid rule
+func newLimiter(t *testing.T, store storage.Storage, rule Rule) *Limiter {
+  l, err := NewLimiter(store, rule)
+  if err != nil {
+    t.Fatalf("Unexpected error: %v", err)
+  }
+  return l
+}
+
+func TestLimiterAllow(t *testing.T) {
+  ctx := context.Background()
+  mockStorage := NewMockStorage()
+
+  now := time.Unix(1000, 0)
+  l := newLimiter(t, mockStorage, Rule{Name: "emails", Limit: 5, Expiration: time.Minute})
+  l.now = func() time.Time { return now }
+
+  // Should allow up to the limit
+  for i := 0; i < 5; i++ {
+    allowed, err := l.Allow(ctx, "user-1", 1)
+    if err != nil {
+      t.Fatalf("Unexpected error: %v", err)
+    }
+    if !allowed {
+      t.Errorf("Expected unit %d to be allowed", i+1)
+    }
+  }
+
+  // Should deny over the limit
+  allowed, err := l.Allow(ctx, "user-1", 1)
+  if err != nil {
+    t.Fatalf("Unexpected error: %v", err)
+  }
+  if allowed {
+    t.Errorf("Expected unit over the limit to be denied")
+  }
+
+  // Other keys have their own budget
+  allowed, _ = l.Allow(ctx, "user-2", 5)
+  if !allowed {
+    t.Errorf("Expected a different key to be allowed")
+  }
+
+  // The next window starts afresh
+  now = now.Add(time.Minute)
+  allowed, _ = l.Allow(ctx, "user-1", 5)
+  if !allowed {
+    t.Errorf("Expected the next window to be allowed")
+  }
+}
+
+func TestLimiterReserve(t *testing.T) {
+  ctx := context.Background()
+  mockStorage := NewMockStorage()
+
+  now := time.Unix(1040, 0)
+  l := newLimiter(t, mockStorage, Rule{Name: "jobs", Limit: 10, Expiration: time.Minute})
+  l.now = func() time.Time { return now }
+
+  r, err := l.Reserve(ctx, "queue", 8)
+  if err != nil {
+    t.Fatalf("Unexpected error: %v", err)
+  }
+  if !r.OK() {
+    t.Fatalf("Expected the reservation to be OK")
+  }
+
+  // A denied reservation consumes nothing and waits for the window
+  denied, _ := l.Reserve(ctx, "queue", 3)
+  if denied.OK() {
+    t.Errorf("Expected the reservation over the limit to be denied")
+  }
+  if denied.Delay() != 40*time.Second {
+    t.Errorf("Expected a delay of 40s until the window ends, got %v", denied.Delay())
+  }
+
+  // Cancelling refunds the units, only once
+  if err := r.Cancel(ctx); err != nil {
+    t.Fatalf("Unexpected error: %v", err)
+  }
+  r.Cancel(ctx)
+
+  r, _ = l.Reserve(ctx, "queue", 10)
+  if !r.OK() {
+    t.Errorf("Expected the refunded units to be available")
+  }
+
+  // Units above the limit can never be reserved
+  r, _ = l.Reserve(ctx, "queue", 11)
+  if r.OK() || r.Delay() != InfDuration {
+    t.Errorf("Expected an infinite delay, got %v", r.Delay())
+  }
+}
+
+func TestLimiterWait(t *testing.T) {
+  mockStorage := NewMockStorage()
+  l := newLimiter(t, mockStorage, Rule{Name: "writes", Limit: 1, Expiration: time.Hour})
+
+  if err := l.Wait(context.Background(), "db", 1); err != nil {
+    t.Fatalf("Unexpected error: %v", err)
+  }
+
+  // The window does not free up before the deadline
+  ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+  defer cancel()
+  if err := l.Wait(ctx, "db", 1); !errors.Is(err, context.DeadlineExceeded) {
+    t.Errorf("Expected the deadline to be exceeded, got %v", err)
+  }
+
+  if err := l.Wait(context.Background(), "db", 2); !errors.Is(err, ErrExceedsLimit) {
+    t.Errorf("Expected ErrExceedsLimit, got %v", err)
+  }
+}
+
+func TestLimiterReserveConcurrent(t *testing.T) {
+  ctx := context.Background()
+  store := storage.NewMemoryStorage()
+  defer store.Close()
+  l := newLimiter(t, store, Rule{Name: "jobs", Limit: 10, Expiration: time.Hour})
+
+  // Reserve 9 units, then race callers over the limit with one that fits
+  if r, _ := l.Reserve(ctx, "queue", 9); !r.OK() {
+    t.Fatalf("Expected the first reservation to be OK")
+  }
+
+  var wg sync.WaitGroup
+  for i := 0; i < 20; i++ {
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      l.Reserve(ctx, "queue", 2)
+    }()
+  }
+  r, err := l.Reserve(ctx, "queue", 1)
+  wg.Wait()
+  if err != nil {
+    t.Fatalf("Unexpected error: %v", err)
+  }
+  if !r.OK() {
+    t.Errorf("Denied reservations should not take units from one that fits")
+  }
+}
+
+func TestNewLimiterInvalidRule(t *testing.T) {
+  for _, rule := range []Rule{
+    {Name: "zero-limit", Limit: 0, Expiration: time.Minute},
+    {Name: "negative-limit", Limit: -1, Expiration: time.Minute},
+    {Name: "zero-expiration", Limit: 5},
+    {Name: "negative-expiration", Limit: 5, Expiration: -time.Second},
+  } {
+    if _, err := NewLimiter(NewMockStorage(), rule); err == nil {
+      t.Errorf("Expected an error for rule %s", rule.Name)
+    }
+  }
+}
@@ -0,0 +1,85 @@
+package limiter
+
+import (
+  "fmt"
+  "net"
+  "strings"
+
+  "rate-limiter/interfaces"
+  "rate-limiter/tenant"
+)
+
+// DefaultTenant is the tenant of keys when no tenant is configured
+const DefaultTenant = tenant.Default
+
+// Key is the structured storage key of a limited value. Storage backends
+// prefix it with the application namespace and the kind of data, so a Redis
+// key reads <app>:<kind>:<tenant>:<rule>:<dimension>:<value>. Tenants, rules
+// and dimensions must not contain colons, values may.
+type Key struct {
+  Tenant    string
+  Rule      string
+  Dimension string
+  Value     string
+}
+
+// String returns the storage form of the key
+func (k Key) String() string {
+  tenant := k.Tenant
+  if tenant == "" {
+    tenant = DefaultTenant
+  }
+  return fmt.Sprintf("%s:%s:%s:%s", tenant, k.Rule, k.Dimension, k.Value)
+}
+
+// ParseKey parses the storage form of a key
+func ParseKey(s string) (Key, error) {
+  parts := strings.SplitN(s, ":", 4)
+  if len(parts) != 4 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+    return Key{}, fmt.Errorf("%w %q, expected tenant:rule:dimension:value", interfaces.ErrInvalidKey, s)
+  }
+  return Key{Tenant: parts[0], Rule: parts[1], Dimension: parts[2], Value: parts[3]}, nil
+}
+
+// offenses returns the key counting the offenses of the key
+func (k Key) offenses() Key {
+  k.Dimension += ".offenses"
+  return k
+}
+
+// burst returns the key counting the burst allowance spent by the key
+func (k Key) burst() Key {
+  k.Dimension += ".burst"
+  return k
+}
+
+// seen returns the key recording when the key was first seen
+func (k Key) seen() Key {
+  k.Dimension += ".seen"
+  return k
+}
+
+// LegacyBlockKey maps a block key written before keys were namespaced to its
+// structured form. Legacy blocks used the raw IP or token for the ip and token
+// rules and <rule>:<key> for other rules, so a value parsing as an IP is taken
+// as an IP, a value with a colon as a rule key and anything else as a token.
+func LegacyBlockKey(legacy string) Key {
+  if net.ParseIP(legacy) != nil {
+    return Key{Tenant: DefaultTenant, Rule: "ip", Dimension: "ip", Value: legacy}
+  }
+
+  rule, value, found := strings.Cut(legacy, ":")
+  if !found {
+    return Key{Tenant: DefaultTenant, Rule: "token", Dimension: "token", Value: legacy}
+  }
+
+  switch rule {
+  case "rls":
+    // Envoy domains were part of the rule name
+    domain, descriptor, _ := strings.Cut(value, ":")
+    return Key{Tenant: DefaultTenant, Rule: "rls." + domain, Dimension: "key", Value: descriptor}
+  case "failures":
+    return Key{Tenant: DefaultTenant, Rule: rule, Dimension: "login", Value: value}
+  }
+  return Key{Tenant: DefaultTenant, Rule: rule, Dimension: "key", Value: value}
+}
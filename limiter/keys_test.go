@@ -0,0 +1,73 @@
+package limiter
+
+import (
+  "context"
+  "testing"
+
+  "rate-limiter/config"
+)
+
+// TestRateLimiterKeyCollision tests that a token equal to an IP does not share its block
+func TestRateLimiterKeyCollision(t *testing.T) {
+  mockStorage := NewMockStorage()
+
+  cfg := &config.Config{
+    IPLimit:         1,
+    IPExpiration:    300,
+    TokenLimit:      5,
+    TokenExpiration: 300,
+    BlockDuration:   300,
+  }
+
+  limiter := NewRateLimiter(cfg, mockStorage)
+
+  value := "192.168.1.1"
+  ctx := context.Background()
+
+  // Block the IP
+  for i := 0; i < 2; i++ {
+    limiter.CheckIP(ctx, value, 1)
+  }
+
+  result, err := limiter.CheckToken(ctx, value, 1)
+  if err != nil {
+    t.Errorf("Error checking token: %v", err)
+  }
+  if !result.Allowed {
+    t.Error("Token equal to a blocked IP should be allowed")
+  }
+}
+
+// TestParseKey tests that keys survive a round trip through their storage form
+func TestParseKey(t *testing.T) {
+  key := Key{Tenant: "acme", Rule: "ip", Dimension: "ip", Value: "2001:db8::1"}
+
+  parsed, err := ParseKey(key.String())
+  if err != nil {
+    t.Fatalf("Unexpected error: %v", err)
+  }
+  if parsed != key {
+    t.Errorf("Expected %+v, got %+v", key, parsed)
+  }
+
+  if _, err := ParseKey("192.168.1.1"); err == nil {
+    t.Error("Expected a raw value to be rejected")
+  }
+}
+
+// TestLegacyBlockKey tests the mapping of blocks written before keys were namespaced
+func TestLegacyBlockKey(t *testing.T) {
+  tests := map[string]string{
+    "192.168.1.1":                 "default:ip:ip:192.168.1.1",
+    "2001:db8::1":                 "default:ip:ip:2001:db8::1",
+    "secret-token":                "default:token:token:secret-token",
+    "stripe:api.stripe.com":       "default:stripe:key:api.stripe.com",
+    "rls:edge:remote_address=1.2": "default:rls.edge:key:remote_address=1.2",
+  }
+
+  for legacy, want := range tests {
+    if got := LegacyBlockKey(legacy).String(); got != want {
+      t.Errorf("LegacyBlockKey(%q) = %q, want %q", legacy, got, want)
+    }
+  }
+}
@@ -2,98 +2,688 @@ package limiter
 
 import (
   "context"
-  "fmt"
+  "expvar"
+  "log"
+  "math"
+  "strconv"
+  "sync"
   "time"
 
   "rate-limiter/config"
   "rate-limiter/interfaces"
+  "rate-limiter/metrics"
   "rate-limiter/storage"
 )
 
 // Ensure RateLimiter implements the interfaces.RateLimiter interface
 var _ interfaces.RateLimiter = (*RateLimiter)(nil)
 
+// Ensure RateLimiter implements the interfaces.ConcurrencyLimiter interface
+var _ interfaces.ConcurrencyLimiter = (*RateLimiter)(nil)
+
+// Ensure RateLimiter implements the interfaces.Refunder interface
+var _ interfaces.Refunder = (*RateLimiter)(nil)
+
+// Ensure RateLimiter implements the interfaces.FailureLimiter interface
+var _ interfaces.FailureLimiter = (*RateLimiter)(nil)
+
+// Ensure RateLimiter implements the interfaces.HierarchicalLimiter interface
+var _ interfaces.HierarchicalLimiter = (*RateLimiter)(nil)
+
+// Ensure RateLimiter implements the interfaces.BlockManager interface
+var _ interfaces.BlockManager = (*RateLimiter)(nil)
+
+// releaseTimeout bounds how long releasing or renewing a lease may take
+const releaseTimeout = 5 * time.Second
+
+// leaseRenewals is how many times a lease is renewed within its TTL, so a
+// single failed renewal does not lose it
+const leaseRenewals = 3
+
+// Mode is what happens to a key once it exceeds the limit of its rule
+type Mode string
+
+const (
+  // ModeBlock blocks the key for the block duration, the default
+  ModeBlock Mode = "block"
+  // ModeReject only rejects requests until the window frees up
+  ModeReject Mode = "reject"
+)
+
+// Rule describes a limit applied to one dimension of a request
+type Rule struct {
+  // Name identifies the rule in logs and metrics
+  Name string
+
+  // Limit is the number of cost units allowed per window
+  Limit int
+
+  // Expiration is the length of the counting window
+  Expiration time.Duration
+
+  // DryRun accounts for requests without ever denying them
+  DryRun bool
+
+  // Mode chooses between blocking and only rejecting keys over the limit
+  Mode Mode
+
+  // SkipDenied leaves denied requests out of the count, so they neither
+  // use up the window nor restart it
+  SkipDenied bool
+
+  // Aligned counts over fixed windows aligned to the expiration, such as
+  // whole minutes, instead of windows restarted by every request
+  Aligned bool
+
+  // ExtendBlock restarts the block of a key that keeps sending requests
+  // while blocked, so it only ends after the key backs off
+  ExtendBlock bool
+
+  // Burst is the number of cost units a key may spend above the limit,
+  // the allowance refills once unused for BurstWindow
+  Burst       int
+  BurstWindow time.Duration
+
+  // WarmUp ramps the limit and burst of new keys from the WarmUpStart
+  // fraction of them up to all of them over their first WarmUp
+  WarmUp      time.Duration
+  WarmUpStart float64
+}
+
 // RateLimiter provides rate limiting functionality
 type RateLimiter struct {
   storage       storage.Storage
-  ipLimit       int
-  ipExpiration  time.Duration
-  tokenLimit    int
-  tokenExpiration time.Duration
+  tenant        string
+  tokenHasher   *TokenHasher
+  ceiling       Rule
+  adaptive      *Adaptive
+  quotas        []Quota
+  quotaLocation *time.Location
+  now           func() time.Time
+  ipRule        Rule
+  tokenRule     Rule
   blockDuration time.Duration
+  waitMode      bool
+  dryRun        bool
+
+  failureRule    Rule
+  failureLockout time.Duration
+
+  maxConcurrentPerKey int
+  maxConcurrent       int
+  leaseTTL            time.Duration
+
+  penaltyMultiplier  int
+  penaltyMaxDuration time.Duration
+  penaltyWindow      time.Duration
+  banThreshold       int
 }
 
 // NewRateLimiter creates a new rate limiter instance
 func NewRateLimiter(cfg *config.Config, store storage.Storage) *RateLimiter {
-  return &RateLimiter{
-    storage:         store,
-    ipLimit:         cfg.IPLimit,
-    ipExpiration:    time.Duration(cfg.IPExpiration) * time.Second,
-    tokenLimit:      cfg.TokenLimit,
-    tokenExpiration: time.Duration(cfg.TokenExpiration) * time.Second,
-    blockDuration:   time.Duration(cfg.BlockDuration) * time.Second,
+  rl := &RateLimiter{
+    storage: store,
+    tenant:  DefaultTenant,
+
+    tokenHasher: NewTokenHasher(cfg.TokenHashSecret, cfg.TokenHashPreviousSecrets...),
+    ipRule: Rule{
+      Name:       "ip",
+      Limit:      cfg.IPLimit,
+      Expiration: time.Duration(cfg.IPExpiration) * time.Second,
+      DryRun:     cfg.DryRun || cfg.IPDryRun,
+
+      Mode:        parseMode(cfg.IPMode),
+      SkipDenied:  cfg.SkipDenied,
+      ExtendBlock: cfg.ExtendBlocks,
+
+      Burst:       cfg.IPBurst,
+      BurstWindow: time.Duration(cfg.BurstWindow) * time.Second,
+      WarmUp:      time.Duration(cfg.IPWarmUp) * time.Second,
+      WarmUpStart: float64(cfg.WarmUpStart) / 100,
+    },
+    tokenRule: Rule{
+      Name:       "token",
+      Limit:      cfg.TokenLimit,
+      Expiration: time.Duration(cfg.TokenExpiration) * time.Second,
+      DryRun:     cfg.DryRun || cfg.TokenDryRun,
+
+      Mode:        parseMode(cfg.TokenMode),
+      SkipDenied:  cfg.SkipDenied,
+      ExtendBlock: cfg.ExtendBlocks,
+
+      Burst:       cfg.TokenBurst,
+      BurstWindow: time.Duration(cfg.BurstWindow) * time.Second,
+      WarmUp:      time.Duration(cfg.TokenWarmUp) * time.Second,
+      WarmUpStart: float64(cfg.WarmUpStart) / 100,
+    },
+    blockDuration: time.Duration(cfg.BlockDuration) * time.Second,
+    dryRun:        cfg.DryRun,
+
+    quotas:        newQuotas(cfg.Quotas),
+    quotaLocation: loadLocation(cfg.QuotaTimezone),
+    now:           time.Now,
+
+    failureRule: Rule{
+      Name:       "failures",
+      Limit:      cfg.FailureLimit,
+      Expiration: time.Duration(cfg.FailureWindow) * time.Second,
+    },
+    failureLockout: time.Duration(cfg.FailureLockout) * time.Second,
+
+    maxConcurrentPerKey: cfg.MaxConcurrentPerKey,
+    maxConcurrent:       cfg.MaxConcurrent,
+    leaseTTL:            time.Duration(cfg.LeaseTTL) * time.Second,
+
+    penaltyMultiplier:  cfg.PenaltyMultiplier,
+    penaltyMaxDuration: time.Duration(cfg.PenaltyMaxDuration) * time.Second,
+    penaltyWindow:      time.Duration(cfg.PenaltyWindow) * time.Second,
+    banThreshold:       cfg.BanThreshold,
+  }
+
+  if cfg.AdaptiveLimits {
+    rl.adaptive = NewAdaptive(AdaptiveConfig{
+      TargetLatency: time.Duration(cfg.AdaptiveTargetLatency) * time.Millisecond,
+      MaxErrorRate:  float64(cfg.AdaptiveMaxErrorRate) / 100,
+      Decrease:      float64(cfg.AdaptiveDecrease) / 100,
+      Increase:      float64(cfg.AdaptiveIncrease) / 100,
+      Min:           float64(cfg.AdaptiveMin) / 100,
+      Max:           float64(cfg.AdaptiveMax) / 100,
+      Interval:      time.Duration(cfg.AdaptiveInterval) * time.Second,
+      MinSamples:    cfg.AdaptiveMinSamples,
+    })
+    metrics.Adaptive.Set("ip_limit", expvar.Func(func() interface{} { return rl.adapt(rl.ipRule).Limit }))
+    metrics.Adaptive.Set("token_limit", expvar.Func(func() interface{} { return rl.adapt(rl.tokenRule).Limit }))
+  }
+
+  // Waiting requests are checked again, blocking them on the first check or
+  // charging every retry would defeat the wait
+  if cfg.MaxWait > 0 {
+    warnWaitMode("IP", cfg.IPMode)
+    warnWaitMode("token", cfg.TokenMode)
+    rl.waitMode = true
+    rl.ipRule.Mode, rl.ipRule.SkipDenied = ModeReject, true
+    rl.tokenRule.Mode, rl.tokenRule.SkipDenied = ModeReject, true
   }
+  return rl
 }
 
 // CheckIP checks if an IP address has exceeded its rate limit
-func (rl *RateLimiter) CheckIP(ctx context.Context, ip string) (bool, error) {
-  // Check if the IP is blocked
-  blocked, err := rl.storage.IsBlocked(ctx, ip)
+func (rl *RateLimiter) CheckIP(ctx context.Context, ip string, cost int) (interfaces.Result, error) {
+  return rl.checkClient(ctx, rl.ipRule, rl.key(rl.ipRule.Name, "ip", ip), cost)
+}
+
+// CheckToken checks if a token has exceeded its rate limit
+func (rl *RateLimiter) CheckToken(ctx context.Context, token string, cost int) (interfaces.Result, error) {
+  k := rl.tokenKey(token)
+  if result, blocked, err := rl.rotate(ctx, rl.tokenRule, k, token); err != nil || blocked {
+    return result, err
+  }
+  return rl.checkClient(ctx, rl.tokenRule, k, cost)
+}
+
+// RefundIP gives back cost units charged to an IP address
+func (rl *RateLimiter) RefundIP(ctx context.Context, ip string, cost int) error {
+  return rl.refundClient(ctx, rl.key(rl.ipRule.Name, "ip", ip), cost)
+}
+
+// RefundToken gives back cost units charged to a token
+func (rl *RateLimiter) RefundToken(ctx context.Context, token string, cost int) error {
+  return rl.refundClient(ctx, rl.tokenKey(token), cost)
+}
+
+// Refund gives back cost units charged to an arbitrary key of a rule
+func (rl *RateLimiter) Refund(ctx context.Context, rule Rule, key string, cost int) error {
+  counter, _ := rl.window(rule, rl.key(rule.Name, "key", key))
+  return rl.refund(ctx, counter, cost)
+}
+
+// Check checks if an arbitrary key has exceeded the limit of a rule, the key
+// is namespaced by the rule name so rules never share counters or blocks
+func (rl *RateLimiter) Check(ctx context.Context, rule Rule, key string, cost int) (interfaces.Result, error) {
+  return rl.check(ctx, rule, rl.key(rule.Name, "key", key), cost)
+}
+
+// CheckMethod checks a method, such as a gRPC method, against a rule under a
+// dimension of its own, every caller of the method sharing its budget
+func (rl *RateLimiter) CheckMethod(ctx context.Context, rule Rule, method string, cost int) (interfaces.Result, error) {
+  return rl.check(ctx, rule, rl.key(rule.Name, "method", method), cost)
+}
+
+// Throttle blocks an arbitrary key of a rule for the given duration, such as
+// when an upstream asks callers to back off
+func (rl *RateLimiter) Throttle(ctx context.Context, rule Rule, key string, duration time.Duration) error {
+  return rl.storage.Block(ctx, rl.key(rule.Name, "key", key).String(), duration)
+}
+
+// AcquireIP takes a concurrency slot for an IP address
+func (rl *RateLimiter) AcquireIP(ctx context.Context, ip string) (func(), bool, error) {
+  return rl.acquire(ctx, rl.key("concurrency", "ip", ip))
+}
+
+// AcquireToken takes a concurrency slot for a token
+func (rl *RateLimiter) AcquireToken(ctx context.Context, token string) (func(), bool, error) {
+  return rl.acquire(ctx, rl.key("concurrency", "token", rl.tokenHasher.Hash(token)))
+}
+
+// Unblock lifts any block or permanent ban on a key, given in its
+// tenant:rule:dimension:value form, and forgets its offenses
+func (rl *RateLimiter) Unblock(ctx context.Context, key string) error {
+  parsed, err := ParseKey(key)
+  if err != nil {
+    return err
+  }
+  if err := rl.storage.Unblock(ctx, parsed.String()); err != nil {
+    return err
+  }
+  return rl.storage.Reset(ctx, parsed.offenses().String())
+}
+
+// Close closes the rate limiter and its storage
+func (rl *RateLimiter) Close() error {
+  return rl.storage.Close()
+}
+
+// check charges cost units to the key and blocks it once the rule's limit is
+// exceeded
+func (rl *RateLimiter) check(ctx context.Context, rule Rule, k Key, cost int) (interfaces.Result, error) {
+  // New keys only get part of the rule until they warm up
+  rule, err := rl.warmUp(ctx, rule, k)
   if err != nil {
-    return false, err
+    return interfaces.Result{Rule: rule.Name, Limit: rule.Limit}, err
+  }
+
+  // Check if the key is blocked
+  result, blocked, err := rl.blocked(ctx, rule, k)
+  if err != nil || blocked {
+    return result, err
   }
-  if blocked {
-    return false, nil
+
+  // Requests always cost at least one unit
+  if cost < 1 {
+    cost = 1
   }
 
-  // Get the current count for this IP
-  key := fmt.Sprintf("ip:%s", ip)
-  count, err := rl.storage.Increment(ctx, key, rl.ipExpiration)
+  // Get the current count for this key
+  counter, expiration := rl.window(rule, k)
+  count, charged, err := rl.charge(ctx, rule, counter.String(), expiration, cost)
   if err != nil {
-    return false, err
+    return result, err
   }
 
-  // If the count exceeds the limit, block the IP
-  if count > rl.ipLimit {
-    if err := rl.storage.Block(ctx, ip, rl.blockDuration); err != nil {
-      return false, err
+  // Every increment restarts the window, unless it is aligned
+  result.Reset = expiration
+  if count < rule.Limit {
+    result.Remaining = rule.Limit - count
+  }
+
+  if count <= rule.Limit {
+    result.Allowed = true
+    return result, nil
+  }
+
+  // Spikes above the limit are served while the burst allowance lasts
+  covered, err := rl.burst(ctx, rule, k, count, cost)
+  if err != nil {
+    return result, err
+  }
+  if !covered {
+    result.OverLimit = true
+    if !rule.DryRun {
+      return rl.deny(ctx, rule, k, counter, expiration, result)
     }
-    return false, nil
+
+    // In dry-run mode the denial is only reported
+    log.Printf("Dry run: %s rule would deny %s (count %d, limit %d)", rule.Name, k.Value, count, rule.Limit)
+    metrics.DryRunDenials.Add(rule.Name, 1)
   }
 
-  return true, nil
+  // Requests served over the limit count even when denials do not
+  result.Allowed = true
+  if !charged {
+    _, err = rl.storage.IncrementBy(ctx, counter.String(), cost, expiration)
+  }
+  return result, err
 }
 
-// CheckToken checks if a token has exceeded its rate limit
-func (rl *RateLimiter) CheckToken(ctx context.Context, token string) (bool, error) {
-  // Check if the token is blocked
-  blocked, err := rl.storage.IsBlocked(ctx, token)
+// window returns the counter of a key under the rule and its expiration.
+// Aligned windows count under a key of their own that expires when the
+// window ends, other windows restart with every increment.
+func (rl *RateLimiter) window(rule Rule, k Key) (Key, time.Duration) {
+  if !rule.Aligned || rule.Expiration <= 0 {
+    return k, rule.Expiration
+  }
+
+  now := rl.now()
+  start := now.Truncate(rule.Expiration)
+  k.Value = strconv.FormatInt(start.Unix(), 10) + ":" + k.Value
+  return k, start.Add(rule.Expiration).Sub(now)
+}
+
+// charge adds cost units to the key and returns its count including them.
+// When the rule skips denials the units are only added if they fit in the
+// limit, so denied requests leave the counter and its window untouched.
+func (rl *RateLimiter) charge(ctx context.Context, rule Rule, key string, expiration time.Duration, cost int) (int, bool, error) {
+  if !rule.SkipDenied {
+    count, err := rl.storage.IncrementBy(ctx, key, cost, expiration)
+    return count, true, err
+  }
+
+  counts, denied, err := rl.storage.IncrementAll(ctx, []string{key}, cost, []int{rule.Limit}, []time.Duration{expiration})
   if err != nil {
-    return false, err
+    return 0, false, err
   }
-  if blocked {
-    return false, nil
+  if denied >= 0 {
+    return counts[0] + cost, false, nil
   }
+  return counts[0], true, nil
+}
 
-  // Get the current count for this token
-  key := fmt.Sprintf("token:%s", token)
-  count, err := rl.storage.Increment(ctx, key, rl.tokenExpiration)
+// deny rejects a request over the rule's limit, blocking the key unless the
+// rule only rejects
+func (rl *RateLimiter) deny(ctx context.Context, rule Rule, k, counter Key, expiration time.Duration, result interfaces.Result) (interfaces.Result, error) {
+  var err error
+  if rule.Mode == ModeReject {
+    // The key may retry once its window frees up, which denials restart
+    // unless they are skipped or the window is aligned
+    result.RetryAfter = expiration
+    if rule.SkipDenied {
+      result.RetryAfter, err = rl.storage.TTL(ctx, counter.String())
+    }
+  } else {
+    result.RetryAfter, err = rl.penalize(ctx, k)
+  }
+  result.Reset = result.RetryAfter
+  return result, err
+}
+
+// refund subtracts cost units from a counter, matching the minimum cost
+// charged by check
+func (rl *RateLimiter) refund(ctx context.Context, k Key, cost int) error {
+  if cost < 1 {
+    cost = 1
+  }
+  _, err := rl.storage.Decrement(ctx, k.String(), cost)
+  return err
+}
+
+// checkClient checks a client against its rule, then against the ceiling
+// shared by every client and finally against the client's quotas, giving
+// back the units already charged when a later check denies the request
+func (rl *RateLimiter) checkClient(ctx context.Context, rule Rule, k Key, cost int) (interfaces.Result, error) {
+  result, err := rl.check(ctx, rl.adapt(rule), k, cost)
+  if err != nil || !result.Allowed {
+    return result, err
+  }
+  return rl.checkShared(ctx, k, cost, result, []Key{k})
+}
+
+// checkShared checks a request its own limits allowed against the ceiling
+// shared by every client and against the quotas of the client k, giving back
+// the units charged to the keys of its limits when one of them denies it
+func (rl *RateLimiter) checkShared(ctx context.Context, k Key, cost int, result interfaces.Result, charged []Key) (interfaces.Result, error) {
+  if cost < 1 {
+    cost = 1
+  }
+
+  // The ceiling only rejects, blocking it would lock out every client
+  if ceiling := rl.adapt(rl.ceiling); ceiling.Limit > 0 {
+    ceilingKey := rl.ceilingKey().String()
+    count, err := rl.storage.IncrementBy(ctx, ceilingKey, cost, ceiling.Expiration)
+    if err != nil {
+      return result, err
+    }
+    if count > ceiling.Limit {
+      if _, err := rl.storage.Decrement(ctx, ceilingKey, cost); err != nil {
+        return result, err
+      }
+      if err := rl.refundKeys(ctx, charged, cost); err != nil {
+        return result, err
+      }
+      return interfaces.Result{
+        Rule:       ceiling.Name,
+        Limit:      ceiling.Limit,
+        OverLimit:  true,
+        Reset:      ceiling.Expiration,
+        RetryAfter: ceiling.Expiration,
+      }, nil
+    }
+    if remaining := ceiling.Limit - count; remaining < result.Remaining {
+      result.Remaining = remaining
+    }
+  }
+
+  // Quotas only reject as well, the client is not blocked until they reset
+  if len(rl.quotas) > 0 {
+    quota, err := rl.checkQuotas(ctx, k, cost)
+    if err != nil {
+      return result, err
+    }
+    if !quota.Allowed {
+      if err := rl.refundKeys(ctx, charged, cost); err != nil || rl.ceiling.Limit == 0 {
+        return quota, err
+      }
+      return quota, rl.refund(ctx, rl.ceilingKey(), cost)
+    }
+    if quota.Remaining < result.Remaining {
+      result.Remaining = quota.Remaining
+    }
+  }
+  return result, nil
+}
+
+// blocked reports whether a key is blocked, with the result denying it
+func (rl *RateLimiter) blocked(ctx context.Context, rule Rule, k Key) (interfaces.Result, bool, error) {
+  result := interfaces.Result{Rule: rule.Name, Limit: rule.Limit}
+
+  key := k.String()
+  blocked, err := rl.storage.IsBlocked(ctx, key)
+  if err != nil || !blocked {
+    return result, false, err
+  }
+
+  result.RetryAfter, err = rl.storage.BlockTTL(ctx, key)
   if err != nil {
-    return false, err
+    return result, true, err
   }
 
-  // If the count exceeds the limit, block the token
-  if count > rl.tokenLimit {
-    if err := rl.storage.Block(ctx, token, rl.blockDuration); err != nil {
-      return false, err
+  // Requests during the block restart it, permanent bans have no TTL
+  if rule.ExtendBlock && result.RetryAfter > 0 && result.RetryAfter < rl.blockDuration {
+    result.RetryAfter = rl.blockDuration
+    err = rl.storage.Block(ctx, key, rl.blockDuration)
+  }
+  result.Reset = result.RetryAfter
+  return result, true, err
+}
+
+// refundClient gives back units charged to a client, to the ceiling and to
+// the client's quotas
+func (rl *RateLimiter) refundClient(ctx context.Context, k Key, cost int) error {
+  if err := rl.refundLimits(ctx, k, cost); err != nil {
+    return err
+  }
+  return rl.refundQuotas(ctx, k, cost)
+}
+
+// refundKeys gives back cost units charged to every key
+func (rl *RateLimiter) refundKeys(ctx context.Context, keys []Key, cost int) error {
+  for _, k := range keys {
+    if err := rl.refund(ctx, k, cost); err != nil {
+      return err
     }
-    return false, nil
   }
+  return nil
+}
 
-  return true, nil
+// refundLimits gives back cost units charged to a client and to the ceiling
+func (rl *RateLimiter) refundLimits(ctx context.Context, k Key, cost int) error {
+  if err := rl.refund(ctx, k, cost); err != nil || rl.ceiling.Limit == 0 {
+    return err
+  }
+  return rl.refund(ctx, rl.ceilingKey(), cost)
 }
 
-// Close closes the rate limiter and its storage
-func (rl *RateLimiter) Close() error {
-  return rl.storage.Close()
+// acquire takes a lease on the key and on the global pool, a zero limit
+// disables the corresponding check
+func (rl *RateLimiter) acquire(ctx context.Context, k Key) (func(), bool, error) {
+  var releases []func()
+  release := func() {
+    for _, r := range releases {
+      r()
+    }
+  }
+
+  if rl.maxConcurrentPerKey > 0 {
+    r, ok, err := rl.lease(ctx, k.String(), rl.maxConcurrentPerKey)
+    if err != nil || !ok {
+      return nil, false, err
+    }
+    releases = append(releases, r)
+  }
+
+  if rl.maxConcurrent > 0 {
+    r, ok, err := rl.lease(ctx, rl.key("concurrency", "global", "all").String(), rl.maxConcurrent)
+    if err != nil || !ok {
+      release()
+      return nil, false, err
+    }
+    releases = append(releases, r)
+  }
+
+  return release, true, nil
+}
+
+// lease takes a single lease and returns the function that releases it
+func (rl *RateLimiter) lease(ctx context.Context, key string, limit int) (func(), bool, error) {
+  lease, ok, err := rl.storage.AcquireLease(ctx, key, limit, rl.leaseTTL)
+  if err != nil || !ok {
+    return nil, false, err
+  }
+
+  // Requests outliving the TTL, such as streams, must keep their lease
+  done, stopped := make(chan struct{}), make(chan struct{})
+  if rl.leaseTTL > 0 {
+    go rl.renewLease(key, lease, done, stopped)
+  } else {
+    close(stopped)
+  }
+
+  var once sync.Once
+  return func() {
+    once.Do(func() {
+      close(done)
+      <-stopped
+
+      // The request context may already be cancelled when the lease is released
+      releaseCtx, cancel := context.WithTimeout(context.Background(), releaseTimeout)
+      defer cancel()
+
+      if err := rl.storage.ReleaseLease(releaseCtx, key, lease); err != nil {
+        log.Printf("Failed to release lease on %s: %v", key, err)
+      }
+    })
+  }, true, nil
+}
+
+// renewLease pushes back the expiry of a lease until done is closed, then
+// closes stopped
+func (rl *RateLimiter) renewLease(key, lease string, done <-chan struct{}, stopped chan<- struct{}) {
+  defer close(stopped)
+
+  ticker := time.NewTicker(rl.leaseTTL / leaseRenewals)
+  defer ticker.Stop()
+
+  for {
+    select {
+    case <-done:
+      return
+    case <-ticker.C:
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), releaseTimeout)
+    renewed, err := rl.storage.RenewLease(ctx, key, lease, rl.leaseTTL)
+    cancel()
+    if err != nil {
+      log.Printf("Failed to renew lease on %s: %v", key, err)
+      continue
+    }
+    if !renewed {
+      log.Printf("Lease on %s expired before it was renewed", key)
+      return
+    }
+  }
+}
+
+// penalize records an offense for the key and blocks it for a duration that
+// grows with the number of offenses inside the penalty window, returning the
+// block duration, zero for a permanent ban or when blocks are disabled
+func (rl *RateLimiter) penalize(ctx context.Context, k Key) (time.Duration, error) {
+  key := k.String()
+  // The penalty window starts at the first offense and is not extended
+  offenses, err := rl.storage.IncrementFixed(ctx, k.offenses().String(), rl.penaltyWindow)
+  if err != nil {
+    return 0, err
+  }
+
+  // Repeat offenders past the ban threshold are blocked until an admin lifts it
+  if rl.banThreshold > 0 && offenses >= rl.banThreshold {
+    return 0, rl.storage.Ban(ctx, key)
+  }
+
+  duration := rl.penaltyDuration(offenses)
+  return duration, rl.storage.Block(ctx, key, duration)
+}
+
+// penaltyDuration returns the block duration for the given offense count
+func (rl *RateLimiter) penaltyDuration(offenses int) time.Duration {
+  duration := rl.blockDuration
+  if rl.penaltyMultiplier <= 1 {
+    return duration
+  }
+
+  for i := 1; i < offenses; i++ {
+    if duration > math.MaxInt64/time.Duration(rl.penaltyMultiplier) {
+      break
+    }
+    duration *= time.Duration(rl.penaltyMultiplier)
+    if rl.penaltyMaxDuration > 0 && duration >= rl.penaltyMaxDuration {
+      return rl.penaltyMaxDuration
+    }
+  }
+  return duration
+}
+
+// tokenKey builds the key of a token, identified by its hash
+func (rl *RateLimiter) tokenKey(token string) Key {
+  return rl.key(rl.tokenRule.Name, "token", rl.tokenHasher.Hash(token))
+}
+
+// ceilingKey builds the key of the ceiling shared by the tenant's clients
+func (rl *RateLimiter) ceilingKey() Key {
+  return rl.key(rl.ceiling.Name, "all", rl.tenant)
+}
+
+// key builds the structured key of a value in the limiter's tenant
+func (rl *RateLimiter) key(rule, dimension, value string) Key {
+  return Key{Tenant: rl.tenant, Rule: rule, Dimension: dimension, Value: value}
+}
+
+// parseMode returns the named mode, blocking when it is empty or unknown
+// warnWaitMode warns when wait mode overrides a block mode configured for a
+// rule
+func warnWaitMode(rule, mode string) {
+  if Mode(mode) == ModeBlock {
+    log.Printf("Warning: %s mode 'block' is overridden by wait mode, over-limit requests are only rejected and denials are skipped", rule)
+  }
+}
+
+func parseMode(name string) Mode {
+  switch Mode(name) {
+  case "":
+    return ModeBlock
+  case ModeBlock, ModeReject:
+    return Mode(name)
+  default:
+    log.Printf("Warning: Unknown rule mode '%s', blocking", name)
+    return ModeBlock
+  }
 }
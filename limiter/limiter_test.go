@@ -2,17 +2,26 @@ package limiter
 
 import (
   "context"
+  "net/http"
+  "net/http/httptest"
+  "sync/atomic"
   "testing"
   "time"
 
   "rate-limiter/config"
+  "rate-limiter/middleware"
+  "rate-limiter/storage"
 )
 
 // MockStorage is a mock implementation of the Storage interface for testing
 type MockStorage struct {
   counters      map[string]int
   blockedKeys   map[string]bool
+  leases        map[string]int
+  firstSeen     map[string]time.Time
+  renewals      int32
   lastExpiration time.Duration
+  lastBlockDuration time.Duration
 }
 
 // NewMockStorage creates a new mock storage
@@ -20,6 +29,8 @@ func NewMockStorage() *MockStorage {
   return &MockStorage{
     counters:    make(map[string]int),
     blockedKeys: make(map[string]bool),
+    leases:      make(map[string]int),
+    firstSeen:   make(map[string]time.Time),
   }
 }
 
@@ -30,11 +41,52 @@ func (m *MockStorage) Get(ctx context.Context, key string) (int, error) {
 
 // Increment increments the counter for a key and returns the new value
 func (m *MockStorage) Increment(ctx context.Context, key string, expiration time.Duration) (int, error) {
+  return m.IncrementBy(ctx, key, 1, expiration)
+}
+
+// IncrementBy adds n to the counter for a key and returns the new value
+func (m *MockStorage) IncrementBy(ctx context.Context, key string, n int, expiration time.Duration) (int, error) {
   m.lastExpiration = expiration
+  m.counters[key] += n
+  return m.counters[key], nil
+}
+
+// IncrementFixed increments a counter, its expiration is only recorded when
+// the increment creates it
+func (m *MockStorage) IncrementFixed(ctx context.Context, key string, expiration time.Duration) (int, error) {
+  if _, exists := m.counters[key]; !exists {
+    m.lastExpiration = expiration
+  }
   m.counters[key]++
   return m.counters[key], nil
 }
 
+// IncrementAll adds n to every counter only if none of them would exceed its limit
+func (m *MockStorage) IncrementAll(ctx context.Context, keys []string, n int, limits []int, expirations []time.Duration) ([]int, int, error) {
+  counts := make([]int, len(keys))
+  for i, key := range keys {
+    counts[i] = m.counters[key]
+    if counts[i]+n > limits[i] {
+      return counts, i, nil
+    }
+  }
+  for i, key := range keys {
+    m.lastExpiration = expirations[i]
+    m.counters[key] += n
+    counts[i] = m.counters[key]
+  }
+  return counts, -1, nil
+}
+
+// Decrement subtracts n from an existing counter and returns the new value
+func (m *MockStorage) Decrement(ctx context.Context, key string, n int) (int, error) {
+  if _, exists := m.counters[key]; !exists {
+    return 0, nil
+  }
+  m.counters[key] -= n
+  return m.counters[key], nil
+}
+
 // IsBlocked checks if a key is blocked
 func (m *MockStorage) IsBlocked(ctx context.Context, key string) (bool, error) {
   return m.blockedKeys[key], nil
@@ -42,7 +94,95 @@ func (m *MockStorage) IsBlocked(ctx context.Context, key string) (bool, error) {
 
 // Block blocks a key for the specified duration
 func (m *MockStorage) Block(ctx context.Context, key string, duration time.Duration) error {
+  if duration <= 0 {
+    return nil
+  }
+  m.blockedKeys[key] = true
+  m.lastBlockDuration = duration
+  return nil
+}
+
+// Ban blocks a key without expiry
+func (m *MockStorage) Ban(ctx context.Context, key string) error {
   m.blockedKeys[key] = true
+  m.lastBlockDuration = 0
+  return nil
+}
+
+// BlockTTL returns how long a key remains blocked
+func (m *MockStorage) BlockTTL(ctx context.Context, key string) (time.Duration, error) {
+  if !m.blockedKeys[key] {
+    return 0, nil
+  }
+  return m.lastBlockDuration, nil
+}
+
+// Unblock removes any block on a key
+func (m *MockStorage) Unblock(ctx context.Context, key string) error {
+  delete(m.blockedKeys, key)
+  return nil
+}
+
+// TTL returns how long until a counter expires
+func (m *MockStorage) TTL(ctx context.Context, key string) (time.Duration, error) {
+  if _, exists := m.counters[key]; !exists {
+    return 0, nil
+  }
+  return m.lastExpiration, nil
+}
+
+// FirstSeen returns when a key was first seen, recording now for new keys
+func (m *MockStorage) FirstSeen(ctx context.Context, key string, ttl time.Duration) (time.Time, error) {
+  if _, exists := m.firstSeen[key]; !exists {
+    m.firstSeen[key] = time.Now()
+  }
+  return m.firstSeen[key], nil
+}
+
+// Merge moves the counters and first sightings of the from keys to the to keys
+func (m *MockStorage) Merge(ctx context.Context, from, to []string) (bool, error) {
+  moved := false
+  for i := range from {
+    if n, exists := m.counters[from[i]]; exists {
+      delete(m.counters, from[i])
+      m.counters[to[i]] += n
+      moved = true
+    }
+    if first, exists := m.firstSeen[from[i]]; exists {
+      delete(m.firstSeen, from[i])
+      if current, exists := m.firstSeen[to[i]]; !exists || first.Before(current) {
+        m.firstSeen[to[i]] = first
+      }
+      moved = true
+    }
+  }
+  return moved, nil
+}
+
+// Reset removes the counter for a key
+func (m *MockStorage) Reset(ctx context.Context, key string) error {
+  delete(m.counters, key)
+  return nil
+}
+
+// AcquireLease takes one of limit concurrent leases on a key
+func (m *MockStorage) AcquireLease(ctx context.Context, key string, limit int, ttl time.Duration) (string, bool, error) {
+  if m.leases[key] >= limit {
+    return "", false, nil
+  }
+  m.leases[key]++
+  return key, true, nil
+}
+
+// RenewLease counts the renewals of leases, it may run concurrently
+func (m *MockStorage) RenewLease(ctx context.Context, key, lease string, ttl time.Duration) (bool, error) {
+  atomic.AddInt32(&m.renewals, 1)
+  return true, nil
+}
+
+// ReleaseLease gives back a lease taken with AcquireLease
+func (m *MockStorage) ReleaseLease(ctx context.Context, key, lease string) error {
+  m.leases[key]--
   return nil
 }
 
@@ -72,26 +212,26 @@ func TestRateLimiterIP(t *testing.T) {
 
   // First 3 requests should be allowed
   for i := 0; i < 3; i++ {
-    allowed, err := limiter.CheckIP(ctx, ip)
+    result, err := limiter.CheckIP(ctx, ip, 1)
     if err != nil {
       t.Errorf("Error checking IP: %v", err)
     }
-    if !allowed {
+    if !result.Allowed {
       t.Errorf("Request %d should be allowed", i+1)
     }
   }
 
   // 4th request should be blocked
-  allowed, err := limiter.CheckIP(ctx, ip)
+  result, err := limiter.CheckIP(ctx, ip, 1)
   if err != nil {
     t.Errorf("Error checking IP: %v", err)
   }
-  if allowed {
+  if result.Allowed {
     t.Error("4th request should be blocked")
   }
 
   // Verify the IP is now blocked
-  blocked, err := mockStorage.IsBlocked(ctx, ip)
+  blocked, err := mockStorage.IsBlocked(ctx, "default:ip:ip:"+ip)
   if err != nil {
     t.Errorf("Error checking if IP is blocked: %v", err)
   }
@@ -121,26 +261,26 @@ func TestRateLimiterToken(t *testing.T) {
 
   // First 5 requests should be allowed
   for i := 0; i < 5; i++ {
-    allowed, err := limiter.CheckToken(ctx, token)
+    result, err := limiter.CheckToken(ctx, token, 1)
     if err != nil {
       t.Errorf("Error checking token: %v", err)
     }
-    if !allowed {
+    if !result.Allowed {
       t.Errorf("Request %d should be allowed", i+1)
     }
   }
 
   // 6th request should be blocked
-  allowed, err := limiter.CheckToken(ctx, token)
+  result, err := limiter.CheckToken(ctx, token, 1)
   if err != nil {
     t.Errorf("Error checking token: %v", err)
   }
-  if allowed {
+  if result.Allowed {
     t.Error("6th request should be blocked")
   }
 
   // Verify the token is now blocked
-  blocked, err := mockStorage.IsBlocked(ctx, token)
+  blocked, err := mockStorage.IsBlocked(ctx, "default:token:token:"+token)
   if err != nil {
     t.Errorf("Error checking if token is blocked: %v", err)
   }
@@ -148,3 +288,450 @@ func TestRateLimiterToken(t *testing.T) {
     t.Error("Token should be blocked")
   }
 }
+
+// TestRateLimiterEscalatingPenalty tests that repeat offenders are blocked for longer
+func TestRateLimiterEscalatingPenalty(t *testing.T) {
+  mockStorage := NewMockStorage()
+
+  cfg := &config.Config{
+    IPLimit:            1,
+    IPExpiration:       300,
+    BlockDuration:      60,
+    PenaltyMultiplier:  2,
+    PenaltyMaxDuration: 200,
+    PenaltyWindow:      3600,
+  }
+
+  limiter := NewRateLimiter(cfg, mockStorage)
+
+  ip := "192.168.1.1"
+  ctx := context.Background()
+
+  expected := []time.Duration{60 * time.Second, 120 * time.Second, 200 * time.Second}
+  for i, want := range expected {
+    // Each offense starts from a fresh window
+    mockStorage.counters["default:ip:ip:"+ip] = 1
+    delete(mockStorage.blockedKeys, "default:ip:ip:"+ip)
+
+    result, err := limiter.CheckIP(ctx, ip, 1)
+    if err != nil {
+      t.Errorf("Error checking IP: %v", err)
+    }
+    if result.Allowed {
+      t.Errorf("Offense %d should be blocked", i+1)
+    }
+    if mockStorage.lastBlockDuration != want {
+      t.Errorf("Offense %d blocked for %v, want %v", i+1, mockStorage.lastBlockDuration, want)
+    }
+    if result.RetryAfter != want {
+      t.Errorf("Offense %d retry after %v, want %v", i+1, result.RetryAfter, want)
+    }
+  }
+}
+
+// TestRateLimiterBan tests that the ban threshold blocks a key until it is unblocked
+func TestRateLimiterBan(t *testing.T) {
+  mockStorage := NewMockStorage()
+
+  cfg := &config.Config{
+    IPLimit:       1,
+    IPExpiration:  300,
+    BlockDuration: 60,
+    PenaltyWindow: 3600,
+    BanThreshold:  2,
+  }
+
+  limiter := NewRateLimiter(cfg, mockStorage)
+
+  ip := "192.168.1.1"
+  ctx := context.Background()
+
+  for i := 0; i < 2; i++ {
+    mockStorage.counters["default:ip:ip:"+ip] = 1
+    delete(mockStorage.blockedKeys, "default:ip:ip:"+ip)
+    if _, err := limiter.CheckIP(ctx, ip, 1); err != nil {
+      t.Errorf("Error checking IP: %v", err)
+    }
+  }
+
+  if mockStorage.lastBlockDuration != 0 {
+    t.Errorf("IP should be banned without expiry, got block of %v", mockStorage.lastBlockDuration)
+  }
+
+  // Lifting the ban also forgets previous offenses
+  if err := limiter.Unblock(ctx, "default:ip:ip:"+ip); err != nil {
+    t.Errorf("Error unblocking IP: %v", err)
+  }
+  if mockStorage.blockedKeys["default:ip:ip:"+ip] {
+    t.Error("IP should no longer be blocked")
+  }
+  if mockStorage.counters["default:ip:ip.offenses:"+ip] != 0 {
+    t.Error("Offenses should be reset")
+  }
+}
+
+// TestRateLimiterZeroBlockDuration tests that a zero block duration denies
+// over-limit requests without blocking, let alone banning, the key
+func TestRateLimiterZeroBlockDuration(t *testing.T) {
+  store := storage.NewMemoryStorage()
+
+  cfg := &config.Config{
+    IPLimit:       1,
+    IPExpiration:  300,
+    BlockDuration: 0,
+    PenaltyWindow: 3600,
+  }
+
+  limiter := NewRateLimiter(cfg, store)
+
+  ip := "192.168.1.1"
+  ctx := context.Background()
+
+  for i := 0; i < 2; i++ {
+    if _, err := limiter.CheckIP(ctx, ip, 1); err != nil {
+      t.Errorf("Error checking IP: %v", err)
+    }
+  }
+
+  blocked, err := store.IsBlocked(ctx, "default:ip:ip:"+ip)
+  if err != nil {
+    t.Errorf("Error checking if IP is blocked: %v", err)
+  }
+  if blocked {
+    t.Error("IP should not be blocked with a zero block duration")
+  }
+}
+
+// TestRateLimiterDryRun tests that dry-run rules count requests without denying them
+func TestRateLimiterDryRun(t *testing.T) {
+  mockStorage := NewMockStorage()
+
+  cfg := &config.Config{
+    IPLimit:       1,
+    IPExpiration:  300,
+    BlockDuration: 300,
+    IPDryRun:      true,
+  }
+
+  limiter := NewRateLimiter(cfg, mockStorage)
+
+  ip := "192.168.1.1"
+  ctx := context.Background()
+
+  for i := 0; i < 3; i++ {
+    result, err := limiter.CheckIP(ctx, ip, 1)
+    if err != nil {
+      t.Errorf("Error checking IP: %v", err)
+    }
+    if !result.Allowed {
+      t.Errorf("Request %d should be allowed in dry-run mode", i+1)
+    }
+    if result.OverLimit != (i > 0) {
+      t.Errorf("Request %d over limit = %v, want %v", i+1, result.OverLimit, i > 0)
+    }
+  }
+
+  if mockStorage.counters["default:ip:ip:"+ip] != 3 {
+    t.Errorf("Expected 3 counted requests, got %d", mockStorage.counters["default:ip:ip:"+ip])
+  }
+  if mockStorage.blockedKeys["default:ip:ip:"+ip] {
+    t.Error("IP should not be blocked in dry-run mode")
+  }
+}
+
+// TestRateLimiterRejectOnly tests that reject-only rules deny without blocking
+func TestRateLimiterRejectOnly(t *testing.T) {
+  mockStorage := NewMockStorage()
+
+  cfg := &config.Config{
+    IPLimit:       1,
+    IPExpiration:  60,
+    BlockDuration: 300,
+    IPMode:        "reject",
+    SkipDenied:    true,
+  }
+
+  limiter := NewRateLimiter(cfg, mockStorage)
+
+  ip := "192.168.1.1"
+  ctx := context.Background()
+
+  for i := 0; i < 3; i++ {
+    result, err := limiter.CheckIP(ctx, ip, 1)
+    if err != nil {
+      t.Errorf("Error checking IP: %v", err)
+    }
+    if result.Allowed != (i == 0) {
+      t.Errorf("Request %d allowed = %v, want %v", i+1, result.Allowed, i == 0)
+    }
+    if i > 0 && result.RetryAfter != time.Minute {
+      t.Errorf("Expected to retry once the window frees up, got %v", result.RetryAfter)
+    }
+  }
+
+  if mockStorage.counters["default:ip:ip:"+ip] != 1 {
+    t.Errorf("Expected denied requests not to count, got %d", mockStorage.counters["default:ip:ip:"+ip])
+  }
+  if mockStorage.blockedKeys["default:ip:ip:"+ip] {
+    t.Error("IP should not be blocked by a reject-only rule")
+  }
+}
+
+// TestRateLimiterExtendBlock tests that requests during a block restart it
+func TestRateLimiterExtendBlock(t *testing.T) {
+  mockStorage := NewMockStorage()
+
+  cfg := &config.Config{
+    TokenLimit:      1,
+    TokenExpiration: 60,
+    BlockDuration:   300,
+    ExtendBlocks:    true,
+  }
+
+  limiter := NewRateLimiter(cfg, mockStorage)
+  ctx := context.Background()
+
+  key := limiter.tokenKey("abusive-token").String()
+  mockStorage.Block(ctx, key, 10*time.Second)
+
+  result, err := limiter.CheckToken(ctx, "abusive-token", 1)
+  if err != nil {
+    t.Errorf("Error checking token: %v", err)
+  }
+  if result.Allowed || result.RetryAfter != 300*time.Second {
+    t.Errorf("Expected the block to restart for 300s, got %+v", result)
+  }
+  if mockStorage.lastBlockDuration != 300*time.Second {
+    t.Errorf("Expected the block to be extended, got %v", mockStorage.lastBlockDuration)
+  }
+
+  // Permanent bans are left alone
+  mockStorage.Ban(ctx, key)
+  if _, err := limiter.CheckToken(ctx, "abusive-token", 1); err != nil {
+    t.Errorf("Error checking token: %v", err)
+  }
+  if mockStorage.lastBlockDuration != 0 {
+    t.Errorf("Expected the ban to stay permanent, got %v", mockStorage.lastBlockDuration)
+  }
+}
+
+// TestRateLimiterCost tests that weighted requests consume several units of the budget
+func TestRateLimiterCost(t *testing.T) {
+  mockStorage := NewMockStorage()
+
+  cfg := &config.Config{
+    TokenLimit:      100,
+    TokenExpiration: 300,
+    BlockDuration:   300,
+  }
+
+  limiter := NewRateLimiter(cfg, mockStorage)
+
+  token := "test-token"
+  ctx := context.Background()
+
+  // A bulk call worth 60 units fits in the budget
+  result, err := limiter.CheckToken(ctx, token, 60)
+  if err != nil {
+    t.Errorf("Error checking token: %v", err)
+  }
+  if !result.Allowed {
+    t.Error("First bulk request should be allowed")
+  }
+
+  // A second one exceeds it
+  result, err = limiter.CheckToken(ctx, token, 60)
+  if err != nil {
+    t.Errorf("Error checking token: %v", err)
+  }
+  if result.Allowed {
+    t.Error("Second bulk request should be blocked")
+  }
+  if mockStorage.counters["default:token:token:"+token] != 120 {
+    t.Errorf("Expected 120 consumed units, got %d", mockStorage.counters["default:token:token:"+token])
+  }
+}
+
+// TestRateLimiterRefund tests that refunded units can be used again
+func TestRateLimiterRefund(t *testing.T) {
+  mockStorage := NewMockStorage()
+
+  cfg := &config.Config{
+    TokenLimit:      100,
+    TokenExpiration: 300,
+    BlockDuration:   300,
+  }
+
+  limiter := NewRateLimiter(cfg, mockStorage)
+
+  token := "test-token"
+  ctx := context.Background()
+
+  // A failed bulk call is refunded
+  if _, err := limiter.CheckToken(ctx, token, 60); err != nil {
+    t.Errorf("Error checking token: %v", err)
+  }
+  if err := limiter.RefundToken(ctx, token, 60); err != nil {
+    t.Errorf("Error refunding token: %v", err)
+  }
+
+  // So the next one still fits in the budget
+  result, err := limiter.CheckToken(ctx, token, 60)
+  if err != nil {
+    t.Errorf("Error checking token: %v", err)
+  }
+  if !result.Allowed {
+    t.Error("Bulk request after a refund should be allowed")
+  }
+  if mockStorage.counters["default:token:token:"+token] != 60 {
+    t.Errorf("Expected 60 consumed units, got %d", mockStorage.counters["default:token:token:"+token])
+  }
+}
+
+// TestRateLimiterConcurrency tests the per-key and global in-flight limits
+func TestRateLimiterConcurrency(t *testing.T) {
+  mockStorage := NewMockStorage()
+
+  cfg := &config.Config{
+    MaxConcurrentPerKey: 1,
+    MaxConcurrent:       2,
+    LeaseTTL:            60,
+  }
+
+  limiter := NewRateLimiter(cfg, mockStorage)
+  ctx := context.Background()
+
+  releaseFirst, ok, err := limiter.AcquireIP(ctx, "192.168.1.1")
+  if err != nil || !ok {
+    t.Fatalf("First request should acquire a slot: %v", err)
+  }
+
+  // The same IP is limited to one request in flight
+  if _, ok, _ := limiter.AcquireIP(ctx, "192.168.1.1"); ok {
+    t.Error("Second request from the same IP should not acquire a slot")
+  }
+
+  releaseSecond, ok, err := limiter.AcquireToken(ctx, "test-token")
+  if err != nil || !ok {
+    t.Fatalf("Token request should acquire a slot: %v", err)
+  }
+
+  // The global pool is exhausted, and the per-key lease is given back
+  if _, ok, _ := limiter.AcquireIP(ctx, "192.168.1.2"); ok {
+    t.Error("Request over the global limit should not acquire a slot")
+  }
+  if mockStorage.leases["default:concurrency:ip:192.168.1.2"] != 0 {
+    t.Error("Per-key lease should be released when the global limit is reached")
+  }
+
+  releaseFirst()
+  releaseSecond()
+
+  if _, ok, _ := limiter.AcquireIP(ctx, "192.168.1.1"); !ok {
+    t.Error("Released slots should be available again")
+  }
+}
+
+// TestRateLimiterWaitMode tests that over-limit requests in wait mode are
+// delayed until the window frees up instead of blocking the key
+func TestRateLimiterWaitMode(t *testing.T) {
+  store := storage.NewMemoryStorage()
+
+  cfg := &config.Config{
+    IPLimit:       1,
+    IPExpiration:  1,
+    BlockDuration: 300,
+    PenaltyWindow: 3600,
+    IPMode:        "block",
+    MaxWait:       5,
+  }
+
+  limiter := NewRateLimiter(cfg, store)
+  rateLimiter := middleware.NewRateLimiterMiddleware(limiter, middleware.WithWaitMode(5*time.Second, 1))
+  handler := rateLimiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+  start := time.Now()
+  for i := 0; i < 2; i++ {
+    rr := httptest.NewRecorder()
+    handler.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+    if rr.Code != http.StatusOK {
+      t.Errorf("Request %d should be allowed after waiting, got status %d", i+1, rr.Code)
+    }
+  }
+  if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+    t.Errorf("Second request should wait for the window, took %v", elapsed)
+  }
+
+  ctx := context.Background()
+  key := "default:ip:ip:192.0.2.1"
+  if blocked, _ := store.IsBlocked(ctx, key); blocked {
+    t.Error("Waiting requests should not block the key")
+  }
+  if offenses, _ := store.Get(ctx, "default:ip:ip.offenses:192.0.2.1"); offenses != 0 {
+    t.Errorf("Waiting requests should not record offenses, got %d", offenses)
+  }
+  if count, _ := store.Get(ctx, key); count != 1 {
+    t.Errorf("Only the allowed request should count in the new window, got %d", count)
+  }
+}
+
+// TestRateLimiterLeaseRenewal tests that leases are renewed while held
+func TestRateLimiterLeaseRenewal(t *testing.T) {
+  mockStorage := NewMockStorage()
+  limiter := NewRateLimiter(&config.Config{MaxConcurrentPerKey: 1}, mockStorage)
+  limiter.leaseTTL = 30 * time.Millisecond
+
+  release, ok, err := limiter.AcquireIP(context.Background(), "192.168.1.1")
+  if err != nil || !ok {
+    t.Fatalf("Request should acquire a slot: %v", err)
+  }
+
+  time.Sleep(100 * time.Millisecond)
+  release()
+  renewals := atomic.LoadInt32(&mockStorage.renewals)
+  if renewals == 0 {
+    t.Error("Lease should be renewed while the request runs")
+  }
+
+  // Releasing twice is harmless and stops the renewals
+  release()
+  time.Sleep(50 * time.Millisecond)
+  if atomic.LoadInt32(&mockStorage.renewals) != renewals {
+    t.Error("Lease should not be renewed once released")
+  }
+  if mockStorage.leases["default:concurrency:ip:192.168.1.1"] != 0 {
+    t.Error("Lease should be released once")
+  }
+}
+
+// TestRateLimiterRemaining tests that results report the remaining budget
+func TestRateLimiterRemaining(t *testing.T) {
+  mockStorage := NewMockStorage()
+
+  cfg := &config.Config{
+    IPLimit:       3,
+    IPExpiration:  60,
+    BlockDuration: 300,
+  }
+
+  limiter := NewRateLimiter(cfg, mockStorage)
+  ctx := context.Background()
+
+  for i, want := range []int{2, 1, 0} {
+    result, err := limiter.CheckIP(ctx, "192.168.1.1", 1)
+    if err != nil {
+      t.Errorf("Error checking IP: %v", err)
+    }
+    if result.Limit != 3 || result.Remaining != want || result.Reset != time.Minute {
+      t.Errorf("Request %d: limit %d, remaining %d, reset %v", i+1, result.Limit, result.Remaining, result.Reset)
+    }
+  }
+
+  result, err := limiter.CheckIP(ctx, "192.168.1.1", 1)
+  if err != nil {
+    t.Errorf("Error checking IP: %v", err)
+  }
+  if result.Remaining != 0 || result.RetryAfter != 5*time.Minute {
+    t.Errorf("Denied request: remaining %d, retry after %v", result.Remaining, result.RetryAfter)
+  }
+}
@@ -0,0 +1,146 @@
+package limiter
+
+import (
+  "context"
+  "log"
+  "sort"
+  "strconv"
+  "time"
+
+  "rate-limiter/interfaces"
+)
+
+// Period is the calendar unit a quota resets on
+type Period string
+
+const (
+  // Hourly quotas reset at the top of every hour
+  Hourly Period = "hourly"
+  // Daily quotas reset at midnight
+  Daily Period = "daily"
+  // Weekly quotas reset at midnight on Monday
+  Weekly Period = "weekly"
+  // Monthly quotas reset at midnight on the 1st
+  Monthly Period = "monthly"
+)
+
+// Quota limits the cost units a client may use per calendar period, on top
+// of the short-term rate limits
+type Quota struct {
+  Period Period
+  Limit  int
+}
+
+// window returns the calendar period containing now in the location
+func (p Period) window(now time.Time, loc *time.Location) (time.Time, time.Time) {
+  t := now.In(loc)
+  year, month, day := t.Date()
+  switch p {
+  case Hourly:
+    start := time.Date(year, month, day, t.Hour(), 0, 0, 0, loc)
+    return start, start.Add(time.Hour)
+  case Daily:
+    return time.Date(year, month, day, 0, 0, 0, 0, loc), time.Date(year, month, day+1, 0, 0, 0, 0, loc)
+  case Weekly:
+    day -= (int(t.Weekday()) + 6) % 7
+    return time.Date(year, month, day, 0, 0, 0, 0, loc), time.Date(year, month, day+7, 0, 0, 0, 0, loc)
+  default:
+    return time.Date(year, month, 1, 0, 0, 0, 0, loc), time.Date(year, month+1, 1, 0, 0, 0, 0, loc)
+  }
+}
+
+// newQuotas builds the quotas from limits keyed by period, ignoring unknown
+// periods, ordered from the shortest period to the longest
+func newQuotas(limits map[string]int) []Quota {
+  var quotas []Quota
+  for period, limit := range limits {
+    switch Period(period) {
+    case Hourly, Daily, Weekly, Monthly:
+      if limit > 0 {
+        quotas = append(quotas, Quota{Period: Period(period), Limit: limit})
+      }
+    default:
+      log.Printf("Warning: Unknown quota period '%s', ignoring it", period)
+    }
+  }
+
+  order := map[Period]int{Hourly: 0, Daily: 1, Weekly: 2, Monthly: 3}
+  sort.Slice(quotas, func(i, j int) bool {
+    return order[quotas[i].Period] < order[quotas[j].Period]
+  })
+  return quotas
+}
+
+// loadLocation returns the named time zone, UTC when it is unknown
+func loadLocation(name string) *time.Location {
+  loc, err := time.LoadLocation(name)
+  if err != nil {
+    log.Printf("Warning: Unknown quota timezone '%s', using UTC", name)
+    return time.UTC
+  }
+  return loc
+}
+
+// checkQuotas charges cost units to every quota of a client at once, none
+// are charged when one of them is used up
+func (rl *RateLimiter) checkQuotas(ctx context.Context, k Key, cost int) (interfaces.Result, error) {
+  now := rl.now()
+  keys := make([]string, len(rl.quotas))
+  limits := make([]int, len(rl.quotas))
+  expirations := make([]time.Duration, len(rl.quotas))
+  for i, quota := range rl.quotas {
+    start, end := quota.Period.window(now, rl.quotaLocation)
+    keys[i] = rl.quotaKey(quota, k, start).String()
+    limits[i] = quota.Limit
+    expirations[i] = end.Sub(now)
+  }
+
+  counts, denied, err := rl.storage.IncrementAll(ctx, keys, cost, limits, expirations)
+  if err != nil {
+    return interfaces.Result{}, err
+  }
+
+  if denied >= 0 {
+    quota := rl.quotas[denied]
+    return interfaces.Result{
+      Rule:       string(quota.Period),
+      Limit:      quota.Limit,
+      OverLimit:  true,
+      Reset:      expirations[denied],
+      RetryAfter: expirations[denied],
+    }, nil
+  }
+
+  // Report the quota closest to being used up
+  tightest := 0
+  for i := range rl.quotas {
+    if limits[i]-counts[i] < limits[tightest]-counts[tightest] {
+      tightest = i
+    }
+  }
+  return interfaces.Result{
+    Allowed:   true,
+    Rule:      string(rl.quotas[tightest].Period),
+    Limit:     limits[tightest],
+    Remaining: limits[tightest] - counts[tightest],
+    Reset:     expirations[tightest],
+  }, nil
+}
+
+// refundQuotas gives back cost units charged to the current period of every
+// quota of a client
+func (rl *RateLimiter) refundQuotas(ctx context.Context, k Key, cost int) error {
+  now := rl.now()
+  for _, quota := range rl.quotas {
+    start, _ := quota.Period.window(now, rl.quotaLocation)
+    if err := rl.refund(ctx, rl.quotaKey(quota, k, start), cost); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// quotaKey builds the key counting a client in the period starting at start
+func (rl *RateLimiter) quotaKey(quota Quota, k Key, start time.Time) Key {
+  return rl.key(string(quota.Period), k.Dimension, strconv.FormatInt(start.Unix(), 10)+":"+k.Value)
+}
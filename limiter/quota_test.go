@@ -0,0 +1,144 @@
+package limiter
+
+import (
+  "context"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+  "time"
+
+  "rate-limiter/config"
+  "rate-limiter/middleware"
+)
+
+func TestPeriodWindow(t *testing.T) {
+  loc := time.FixedZone("BRT", -3*60*60)
+  // Saturday 2024-03-02 01:30 UTC is still Friday 2024-03-01 in BRT
+  now := time.Date(2024, 3, 2, 1, 30, 0, 0, time.UTC)
+
+  tests := []struct {
+    period     Period
+    start, end time.Time
+  }{
+    {Hourly, time.Date(2024, 3, 1, 22, 0, 0, 0, loc), time.Date(2024, 3, 1, 23, 0, 0, 0, loc)},
+    {Daily, time.Date(2024, 3, 1, 0, 0, 0, 0, loc), time.Date(2024, 3, 2, 0, 0, 0, 0, loc)},
+    {Weekly, time.Date(2024, 2, 26, 0, 0, 0, 0, loc), time.Date(2024, 3, 4, 0, 0, 0, 0, loc)},
+    {Monthly, time.Date(2024, 3, 1, 0, 0, 0, 0, loc), time.Date(2024, 4, 1, 0, 0, 0, 0, loc)},
+  }
+
+  for _, tt := range tests {
+    start, end := tt.period.window(now, loc)
+    if !start.Equal(tt.start) || !end.Equal(tt.end) {
+      t.Errorf("%s: expected %v to %v, got %v to %v", tt.period, tt.start, tt.end, start, end)
+    }
+  }
+}
+
+func TestRateLimiterQuota(t *testing.T) {
+  ctx := context.Background()
+  mockStorage := NewMockStorage()
+
+  cfg := &config.Config{
+    IPLimit:       10,
+    IPExpiration:  60,
+    BlockDuration: 300,
+    Quotas:        map[string]int{"monthly": 3, "yearly": 1},
+  }
+  limiter := NewRateLimiter(cfg, mockStorage)
+  now := time.Date(2024, 1, 31, 23, 0, 0, 0, time.UTC)
+  limiter.now = func() time.Time { return now }
+
+  ip := "192.168.1.1"
+
+  // Should allow up to the quota, reporting the units left in it
+  for i := 0; i < 3; i++ {
+    result, err := limiter.CheckIP(ctx, ip, 1)
+    if err != nil {
+      t.Fatalf("Unexpected error: %v", err)
+    }
+    if !result.Allowed || result.Remaining != 2-i {
+      t.Errorf("Expected request %d to be allowed with %d remaining, got %+v", i+1, 2-i, result)
+    }
+  }
+
+  // Should deny over the quota until the month ends, without blocking
+  result, err := limiter.CheckIP(ctx, ip, 1)
+  if err != nil {
+    t.Fatalf("Unexpected error: %v", err)
+  }
+  if result.Allowed || result.Rule != "monthly" || result.RetryAfter != time.Hour {
+    t.Errorf("Expected a denial by the monthly quota for an hour, got %+v", result)
+  }
+  if count := mockStorage.counters["default:ip:ip:"+ip]; count != 3 {
+    t.Errorf("Expected the denied request to be given back to the rate limit, got %d", count)
+  }
+  if mockStorage.blockedKeys["default:ip:ip:"+ip] {
+    t.Errorf("Expected the IP not to be blocked")
+  }
+
+  // Should start afresh in the next month
+  now = now.Add(time.Hour)
+  result, _ = limiter.CheckIP(ctx, ip, 1)
+  if !result.Allowed {
+    t.Errorf("Expected the next month to be allowed, got %+v", result)
+  }
+
+  // Should give back units to the quota
+  if err := limiter.RefundIP(ctx, ip, 1); err != nil {
+    t.Fatalf("Unexpected error: %v", err)
+  }
+  if count := mockStorage.counters["default:monthly:ip:1706745600:"+ip]; count != 0 {
+    t.Errorf("Expected the quota to be refunded, got %d", count)
+  }
+}
+
+// TestRateLimiterCapacityQuota tests that the global capacity of priority
+// classes is not charged against the quotas like a client
+func TestRateLimiterCapacityQuota(t *testing.T) {
+  mockStorage := NewMockStorage()
+  cfg := &config.Config{
+    IPLimit:       10,
+    IPExpiration:  60,
+    BlockDuration: 300,
+    Quotas:        map[string]int{"monthly": 2},
+  }
+  limiter := NewRateLimiter(cfg, mockStorage)
+  priorities := &middleware.Priorities{
+    Capacity:   100,
+    Expiration: time.Minute,
+    Classes:    []middleware.PriorityClass{{Name: "normal", Share: 100}},
+    Default:    "normal",
+  }
+  m := middleware.NewRateLimiterMiddleware(limiter, middleware.WithPriorities(limiter, priorities))
+  handler := m.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+  serve := func(ip string) int {
+    req := httptest.NewRequest("GET", "/", nil)
+    req.RemoteAddr = ip + ":1234"
+    rr := httptest.NewRecorder()
+    handler.ServeHTTP(rr, req)
+    return rr.Code
+  }
+
+  // Every client may use up its own quota, the capacity has none
+  for _, ip := range []string{"192.168.1.1", "192.168.1.2", "192.168.1.3"} {
+    for i := 0; i < 2; i++ {
+      if code := serve(ip); code != http.StatusOK {
+        t.Errorf("Expected request %d of %s to be allowed, got %d", i+1, ip, code)
+      }
+    }
+  }
+  if code := serve("192.168.1.1"); code != http.StatusTooManyRequests {
+    t.Errorf("Expected the client over its quota to be denied, got %d", code)
+  }
+
+  if count := mockStorage.counters["default:capacity:global:all"]; count != 6 {
+    t.Errorf("Expected the capacity to be charged 6 units, got %d", count)
+  }
+  for key := range mockStorage.counters {
+    if strings.HasPrefix(key, "default:monthly:global:") {
+      t.Errorf("Expected the capacity not to be charged against the quota, got %s", key)
+    }
+  }
+}
@@ -0,0 +1,250 @@
+package limiter
+
+import (
+  "context"
+  "log"
+  "sync"
+  "time"
+
+  "rate-limiter/interfaces"
+  "rate-limiter/metrics"
+  "rate-limiter/tenant"
+  "rate-limiter/usage"
+)
+
+// TenantLimiter hands each decision to the limiter of the tenant carried by
+// the request context, requests without a known tenant use the default one
+type TenantLimiter struct {
+  *RateLimiter
+  tenants map[string]*RateLimiter
+  usage   *usage.Recorder
+
+  // rotated holds the previous-secret keys whose usage was already moved
+  rotated sync.Map
+}
+
+// NewTenantLimiter creates a tenant limiter on top of the default limiter,
+// every tenant gets its own key namespace, per-client rules and ceiling
+func NewTenantLimiter(rl *RateLimiter, tenants []tenant.Tenant) *TenantLimiter {
+  tl := &TenantLimiter{RateLimiter: rl, tenants: make(map[string]*RateLimiter)}
+  for _, t := range tenants {
+    tl.tenants[t.Name] = rl.forTenant(t)
+  }
+  return tl
+}
+
+// SetUsageRecorder records the decisions taken for every client in the
+// recorder, nil stops recording
+func (tl *TenantLimiter) SetUsageRecorder(recorder *usage.Recorder) {
+  tl.usage = recorder
+}
+
+// CheckIP checks an IP address against the limits of its tenant
+func (tl *TenantLimiter) CheckIP(ctx context.Context, ip string, cost int) (interfaces.Result, error) {
+  rl := tl.limiter(ctx)
+  result, err := rl.CheckIP(ctx, ip, cost)
+  recordDecision(rl.tenant, result, err)
+  tl.recordUsage(ctx, rl.key(rl.ipRule.Name, "ip", ip), result, err, cost)
+  return result, err
+}
+
+// CheckToken checks a token against the limits of its tenant
+func (tl *TenantLimiter) CheckToken(ctx context.Context, token string, cost int) (interfaces.Result, error) {
+  rl := tl.limiter(ctx)
+  result, err := rl.CheckToken(ctx, token, cost)
+  recordDecision(rl.tenant, result, err)
+  tl.rotateUsage(ctx, rl, rl.tokenKey(token), token)
+  tl.recordUsage(ctx, rl.tokenKey(token), result, err, cost)
+  return result, err
+}
+
+// CheckLevels checks a chain of limits within the namespace of a tenant, the
+// usage is recorded for the narrowest level
+func (tl *TenantLimiter) CheckLevels(ctx context.Context, levels []interfaces.Level, cost int) (interfaces.Result, error) {
+  rl := tl.limiter(ctx)
+  result, err := rl.CheckLevels(ctx, levels, cost)
+  recordDecision(rl.tenant, result, err)
+  if len(levels) > 0 {
+    if levels[0].Dimension == "token" {
+      tl.rotateUsage(ctx, rl, rl.levelKey(levels[0]), levels[0].Value)
+    }
+    tl.recordUsage(ctx, rl.levelKey(levels[0]), result, err, cost)
+  }
+  return result, err
+}
+
+// RefundLevels gives back cost units charged to a chain of limits of a tenant
+func (tl *TenantLimiter) RefundLevels(ctx context.Context, levels []interfaces.Level, cost int) error {
+  rl := tl.limiter(ctx)
+  if err := rl.RefundLevels(ctx, levels, cost); err != nil || len(levels) == 0 {
+    return err
+  }
+  tl.refundUsage(rl.levelKey(levels[0]), cost)
+  return nil
+}
+
+// RefundIP gives back cost units charged to an IP address of a tenant
+func (tl *TenantLimiter) RefundIP(ctx context.Context, ip string, cost int) error {
+  rl := tl.limiter(ctx)
+  if err := rl.RefundIP(ctx, ip, cost); err != nil {
+    return err
+  }
+  tl.refundUsage(rl.key(rl.ipRule.Name, "ip", ip), cost)
+  return nil
+}
+
+// RefundToken gives back cost units charged to a token of a tenant
+func (tl *TenantLimiter) RefundToken(ctx context.Context, token string, cost int) error {
+  rl := tl.limiter(ctx)
+  if err := rl.RefundToken(ctx, token, cost); err != nil {
+    return err
+  }
+  tl.refundUsage(rl.tokenKey(token), cost)
+  return nil
+}
+
+// AcquireIP takes a concurrency slot for an IP address of a tenant
+func (tl *TenantLimiter) AcquireIP(ctx context.Context, ip string) (func(), bool, error) {
+  return tl.limiter(ctx).AcquireIP(ctx, ip)
+}
+
+// AcquireToken takes a concurrency slot for a token of a tenant
+func (tl *TenantLimiter) AcquireToken(ctx context.Context, token string) (func(), bool, error) {
+  return tl.limiter(ctx).AcquireToken(ctx, token)
+}
+
+// Locked reports whether a key of a tenant is locked out
+func (tl *TenantLimiter) Locked(ctx context.Context, key string) (interfaces.Result, error) {
+  return tl.limiter(ctx).Locked(ctx, key)
+}
+
+// RecordFailure counts a failed attempt for a key of a tenant
+func (tl *TenantLimiter) RecordFailure(ctx context.Context, key string) (interfaces.Result, error) {
+  return tl.limiter(ctx).RecordFailure(ctx, key)
+}
+
+// ReserveAttempt counts an attempt of a key of a tenant before it is made
+func (tl *TenantLimiter) ReserveAttempt(ctx context.Context, key string) (interfaces.Result, error) {
+  return tl.limiter(ctx).ReserveAttempt(ctx, key)
+}
+
+// SettleAttempt settles a reserved attempt of a key of a tenant
+func (tl *TenantLimiter) SettleAttempt(ctx context.Context, key string, failed bool) (interfaces.Result, error) {
+  return tl.limiter(ctx).SettleAttempt(ctx, key, failed)
+}
+
+// ResetFailures forgets the failed attempts of a key of a tenant
+func (tl *TenantLimiter) ResetFailures(ctx context.Context, key string) error {
+  return tl.limiter(ctx).ResetFailures(ctx, key)
+}
+
+// limiter returns the limiter of the tenant carried by the context
+func (tl *TenantLimiter) limiter(ctx context.Context) *RateLimiter {
+  if rl, ok := tl.tenants[tenant.FromContext(ctx)]; ok {
+    return rl
+  }
+  return tl.RateLimiter
+}
+
+// recordDecision counts a decision in the metrics of a tenant
+func recordDecision(name string, result interfaces.Result, err error) {
+  counters := metrics.Tenant(name)
+  switch {
+  case err != nil:
+    counters.Add("errors", 1)
+  case !result.Allowed:
+    counters.Add("denied", 1)
+    counters.Add("denied_by_"+result.Rule, 1)
+  case result.OverLimit:
+    counters.Add("dry_run_denials", 1)
+  default:
+    counters.Add("allowed", 1)
+  }
+}
+
+// recordUsage counts a decision for a client key in the usage recorder, the
+// retries of a denied request add no further denials
+func (tl *TenantLimiter) recordUsage(ctx context.Context, k Key, result interfaces.Result, err error, cost int) {
+  if tl.usage == nil || err != nil || (!result.Allowed && interfaces.IsRetry(ctx)) {
+    return
+  }
+  tl.usage.Record(k.String(), result.Allowed, cost)
+}
+
+// refundUsage takes back the usage of a refunded request of a client key
+func (tl *TenantLimiter) refundUsage(k Key, cost int) {
+  if tl.usage != nil {
+    tl.usage.Refund(k.String(), cost)
+  }
+}
+
+// rotateUsage moves the usage a token gathered under previous secrets over to
+// its current key k, once per previous key
+func (tl *TenantLimiter) rotateUsage(ctx context.Context, rl *RateLimiter, k Key, token string) {
+  if tl.usage == nil {
+    return
+  }
+  for _, previous := range rl.tokenHasher.previous(token) {
+    old := k
+    old.Value = previous
+    from := old.String()
+    if _, done := tl.rotated.LoadOrStore(from, struct{}{}); done {
+      continue
+    }
+    if err := tl.usage.Merge(ctx, from, k.String()); err != nil {
+      tl.rotated.Delete(from)
+      log.Printf("Error merging usage: %v", err)
+    }
+  }
+}
+
+// forTenant returns a limiter sharing the storage and settings of rl that
+// keeps the keys of the tenant apart and applies its rules and ceiling
+func (rl *RateLimiter) forTenant(t tenant.Tenant) *RateLimiter {
+  trl := *rl
+  trl.tenant = t.Name
+
+  if t.IPLimit > 0 {
+    trl.ipRule.Limit = t.IPLimit
+  }
+  if t.IPExpiration > 0 {
+    trl.ipRule.Expiration = time.Duration(t.IPExpiration) * time.Second
+  }
+  if t.TokenLimit > 0 {
+    trl.tokenRule.Limit = t.TokenLimit
+  }
+  if t.TokenExpiration > 0 {
+    trl.tokenRule.Expiration = time.Duration(t.TokenExpiration) * time.Second
+  }
+  if rl.waitMode {
+    warnWaitMode("Tenant '"+t.Name+"' IP", t.IPMode)
+    warnWaitMode("Tenant '"+t.Name+"' token", t.TokenMode)
+  } else {
+    if t.IPMode != "" {
+      trl.ipRule.Mode = parseMode(t.IPMode)
+    }
+    if t.TokenMode != "" {
+      trl.tokenRule.Mode = parseMode(t.TokenMode)
+    }
+  }
+  if t.IPBurst > 0 {
+    trl.ipRule.Burst = t.IPBurst
+  }
+  if t.TokenBurst > 0 {
+    trl.tokenRule.Burst = t.TokenBurst
+  }
+  if t.Limit > 0 {
+    expiration := time.Duration(t.Expiration) * time.Second
+    if expiration <= 0 {
+      expiration = time.Minute
+    }
+    trl.ceiling = Rule{Name: "tenant", Limit: t.Limit, Expiration: expiration}
+  }
+  if len(t.Quotas) > 0 {
+    trl.quotas = newQuotas(t.Quotas)
+  }
+  if t.Timezone != "" {
+    trl.quotaLocation = loadLocation(t.Timezone)
+  }
+  return &trl
+}
@@ -0,0 +1,164 @@
+package limiter
+
+import (
+  "context"
+  "testing"
+  "time"
+
+  "rate-limiter/config"
+  "rate-limiter/interfaces"
+  "rate-limiter/storage"
+  "rate-limiter/tenant"
+  "rate-limiter/usage"
+)
+
+// TestTenantLimiter tests that tenants have their own rules and keys
+func TestTenantLimiter(t *testing.T) {
+  mockStorage := NewMockStorage()
+
+  cfg := &config.Config{
+    IPLimit:       1,
+    IPExpiration:  300,
+    BlockDuration: 300,
+  }
+
+  limiter := NewTenantLimiter(NewRateLimiter(cfg, mockStorage), []tenant.Tenant{
+    {Name: "acme", IPLimit: 3},
+  })
+
+  ip := "192.168.1.1"
+  acme := tenant.NewContext(context.Background(), "acme")
+
+  // The tenant's own limit applies
+  for i := 0; i < 3; i++ {
+    result, err := limiter.CheckIP(acme, ip, 1)
+    if err != nil {
+      t.Errorf("Error checking IP: %v", err)
+    }
+    if !result.Allowed {
+      t.Errorf("Request %d should be allowed for the tenant", i+1)
+    }
+  }
+  if mockStorage.counters["acme:ip:ip:"+ip] != 3 {
+    t.Errorf("Expected 3 requests in the tenant namespace, got %d", mockStorage.counters["acme:ip:ip:"+ip])
+  }
+
+  // Other requests use the default tenant and limits
+  limiter.CheckIP(context.Background(), ip, 1)
+  result, _ := limiter.CheckIP(context.Background(), ip, 1)
+  if result.Allowed {
+    t.Error("Second request without a tenant should be denied")
+  }
+
+  // The tenant is not affected by the default tenant's block
+  mockStorage.counters["acme:ip:ip:"+ip] = 0
+  result, _ = limiter.CheckIP(acme, ip, 1)
+  if !result.Allowed {
+    t.Error("Tenant request should not share the default tenant's block")
+  }
+}
+
+// TestTenantCeiling tests the limit shared by every client of a tenant
+func TestTenantCeiling(t *testing.T) {
+  mockStorage := NewMockStorage()
+
+  cfg := &config.Config{
+    IPLimit:       10,
+    IPExpiration:  300,
+    BlockDuration: 300,
+  }
+
+  limiter := NewTenantLimiter(NewRateLimiter(cfg, mockStorage), []tenant.Tenant{
+    {Name: "acme", Limit: 3, Expiration: 60},
+  })
+  acme := tenant.NewContext(context.Background(), "acme")
+
+  for _, ip := range []string{"192.168.1.1", "192.168.1.2", "192.168.1.3"} {
+    if result, _ := limiter.CheckIP(acme, ip, 1); !result.Allowed {
+      t.Errorf("Request from %s should be allowed", ip)
+    }
+  }
+
+  // A fourth client exceeds the ceiling without being charged or blocked
+  result, err := limiter.CheckIP(acme, "192.168.1.4", 1)
+  if err != nil {
+    t.Errorf("Error checking IP: %v", err)
+  }
+  if result.Allowed || result.Rule != "tenant" {
+    t.Errorf("Expected a denial by the tenant ceiling, got %+v", result)
+  }
+  if mockStorage.counters["acme:ip:ip:192.168.1.4"] != 0 {
+    t.Error("Client denied by the ceiling should be refunded")
+  }
+  if mockStorage.blockedKeys["acme:ip:ip:192.168.1.4"] || mockStorage.blockedKeys["acme:tenant:all:acme"] {
+    t.Error("The ceiling should not block")
+  }
+}
+
+// TestTenantUsage tests that decisions are recorded per client key, without
+// refunded requests nor the denials of retries
+func TestTenantUsage(t *testing.T) {
+  ctx := context.Background()
+  cfg := &config.Config{
+    IPLimit:       1,
+    IPExpiration:  300,
+    BlockDuration: 300,
+    TokenLimit:    10,
+  }
+  limiter := NewTenantLimiter(NewRateLimiter(cfg, NewMockStorage()), []tenant.Tenant{{Name: "acme"}})
+  store := storage.NewMemoryStorage()
+  limiter.SetUsageRecorder(usage.NewRecorder(store, time.Hour, time.Hour))
+
+  limiter.CheckIP(ctx, "192.168.1.1", 1)
+  limiter.CheckIP(ctx, "192.168.1.1", 1)
+  limiter.CheckIP(interfaces.WithRetry(ctx), "192.168.1.1", 1)
+  acme := tenant.NewContext(ctx, "acme")
+  limiter.CheckToken(acme, "abc", 4)
+  limiter.RefundToken(acme, "abc", 4)
+  limiter.CheckToken(acme, "abc", 2)
+  limiter.usage.Flush(ctx)
+
+  totals, _ := store.Usage(ctx, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+  if len(totals) != 2 {
+    t.Fatalf("Expected the usage of 2 keys, got %+v", totals)
+  }
+  if totals[0].Key != "acme:token:token:abc" || totals[0].Allowed != 1 || totals[0].Units != 2 {
+    t.Errorf("Unexpected token usage %+v", totals[0])
+  }
+  if totals[1].Key != "default:ip:ip:192.168.1.1" || totals[1].Allowed != 1 || totals[1].Denied != 1 {
+    t.Errorf("Unexpected IP usage %+v", totals[1])
+  }
+}
+
+// TestTenantUsageRotation tests that the usage of a token under a previous
+// secret moves to its current key once per rotation
+func TestTenantUsageRotation(t *testing.T) {
+  ctx := context.Background()
+  cfg := &config.Config{
+    TokenLimit:               10,
+    TokenHashSecret:          "new",
+    TokenHashPreviousSecrets: []string{"old"},
+  }
+  limiter := NewTenantLimiter(NewRateLimiter(cfg, NewMockStorage()), nil)
+  store := storage.NewMemoryStorage()
+  limiter.SetUsageRecorder(usage.NewRecorder(store, time.Hour, time.Hour))
+
+  old := "default:token:token:" + NewTokenHasher("old").Hash("abc")
+  current := "default:token:token:" + NewTokenHasher("new").Hash("abc")
+  limiter.usage.Record(old, true, 3)
+  limiter.CheckToken(ctx, "abc", 1)
+
+  // Later checks no longer merge the previous key
+  limiter.usage.Record(old, true, 5)
+  limiter.CheckToken(ctx, "abc", 1)
+  limiter.usage.Flush(ctx)
+
+  totals, _ := store.Usage(ctx, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+  units := map[string]int64{}
+  for _, u := range totals {
+    units[u.Key] = u.Units
+  }
+  if units[current] != 5 || units[old] != 5 {
+    t.Errorf("Unexpected usage after the rotation: %+v", totals)
+  }
+}
@@ -2,25 +2,57 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
+	// Quota time zones must resolve in images without a zoneinfo database
+	_ "time/tzdata"
+
+	ratelimitv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
 	"github.com/gorilla/mux"
+	"google.golang.org/grpc"
+	"rate-limiter/admin"
 	"rate-limiter/config"
 	"rate-limiter/interfaces"
 	"rate-limiter/limiter"
 	"rate-limiter/middleware"
+	"rate-limiter/proxy"
+	"rate-limiter/rls"
 	"rate-limiter/storage"
+	"rate-limiter/tenant"
+	"rate-limiter/usage"
 )
 
 func main() {
 	cfg := config.LoadConfig()
 
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate-keys":
+			migrateKeys(cfg)
+			return
+		case "export-usage":
+			exportUsage(cfg, os.Args[2:])
+			return
+		case "hash-token":
+			if len(os.Args) != 3 {
+				log.Fatalf("Usage: %s hash-token <token>", os.Args[0])
+			}
+			hashToken(cfg, os.Args[2])
+			return
+		}
+	}
+
 	var store storage.Storage
 	var err error
 
@@ -41,19 +73,139 @@ func main() {
 		log.Fatalf("Unknown storage type: %s", cfg.StorageType)
 	}
 	defer store.Close()
+	secretConfigured := cfg.TokenHashSecret != ""
+	cfg.TokenHashSecret = tokenHashSecret(cfg)
+	tokenHasher := limiter.NewTokenHasher(cfg.TokenHashSecret, cfg.TokenHashPreviousSecrets...)
+
+	var tenants []tenant.Tenant
+	if cfg.TenantsFile != "" {
+		tenants, err = tenant.Load(cfg.TenantsFile)
+		if err != nil {
+			log.Fatalf("Failed to load tenants: %v", err)
+		}
+		for _, t := range tenants {
+			if len(t.Tokens) > 0 && !secretConfigured {
+				log.Fatalf("RATE_LIMITER_TOKEN_HASH_SECRET is required to match the tokens of tenants")
+			}
+		}
+	}
 
-	rateLimiter := limiter.NewRateLimiter(cfg, store)
+	// Requests without a known tenant use the default limits
+	rateLimiter := limiter.NewTenantLimiter(limiter.NewRateLimiter(cfg, store), tenants)
 	defer rateLimiter.Close()
 
+	// Usage totals are flushed before the storage is closed
+	var recorder *usage.Recorder
+	if cfg.UsageInterval > 0 {
+		recorder = usage.NewRecorder(store.(storage.UsageStorage), time.Duration(cfg.UsageInterval)*time.Second,
+			time.Duration(cfg.UsageRetentionDays)*24*time.Hour)
+		recorder.StartFlushTask(time.Duration(cfg.UsageFlushInterval) * time.Second)
+		defer recorder.Close()
+		rateLimiter.SetUsageRecorder(recorder)
+	}
+
+	// Headers that change how requests are limited are only read from proxies
+	trustedProxies, err := middleware.ParseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		log.Fatalf("Failed to parse trusted proxies: %v", err)
+	}
+
 	var limiterInterface interfaces.RateLimiter = rateLimiter
-	rateLimiterMiddleware := middleware.NewRateLimiterMiddleware(limiterInterface)
+	middlewareOptions := []middleware.Option{
+		middleware.WithTrustedProxies(trustedProxies),
+		middleware.WithRouteCosts(cfg.RouteCosts),
+		middleware.WithCostHeader(cfg.CostHeader),
+		middleware.WithMaxCost(cfg.MaxCost),
+		middleware.WithConcurrencyLimiter(rateLimiter),
+		middleware.WithCheckDenyStatus(cfg.CheckDenyStatus),
+	}
+	var denials middleware.DenialResponses
+	if cfg.DenialResponsesFile != "" {
+		var err error
+		denials, err = middleware.LoadDenialResponses(cfg.DenialResponsesFile)
+		if err != nil {
+			log.Fatalf("Failed to load denial responses: %v", err)
+		}
+		middlewareOptions = append(middlewareOptions, middleware.WithDenialResponses(denials))
+	}
+	if cfg.HierarchyFile != "" {
+		levels, err := middleware.LoadHierarchy(cfg.HierarchyFile)
+		if err != nil {
+			log.Fatalf("Failed to load hierarchy: %v", err)
+		}
+		if cfg.IPBurst > 0 || cfg.TokenBurst > 0 || cfg.IPWarmUp > 0 || cfg.TokenWarmUp > 0 {
+			log.Println("Warning: Bursts and warm-up belong to the IP and token limits, which the hierarchy replaces")
+		}
+		middlewareOptions = append(middlewareOptions, middleware.WithHierarchy(rateLimiter, levels))
+	}
+	if cfg.PrioritiesFile != "" {
+		priorities, err := middleware.LoadPriorities(cfg.PrioritiesFile, tokenHasher.Hashes)
+		if err != nil {
+			log.Fatalf("Failed to load priorities: %v", err)
+		}
+		if len(priorities.Tokens) > 0 && !secretConfigured {
+			log.Fatalf("RATE_LIMITER_TOKEN_HASH_SECRET is required to match the tokens of priority classes")
+		}
+		// The capacity is shared by every tenant
+		middlewareOptions = append(middlewareOptions, middleware.WithPriorities(rateLimiter.RateLimiter, priorities))
+	}
+	if refund := refundRule(cfg); refund != nil {
+		middlewareOptions = append(middlewareOptions, middleware.WithRefunds(rateLimiter, refund))
+	}
+	if adaptive := rateLimiter.Adaptive(); adaptive != nil {
+		middlewareOptions = append(middlewareOptions, middleware.WithLoadObserver(adaptive))
+	}
+	if cfg.MaxWait > 0 {
+		middlewareOptions = append(middlewareOptions, middleware.WithWaitMode(time.Duration(cfg.MaxWait)*time.Second, cfg.MaxQueue))
+	}
+	rateLimiterMiddleware := middleware.NewRateLimiterMiddleware(limiterInterface, middlewareOptions...)
 
 	router := mux.NewRouter()
 
-	router.Use(rateLimiterMiddleware.Middleware)
+	if len(tenants) > 0 {
+		resolver := tenant.NewResolver(tenants, cfg.TenantHeader, tokenHasher.Hashes,
+			tenant.WithTrustedProxies(trustedProxies))
+		router.Use(resolver.Middleware)
+	}
+
+	adminHandler := admin.NewHandler(rateLimiter, cfg.AdminToken)
+	if cfg.AdminToken != "" {
+		adminHandler.Register(router.PathPrefix("/admin").Subrouter())
+	}
+	if len(tenants) > 0 {
+		tenantTokens := make(map[string]string)
+		for _, t := range tenants {
+			tenantTokens[t.Name] = t.AdminToken
+		}
+		adminHandler.RegisterTenants(router.PathPrefix("/admin").Subrouter(), tenantTokens)
+	}
+	if recorder != nil {
+		adminHandler.RegisterUsage(router.PathPrefix("/admin").Subrouter(), store.(storage.UsageStorage))
+	}
+
+	if cfg.CheckPath != "" {
+		router.Handle(cfg.CheckPath, rateLimiterMiddleware.CheckHandler())
+	}
 
-	router.HandleFunc("/", homeHandler).Methods("GET")
-	router.HandleFunc("/api/test", testHandler).Methods("GET")
+	api := router.PathPrefix("/").Subrouter()
+	api.Use(rateLimiterMiddleware.Middleware)
+
+	// Login-style endpoints only count failed attempts
+	if len(cfg.FailurePaths) > 0 {
+		failureOptions := []middleware.FailureOption{
+			middleware.WithFailurePaths(cfg.FailurePaths...),
+			middleware.WithUsernameField(cfg.FailureUsernameField),
+			middleware.WithFailureDenialResponses(denials),
+			middleware.WithFailureTrustedProxies(trustedProxies),
+		}
+		if len(cfg.FailureStatuses) > 0 {
+			failureOptions = append(failureOptions, middleware.WithFailureStatuses(cfg.FailureStatuses...))
+		}
+		if cfg.FailureResetOnSuccess {
+			failureOptions = append(failureOptions, middleware.WithResetOnSuccess())
+		}
+		api.Use(middleware.NewFailureMiddleware(rateLimiter, failureOptions...).Middleware)
+	}
 
 	server := &http.Server{
 		Addr:         fmt.Sprintf(":%s", cfg.ServerPort),
@@ -63,6 +215,26 @@ func main() {
 		IdleTimeout:  60 * time.Second,
 	}
 
+	if cfg.GatewayRoutesFile != "" {
+		log.Println("Running as a reverse proxy gateway")
+		routes, err := proxy.LoadRoutes(cfg.GatewayRoutesFile)
+		if err != nil {
+			log.Fatalf("Failed to load gateway routes: %v", err)
+		}
+		gateway, err := proxy.NewGateway(routes)
+		if err != nil {
+			log.Fatalf("Failed to initialize gateway: %v", err)
+		}
+		gateway.StartHealthChecks(time.Duration(cfg.GatewayHealthInterval) * time.Second)
+		api.PathPrefix("/").Handler(gateway)
+
+		// Streamed responses and WebSockets outlive any fixed write timeout
+		server.WriteTimeout = 0
+	} else {
+		api.HandleFunc("/", homeHandler).Methods("GET")
+		api.HandleFunc("/api/test", testHandler).Methods("GET")
+	}
+
 	go func() {
 		log.Printf("Server starting on port %s", cfg.ServerPort)
 		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
@@ -70,6 +242,32 @@ func main() {
 		}
 	}()
 
+	var grpcServer *grpc.Server
+	if cfg.RLSPort != "" {
+		domains, err := rls.LoadDomains(cfg.RLSConfigFile)
+		if err != nil {
+			log.Fatalf("Failed to load rate limit domains: %v", err)
+		}
+		service, err := rls.NewService(rateLimiter.RateLimiter, domains)
+		if err != nil {
+			log.Fatalf("Failed to initialize rate limit service: %v", err)
+		}
+
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%s", cfg.RLSPort))
+		if err != nil {
+			log.Fatalf("Failed to listen for gRPC: %v", err)
+		}
+		grpcServer = grpc.NewServer()
+		ratelimitv3.RegisterRateLimitServiceServer(grpcServer, service)
+
+		go func() {
+			log.Printf("Envoy rate limit service starting on port %s", cfg.RLSPort)
+			if err := grpcServer.Serve(listener); err != nil {
+				log.Fatalf("gRPC server failed to start: %v", err)
+			}
+		}()
+	}
+
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
@@ -81,10 +279,116 @@ func main() {
 	if err := server.Shutdown(ctx); err != nil {
 		log.Fatalf("Server forced to shutdown: %v", err)
 	}
+	if grpcServer != nil {
+		grpcServer.GracefulStop()
+	}
 
 	log.Println("Server exited properly")
 }
 
+// migrateKeys moves blocks written before keys were namespaced to their
+// structured keys
+func migrateKeys(cfg *config.Config) {
+	if cfg.StorageType != config.StorageTypeRedis {
+		log.Fatalf("Key migration only applies to Redis storage")
+	}
+
+	store, err := storage.NewRedisStorage(cfg)
+	if err != nil {
+		log.Fatalf("Failed to initialize Redis storage: %v", err)
+	}
+	defer store.Close()
+
+	hasher := limiter.NewTokenHasher(tokenHashSecret(cfg))
+	migrated, err := store.MigrateLegacyBlocks(context.Background(), func(legacy string) string {
+		key := limiter.LegacyBlockKey(legacy)
+		if key.Dimension == "token" {
+			key.Value = hasher.Hash(key.Value)
+		}
+		return key.String()
+	})
+	if err != nil {
+		log.Fatalf("Failed to migrate keys after %d blocks: %v", migrated, err)
+	}
+	log.Printf("Migrated %d blocks", migrated)
+}
+
+// tokenHashSecret returns the configured token hash secret. Token identifiers
+// in Redis outlive the process and are shared by every instance, so they need
+// a configured secret, which is never stored next to them. Memory storage
+// ends with the process and hashes with a random secret otherwise.
+func tokenHashSecret(cfg *config.Config) string {
+	if cfg.TokenHashSecret != "" {
+		return cfg.TokenHashSecret
+	}
+	if cfg.StorageType != config.StorageTypeMemory {
+		log.Fatalf("RATE_LIMITER_TOKEN_HASH_SECRET is required with %s storage", cfg.StorageType)
+	}
+
+	log.Println("RATE_LIMITER_TOKEN_HASH_SECRET is not set, hashing tokens with a random secret")
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		log.Fatalf("Failed to generate the token hash secret: %v", err)
+	}
+	return hex.EncodeToString(secret)
+}
+
+// hashToken prints the identifier of a token, which only lasts with a
+// configured secret
+func hashToken(cfg *config.Config, token string) {
+	if cfg.TokenHashSecret == "" {
+		log.Fatalf("RATE_LIMITER_TOKEN_HASH_SECRET is required to hash tokens")
+	}
+	fmt.Println(limiter.NewTokenHasher(cfg.TokenHashSecret).Hash(token))
+}
+
+// exportUsage writes the usage totals stored in Redis to the standard output
+func exportUsage(cfg *config.Config, args []string) {
+	flags := flag.NewFlagSet("export-usage", flag.ExitOnError)
+	from := flags.String("from", "", "First day or RFC 3339 time to export")
+	to := flags.String("to", "", "Last day or RFC 3339 time to export, now by default")
+	format := flags.String("format", usage.FormatCSV, "Output format, csv or jsonl")
+	flags.Parse(args)
+
+	start, end, err := usage.ParseRange(*from, *to)
+	if err != nil {
+		log.Fatalf("Invalid range: %v", err)
+	}
+	if cfg.StorageType != config.StorageTypeRedis {
+		log.Fatalf("Usage export only applies to Redis storage")
+	}
+
+	store, err := storage.NewRedisStorage(cfg)
+	if err != nil {
+		log.Fatalf("Failed to initialize Redis storage: %v", err)
+	}
+	defer store.Close()
+
+	totals, err := store.Usage(context.Background(), start, end)
+	if err != nil {
+		log.Fatalf("Failed to read usage: %v", err)
+	}
+	if err := usage.Write(os.Stdout, *format, totals); err != nil {
+		log.Fatalf("Failed to export usage: %v", err)
+	}
+}
+
+// refundRule builds the refund rule from the configuration, nil when refunds
+// are disabled
+func refundRule(cfg *config.Config) middleware.RefundFunc {
+	var refunds []middleware.RefundFunc
+	if len(cfg.RefundStatuses) > 0 {
+		refunds = append(refunds, middleware.RefundOnStatus(cfg.RefundStatuses...))
+	}
+	if name, value, found := strings.Cut(cfg.RefundHeader, "="); found {
+		refunds = append(refunds, middleware.RefundOnHeader(strings.TrimSpace(name), strings.TrimSpace(value)))
+	}
+	if len(refunds) == 0 {
+		return nil
+	}
+	return middleware.AnyRefund(refunds...)
+}
+
 func homeHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -0,0 +1,36 @@
+package metrics
+
+import (
+  "expvar"
+  "sync"
+)
+
+var (
+  // DryRunDenials counts requests that would have been denied, by rule
+  DryRunDenials = expvar.NewMap("rate_limiter_dry_run_denials")
+
+  // Adaptive holds the factor adaptive limits are scaled by, the backend
+  // health it was derived from and the effective limits
+  Adaptive = expvar.NewMap("rate_limiter_adaptive")
+
+  // Priorities counts the allowed and shed requests of each priority class
+  Priorities = expvar.NewMap("rate_limiter_priorities")
+
+  // Tenants holds the decision counters of each tenant
+  Tenants = expvar.NewMap("rate_limiter_tenants")
+
+  tenantsMutex sync.Mutex
+)
+
+// Tenant returns the decision counters of a tenant, creating them on first use
+func Tenant(name string) *expvar.Map {
+  tenantsMutex.Lock()
+  defer tenantsMutex.Unlock()
+
+  if counters, ok := Tenants.Get(name).(*expvar.Map); ok {
+    return counters
+  }
+  counters := new(expvar.Map).Init()
+  Tenants.Set(name, counters)
+  return counters
+}
@@ -0,0 +1,142 @@
+package middleware
+
+import (
+  "context"
+  "net/http"
+  "strconv"
+  "time"
+
+  "rate-limiter/interfaces"
+)
+
+// ConcurrencyRule is the rule reported for requests denied a concurrency slot
+const ConcurrencyRule = "concurrency"
+
+// Admission is the outcome of admitting a request, shared by the HTTP
+// middleware and the framework adapters
+type Admission struct {
+  // Result is the outcome of the rate limit check
+  Result interfaces.Result
+
+  // Allowed reports whether the request may be served
+  Allowed bool
+
+  m       *RateLimiterMiddleware
+  start   time.Time
+  release func()
+  token   string
+  ip      string
+  levels  []interfaces.Level
+  cost    int
+}
+
+// Release gives back the concurrency slot held by an allowed request, it
+// must be called once the request completes
+func (a *Admission) Release() {
+  if a.release != nil {
+    a.release()
+    a.release = nil
+  }
+}
+
+// Finish completes an allowed request once its handler returned, given the
+// status and headers of its response or a zero status when none was written.
+// The load observer sees how long the request was served and whether it
+// failed, and its units are given back when the response matches the refund
+// rule. Framework adapters must call it like the HTTP middleware does.
+func (a *Admission) Finish(ctx context.Context, status int, header http.Header) {
+  if !a.Allowed || a.m == nil {
+    return
+  }
+  if a.m.load != nil {
+    a.m.load.Observe(time.Since(a.start), status >= http.StatusInternalServerError)
+  }
+  if a.m.refunder != nil && status != 0 && a.m.refundFunc(status, header) {
+    a.m.refund(ctx, a)
+  }
+}
+
+// Headers returns the response headers describing the admission
+func (a *Admission) Headers() http.Header {
+  header := make(http.Header)
+  result := a.Result
+
+  if result.Limit > 0 {
+    header.Set(LimitHeader, strconv.Itoa(result.Limit))
+    header.Set(RemainingHeader, strconv.Itoa(result.Remaining))
+    header.Set(ResetHeader, strconv.Itoa(seconds(result.Reset)))
+  }
+  if !result.Allowed && result.RetryAfter > 0 {
+    header.Set("Retry-After", strconv.Itoa(seconds(result.RetryAfter)))
+  }
+
+  // Requests over a dry-run limit pass through but are marked
+  if result.Allowed && result.OverLimit {
+    header.Set(DryRunHeader, "over-limit")
+  }
+  return header
+}
+
+// Admit takes a concurrency slot for a request made by the given IP and
+// token and runs its rate limit check, waiting for capacity in wait mode
+func (m *RateLimiterMiddleware) Admit(r *http.Request, ip, token string) (*Admission, error) {
+  ctx := r.Context()
+
+  start := time.Now()
+  cost := m.requestCost(r)
+  levels := m.requestLevels(r, ip, token)
+  class := m.requestClass(r, token)
+
+  admission := &Admission{m: m, token: token, ip: ip, levels: levels, cost: cost}
+  for {
+    // The slot is taken first so requests turned away for concurrency are
+    // not charged against the rate budget
+    release, acquired, err := m.acquire(ctx, token, ip)
+    if err != nil {
+      return nil, err
+    }
+    if !acquired {
+      admission.Result = interfaces.Result{Rule: ConcurrencyRule}
+      return admission, nil
+    }
+
+    result, err := m.check(ctx, token, ip, levels, class, cost)
+    if err != nil {
+      release()
+      return nil, err
+    }
+    admission.Result, admission.Allowed = result, result.Allowed
+    if result.Allowed {
+      admission.release, admission.start = release, time.Now()
+      return admission, nil
+    }
+
+    // In wait mode over-limit requests retry once the limiter allows them,
+    // without holding a slot while they wait
+    release()
+    if m.queue == nil || !m.queue.wait(ctx, queueKey(token, ip), start, result.RetryAfter) {
+      return admission, nil
+    }
+    ctx = interfaces.WithRetry(ctx)
+  }
+}
+
+// acquire takes a concurrency slot for a request, the returned function gives
+// it back
+func (m *RateLimiterMiddleware) acquire(ctx context.Context, token, ip string) (func(), bool, error) {
+  if m.concurrency == nil {
+    return func() {}, true, nil
+  }
+  if token != "" {
+    return m.concurrency.AcquireToken(ctx, token)
+  }
+  return m.concurrency.AcquireIP(ctx, ip)
+}
+
+// RateLimitExceededBody returns the body of rate limit exceeded responses
+func RateLimitExceededBody() map[string]string {
+  return map[string]string{
+    "error":   "Rate limit exceeded",
+    "message": "you have reached the maximum number of requests or actions allowed within a certain time frame",
+  }
+}
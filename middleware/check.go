@@ -0,0 +1,93 @@
+package middleware
+
+import (
+  "net/http"
+  "net/url"
+)
+
+var (
+  // originalMethodHeaders carry the method of the original request, as set
+  // by nginx auth_request configurations and by Traefik forwardAuth
+  originalMethodHeaders = []string{"X-Original-Method", "X-Forwarded-Method"}
+
+  // originalURIHeaders carry the URI of the original request, as set by
+  // nginx auth_request configurations and by Traefik forwardAuth
+  originalURIHeaders = []string{"X-Original-URI", "X-Forwarded-Uri"}
+)
+
+// WithCheckDenyStatus sets the status the check handler answers for denied
+// requests, 403 by default since nginx auth_request only accepts 401 and 403
+// as denials and turns any other status into a 500. Traefik forwardAuth
+// passes 429 through with the denial body.
+func WithCheckDenyStatus(status int) Option {
+  return func(m *RateLimiterMiddleware) {
+    m.checkDenyStatus = status
+  }
+}
+
+// CheckHandler returns a handler that decides whether the original request
+// described by the forwarding headers is allowed, for use as an nginx
+// auth_request or Traefik forwardAuth endpoint
+func (m *RateLimiterMiddleware) CheckHandler() http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    original := originalRequest(r)
+
+    token, ip := original.Header.Get(TokenHeader), getClientIP(original)
+    levels, class := m.requestLevels(original, ip, token), m.requestClass(original, token)
+    result, err := m.check(r.Context(), token, ip, levels, class, m.requestCost(original))
+    if err != nil {
+      http.Error(w, "Internal server error", http.StatusInternalServerError)
+      return
+    }
+
+    admission := &Admission{Result: result, Allowed: result.Allowed}
+    for name, values := range admission.Headers() {
+      w.Header()[name] = values
+    }
+    if !result.Allowed {
+      if m.checkDenyStatus != http.StatusTooManyRequests {
+        w.WriteHeader(m.checkDenyStatus)
+        return
+      }
+      m.WriteDenial(w, original, result)
+      return
+    }
+
+    w.WriteHeader(http.StatusOK)
+  })
+}
+
+// originalRequest rebuilds the request the proxy is asking about from the
+// forwarding headers of the check request
+func originalRequest(r *http.Request) *http.Request {
+  original := r.Clone(r.Context())
+
+  if method := firstHeader(r, originalMethodHeaders); method != "" {
+    original.Method = method
+  }
+  if uri := firstHeader(r, originalURIHeaders); uri != "" {
+    if parsed, err := url.ParseRequestURI(uri); err == nil {
+      original.URL = parsed
+      original.RequestURI = uri
+    }
+  }
+
+  // nginx usually passes the client address in X-Real-IP
+  if original.Header.Get("X-Forwarded-For") == "" {
+    if realIP := original.Header.Get("X-Real-IP"); realIP != "" {
+      original.Header.Set("X-Forwarded-For", realIP)
+    }
+  }
+
+  return original
+}
+
+// Helper function to get the first non-empty header among names
+func firstHeader(r *http.Request, names []string) string {
+  for _, name := range names {
+    if value := r.Header.Get(name); value != "" {
+      return value
+    }
+  }
+  return ""
+}
@@ -0,0 +1,88 @@
+package middleware
+
+import (
+  "net/http"
+  "net/http/httptest"
+  "testing"
+  "time"
+
+  "rate-limiter/interfaces"
+)
+
+// TestCheckHandlerNginx tests a check request as sent by nginx auth_request
+func TestCheckHandlerNginx(t *testing.T) {
+  mockLimiter := &MockRateLimiter{
+    allowIP: true,
+    result:  interfaces.Result{Limit: 10, Remaining: 7, Reset: 30 * time.Second},
+  }
+  middleware := NewRateLimiterMiddleware(mockLimiter, WithRouteCosts(map[string]int{"/api/bulk": 5}))
+
+  req := httptest.NewRequest("GET", "/check", nil)
+  req.RemoteAddr = "10.0.0.1:12345"
+  req.Header.Set("X-Real-IP", "203.0.113.7")
+  req.Header.Set("X-Original-Method", "POST")
+  req.Header.Set("X-Original-URI", "/api/bulk/import?dry=1")
+  rr := httptest.NewRecorder()
+
+  middleware.CheckHandler().ServeHTTP(rr, req)
+
+  if status := rr.Code; status != http.StatusOK {
+    t.Errorf("Handler returned wrong status code: got %v want %v", status, http.StatusOK)
+  }
+  if mockLimiter.lastKey != "203.0.113.7" {
+    t.Errorf("Checked key %q, want the original client IP", mockLimiter.lastKey)
+  }
+  if mockLimiter.lastCost != 5 {
+    t.Errorf("Checked cost %d, want the cost of the original URI", mockLimiter.lastCost)
+  }
+
+  headers := map[string]string{LimitHeader: "10", RemainingHeader: "7", ResetHeader: "30"}
+  for name, want := range headers {
+    if got := rr.Header().Get(name); got != want {
+      t.Errorf("Header %s = %q, want %q", name, got, want)
+    }
+  }
+}
+
+// TestCheckHandlerTraefik tests a denied check request as sent by Traefik forwardAuth
+func TestCheckHandlerTraefik(t *testing.T) {
+  mockLimiter := &MockRateLimiter{
+    allowToken: false,
+    result:     interfaces.Result{Limit: 100, RetryAfter: 90 * time.Second},
+  }
+  middleware := NewRateLimiterMiddleware(mockLimiter, WithCheckDenyStatus(http.StatusTooManyRequests))
+
+  req := httptest.NewRequest("GET", "/check", nil)
+  req.Header.Set("X-Forwarded-For", "203.0.113.7")
+  req.Header.Set("X-Forwarded-Method", "GET")
+  req.Header.Set("X-Forwarded-Uri", "/api/test")
+  req.Header.Set(TokenHeader, "test-token")
+  rr := httptest.NewRecorder()
+
+  middleware.CheckHandler().ServeHTTP(rr, req)
+
+  if status := rr.Code; status != http.StatusTooManyRequests {
+    t.Errorf("Handler returned wrong status code: got %v want %v", status, http.StatusTooManyRequests)
+  }
+  if mockLimiter.lastKey != "test-token" {
+    t.Errorf("Checked key %q, want the token", mockLimiter.lastKey)
+  }
+  if got := rr.Header().Get("Retry-After"); got != "90" {
+    t.Errorf("Retry-After = %q, want %q", got, "90")
+  }
+}
+
+// TestCheckHandlerDenyStatus tests that denied requests default to the 403
+// nginx auth_request understands
+func TestCheckHandlerDenyStatus(t *testing.T) {
+  middleware := NewRateLimiterMiddleware(&MockRateLimiter{allowIP: false})
+
+  req := httptest.NewRequest("GET", "/check", nil)
+  rr := httptest.NewRecorder()
+
+  middleware.CheckHandler().ServeHTTP(rr, req)
+
+  if status := rr.Code; status != http.StatusForbidden {
+    t.Errorf("Handler returned wrong status code: got %v want %v", status, http.StatusForbidden)
+  }
+}
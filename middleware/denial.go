@@ -0,0 +1,293 @@
+package middleware
+
+import (
+  "bytes"
+  "encoding/json"
+  "fmt"
+  htmltemplate "html/template"
+  "io"
+  "log"
+  "mime"
+  "net/http"
+  "os"
+  "strconv"
+  "strings"
+  "text/template"
+
+  "rate-limiter/interfaces"
+)
+
+const (
+  // mediaJSON is the default media type of denial responses
+  mediaJSON = "application/json"
+
+  // mediaProblem is the RFC 9457 problem details media type
+  mediaProblem = "application/problem+json"
+
+  mediaText = "text/plain"
+  mediaHTML = "text/html"
+)
+
+// denialMediaTypes are the media types denial responses are negotiated
+// between, in order of preference
+var denialMediaTypes = []string{mediaJSON, mediaProblem, mediaText, mediaHTML}
+
+// DenialData is the data available to denial templates
+type DenialData struct {
+  Rule       string
+  Status     int
+  Title      string
+  Limit      int
+  Remaining  int
+  RetryAfter int
+  Reset      int
+}
+
+// DenialHandler writes the body of a denied request, headers describing the
+// limit are already set
+type DenialHandler func(w http.ResponseWriter, r *http.Request, result interfaces.Result)
+
+// renderer renders a denial body
+type renderer interface {
+  Execute(w io.Writer, data any) error
+}
+
+// DenialResponse describes how denied requests are answered
+type DenialResponse struct {
+  status    int
+  templates map[string]renderer
+  handler   DenialHandler
+}
+
+// DenialResponses holds the denial response of each rule, the empty rule
+// name applies to rules without their own
+type DenialResponses map[string]*DenialResponse
+
+// denialSpec is the JSON form of a denial response
+type denialSpec struct {
+  Status    int               `json:"status"`
+  Templates map[string]string `json:"templates"`
+}
+
+// defaultTemplates render the built-in bodies for each media type
+var defaultTemplates = map[string]renderer{
+  mediaJSON: jsonBody{},
+  mediaProblem: template.Must(template.New(mediaProblem).Funcs(templateFuncs).Parse(
+    `{"type":"about:blank","title":{{json .Title}},"status":{{.Status}},` +
+      `"detail":"you have reached the maximum number of requests or actions allowed within a certain time frame",` +
+      `"limit":{{.Limit}},"remaining":{{.Remaining}},"retry_after":{{.RetryAfter}}}` + "\n")),
+  mediaText: template.Must(template.New(mediaText).Parse(
+    "Rate limit exceeded: you have reached the maximum number of requests or actions allowed within a certain time frame." +
+      "{{if .RetryAfter}} Retry in {{.RetryAfter}} seconds.{{end}}\n")),
+  mediaHTML: htmltemplate.Must(htmltemplate.New(mediaHTML).Parse(
+    "<!DOCTYPE html>\n<html><head><title>{{.Title}}</title></head><body><h1>{{.Title}}</h1>" +
+      "<p>You have reached the maximum number of requests or actions allowed within a certain time frame.</p>" +
+      "{{if .RetryAfter}}<p>Retry in {{.RetryAfter}} seconds.</p>{{end}}</body></html>\n")),
+}
+
+// templateFuncs are available to every denial template
+var templateFuncs = template.FuncMap{
+  "json": func(v any) (string, error) {
+    b, err := json.Marshal(v)
+    return string(b), err
+  },
+}
+
+// NewDenialResponse creates a denial response with the given status and
+// templates keyed by media type, media types without a template keep the
+// built-in body. HTML templates are escaped as HTML.
+func NewDenialResponse(status int, templates map[string]string) (*DenialResponse, error) {
+  if status == 0 {
+    status = http.StatusTooManyRequests
+  }
+  if status < 400 || status > 599 {
+    return nil, fmt.Errorf("invalid denial status %d", status)
+  }
+
+  resp := &DenialResponse{status: status, templates: make(map[string]renderer)}
+  for mediaType, text := range templates {
+    var (
+      tmpl renderer
+      err  error
+    )
+    if mediaType == mediaHTML {
+      tmpl, err = htmltemplate.New(mediaType).Funcs(htmltemplate.FuncMap(templateFuncs)).Parse(text)
+    } else {
+      tmpl, err = template.New(mediaType).Funcs(templateFuncs).Parse(text)
+    }
+    if err != nil {
+      return nil, fmt.Errorf("invalid %s denial template: %w", mediaType, err)
+    }
+    resp.templates[mediaType] = tmpl
+  }
+  return resp, nil
+}
+
+// CustomDenialResponse creates a denial response written by a handler
+func CustomDenialResponse(handler DenialHandler) *DenialResponse {
+  return &DenialResponse{status: http.StatusTooManyRequests, handler: handler}
+}
+
+// LoadDenialResponses reads the denial responses of each rule from a JSON
+// file, the "default" entry applies to rules without their own
+func LoadDenialResponses(path string) (DenialResponses, error) {
+  data, err := os.ReadFile(path)
+  if err != nil {
+    return nil, fmt.Errorf("failed to read denial responses: %w", err)
+  }
+
+  var specs map[string]denialSpec
+  if err := json.Unmarshal(data, &specs); err != nil {
+    return nil, fmt.Errorf("failed to parse denial responses: %w", err)
+  }
+
+  denials := make(DenialResponses)
+  for rule, spec := range specs {
+    resp, err := NewDenialResponse(spec.Status, spec.Templates)
+    if err != nil {
+      return nil, fmt.Errorf("rule %s: %w", rule, err)
+    }
+    if rule == "default" {
+      rule = ""
+    }
+    denials[rule] = resp
+  }
+  return denials, nil
+}
+
+// WithDenialResponse answers requests denied by the named rule with the
+// given response, the empty name applies to every rule without its own
+func WithDenialResponse(rule string, resp *DenialResponse) Option {
+  return func(m *RateLimiterMiddleware) {
+    if m.denials == nil {
+      m.denials = make(DenialResponses)
+    }
+    m.denials[rule] = resp
+  }
+}
+
+// WithDenialResponses answers denied requests with the response of the
+// denying rule
+func WithDenialResponses(denials DenialResponses) Option {
+  return func(m *RateLimiterMiddleware) {
+    for rule, resp := range denials {
+      WithDenialResponse(rule, resp)(m)
+    }
+  }
+}
+
+// WriteDenial writes the body of a denied request, negotiating its media type
+// with the Accept header of the request
+func (m *RateLimiterMiddleware) WriteDenial(w http.ResponseWriter, r *http.Request, result interfaces.Result) {
+  m.denials.write(w, r, result)
+}
+
+// write answers a denied request with the response of the denying rule
+func (d DenialResponses) write(w http.ResponseWriter, r *http.Request, result interfaces.Result) {
+  resp := d[result.Rule]
+  if resp == nil {
+    resp = d[""]
+  }
+  if resp == nil {
+    resp = &DenialResponse{status: http.StatusTooManyRequests}
+  }
+
+  if resp.handler != nil {
+    resp.handler(w, r, result)
+    return
+  }
+
+  data := DenialData{
+    Rule:       result.Rule,
+    Status:     resp.status,
+    Title:      http.StatusText(resp.status),
+    Limit:      result.Limit,
+    Remaining:  result.Remaining,
+    RetryAfter: seconds(result.RetryAfter),
+    Reset:      seconds(result.Reset),
+  }
+
+  mediaType := negotiate(r.Header.Get("Accept"), denialMediaTypes)
+  tmpl, ok := resp.templates[mediaType]
+  if !ok {
+    tmpl = defaultTemplates[mediaType]
+  }
+
+  var body bytes.Buffer
+  if err := tmpl.Execute(&body, data); err != nil {
+    log.Printf("Error rendering %s denial for rule %s: %v", mediaType, result.Rule, err)
+    mediaType = mediaJSON
+    body.Reset()
+    defaultTemplates[mediaJSON].Execute(&body, data)
+  }
+
+  contentType := mediaType
+  if strings.HasPrefix(mediaType, "text/") {
+    contentType += "; charset=utf-8"
+  }
+  w.Header().Set("Content-Type", contentType)
+  w.WriteHeader(resp.status)
+  w.Write(body.Bytes())
+}
+
+// jsonBody renders the built-in JSON body
+type jsonBody struct{}
+
+// Execute encodes the rate limit exceeded body
+func (jsonBody) Execute(w io.Writer, data any) error {
+  return json.NewEncoder(w).Encode(RateLimitExceededBody())
+}
+
+// negotiate picks the offered media type the Accept header prefers, falling
+// back to the first offer when nothing matches
+func negotiate(accept string, offers []string) string {
+  if accept == "" {
+    return offers[0]
+  }
+
+  best, bestQ, bestSpecificity := offers[0], 0.0, -1
+  for _, part := range strings.Split(accept, ",") {
+    mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+    if err != nil {
+      continue
+    }
+    q := 1.0
+    if value, ok := params["q"]; ok {
+      if q, err = strconv.ParseFloat(value, 64); err != nil {
+        continue
+      }
+    }
+    if q <= 0 {
+      continue
+    }
+
+    for _, offer := range offers {
+      specificity := mediaSpecificity(mediaType, offer)
+      if specificity < 0 {
+        continue
+      }
+      // Higher quality wins, then the more specific range
+      if q > bestQ || (q == bestQ && specificity > bestSpecificity) {
+        best, bestQ, bestSpecificity = offer, q, specificity
+      }
+      // Offers are in order of preference, only the first match of a
+      // range counts
+      break
+    }
+  }
+  return best
+}
+
+// mediaSpecificity reports how specifically a media range matches a media
+// type: 2 for an exact match, 1 for type/*, 0 for */* and -1 for no match
+func mediaSpecificity(mediaRange, mediaType string) int {
+  switch {
+  case mediaRange == mediaType:
+    return 2
+  case mediaRange == "*/*":
+    return 0
+  case strings.HasSuffix(mediaRange, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(mediaRange, "*")):
+    return 1
+  }
+  return -1
+}
@@ -0,0 +1,95 @@
+package middleware
+
+import (
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+  "time"
+
+  "rate-limiter/interfaces"
+)
+
+// TestDenialNegotiation tests that the denial body follows the Accept header
+func TestDenialNegotiation(t *testing.T) {
+  tests := []struct {
+    accept      string
+    contentType string
+    contains    string
+  }{
+    {accept: "", contentType: "application/json", contains: `"error":"Rate limit exceeded"`},
+    {accept: "application/problem+json", contentType: "application/problem+json", contains: `"status":429`},
+    {accept: "text/html,application/xhtml+xml,*/*;q=0.8", contentType: "text/html; charset=utf-8", contains: "<h1>Too Many Requests</h1>"},
+    {accept: "text/*", contentType: "text/plain; charset=utf-8", contains: "Retry in 30 seconds"},
+    {accept: "application/json;q=0.5, text/plain", contentType: "text/plain; charset=utf-8", contains: "Rate limit exceeded"},
+    {accept: "image/png", contentType: "application/json", contains: `"error"`},
+  }
+
+  mockLimiter := &MockRateLimiter{result: interfaces.Result{Rule: "ip", Limit: 10, RetryAfter: 30 * time.Second}}
+  handler := NewRateLimiterMiddleware(mockLimiter).Middleware(http.NotFoundHandler())
+
+  for _, tt := range tests {
+    req := httptest.NewRequest("GET", "/test", nil)
+    req.Header.Set("Accept", tt.accept)
+    rr := httptest.NewRecorder()
+    handler.ServeHTTP(rr, req)
+
+    if rr.Code != http.StatusTooManyRequests {
+      t.Errorf("Accept %q: expected status 429, got %d", tt.accept, rr.Code)
+    }
+    if got := rr.Header().Get("Content-Type"); got != tt.contentType {
+      t.Errorf("Accept %q: expected content type %q, got %q", tt.accept, tt.contentType, got)
+    }
+    if !strings.Contains(rr.Body.String(), tt.contains) {
+      t.Errorf("Accept %q: expected body to contain %q, got %q", tt.accept, tt.contains, rr.Body.String())
+    }
+  }
+}
+
+// TestDenialPerRule tests templates, statuses and handlers configured per rule
+func TestDenialPerRule(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "denials.json")
+  os.WriteFile(path, []byte(`{
+    "default": {"status": 503, "templates": {"text/plain": "busy, {{.Remaining}} of {{.Limit}} left"}},
+    "token": {"templates": {"text/html": "<p>{{.Rule}} {{.RetryAfter}}</p>"}}
+  }`), 0o644)
+
+  denials, err := LoadDenialResponses(path)
+  if err != nil {
+    t.Fatalf("Unexpected error: %v", err)
+  }
+  custom := CustomDenialResponse(func(w http.ResponseWriter, r *http.Request, result interfaces.Result) {
+    w.WriteHeader(http.StatusTeapot)
+  })
+
+  serve := func(rule, accept string, opts ...Option) *httptest.ResponseRecorder {
+    mockLimiter := &MockRateLimiter{result: interfaces.Result{Rule: rule, Limit: 10, RetryAfter: 2 * time.Second}}
+    handler := NewRateLimiterMiddleware(mockLimiter, append([]Option{WithDenialResponses(denials)}, opts...)...).Middleware(http.NotFoundHandler())
+    req := httptest.NewRequest("GET", "/test", nil)
+    req.Header.Set("Accept", accept)
+    rr := httptest.NewRecorder()
+    handler.ServeHTTP(rr, req)
+    return rr
+  }
+
+  rr := serve("ip", "text/plain")
+  if rr.Code != http.StatusServiceUnavailable || rr.Body.String() != "busy, 0 of 10 left" {
+    t.Errorf("Expected the default template, got %d %q", rr.Code, rr.Body.String())
+  }
+
+  rr = serve("token", "text/html")
+  if rr.Code != http.StatusTooManyRequests || rr.Body.String() != "<p>token 2</p>" {
+    t.Errorf("Expected the token template, got %d %q", rr.Code, rr.Body.String())
+  }
+
+  rr = serve("ip", "text/plain", WithDenialResponse("ip", custom))
+  if rr.Code != http.StatusTeapot {
+    t.Errorf("Expected the custom handler, got %d", rr.Code)
+  }
+
+  if _, err := NewDenialResponse(200, nil); err == nil {
+    t.Error("Expected a non-error status to be rejected")
+  }
+}
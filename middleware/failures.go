@@ -0,0 +1,198 @@
+package middleware
+
+import (
+  "bytes"
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+  "io"
+  "log"
+  "mime"
+  "net/http"
+  "net/url"
+  "strings"
+
+  "rate-limiter/interfaces"
+)
+
+// maxCredentialsBody bounds how much of a request body is read to find the
+// username
+const maxCredentialsBody = 1 << 20
+
+// FailureOption configures a FailureMiddleware
+type FailureOption func(m *FailureMiddleware)
+
+// FailureMiddleware limits failed attempts on endpoints such as login or OTP
+// verification, keyed by client IP and submitted username. Every attempt is
+// reserved as a failure before it is made and given back unless its response
+// matches the failure statuses, and a key that reaches the limit is locked
+// out.
+type FailureMiddleware struct {
+  limiter        interfaces.FailureLimiter
+  paths          []string
+  statuses       []string
+  usernameField  string
+  resetOnSuccess bool
+  denials        DenialResponses
+  trusted        TrustedProxies
+}
+
+// NewFailureMiddleware creates a failure middleware counting 401 and 403
+// responses against the "username" field
+func NewFailureMiddleware(limiter interfaces.FailureLimiter, opts ...FailureOption) *FailureMiddleware {
+  m := &FailureMiddleware{
+    limiter:       limiter,
+    statuses:      []string{"401", "403"},
+    usernameField: "username",
+  }
+  for _, opt := range opts {
+    opt(m)
+  }
+  return m
+}
+
+// WithFailurePaths only guards requests whose path starts with one of the
+// prefixes, by default every request is guarded
+func WithFailurePaths(prefixes ...string) FailureOption {
+  return func(m *FailureMiddleware) {
+    m.paths = prefixes
+  }
+}
+
+// WithFailureStatuses sets the response statuses counted as failures, either
+// exact codes such as "401" or classes such as "4xx"
+func WithFailureStatuses(patterns ...string) FailureOption {
+  return func(m *FailureMiddleware) {
+    m.statuses = patterns
+  }
+}
+
+// WithUsernameField reads the username from the given form or JSON field
+func WithUsernameField(field string) FailureOption {
+  return func(m *FailureMiddleware) {
+    m.usernameField = field
+  }
+}
+
+// WithResetOnSuccess forgets the failures of a key after a successful attempt
+func WithResetOnSuccess() FailureOption {
+  return func(m *FailureMiddleware) {
+    m.resetOnSuccess = true
+  }
+}
+
+// WithFailureTrustedProxies reads the client IP from X-Forwarded-For only on
+// requests sent by the given proxies
+func WithFailureTrustedProxies(proxies TrustedProxies) FailureOption {
+  return func(m *FailureMiddleware) {
+    m.trusted = proxies
+  }
+}
+
+// WithFailureDenialResponses answers locked out requests with the response
+// of the failure rule
+func WithFailureDenialResponses(denials DenialResponses) FailureOption {
+  return func(m *FailureMiddleware) {
+    m.denials = denials
+  }
+}
+
+// Middleware returns a handler function that limits failed attempts
+func (m *FailureMiddleware) Middleware(next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if !m.guards(r) {
+      next.ServeHTTP(w, r)
+      return
+    }
+
+    ctx := r.Context()
+    // Clients could rotate X-Forwarded-For to never get locked out
+    key := failureKey(trustedClientIP(r, m.trusted), m.username(r))
+
+    // Reserving the attempt up front keeps parallel attempts from all getting
+    // past the limit
+    result, err := m.limiter.ReserveAttempt(ctx, key)
+    if err != nil {
+      http.Error(w, "Internal server error", http.StatusInternalServerError)
+      return
+    }
+    if !result.Allowed {
+      admission := &Admission{Result: result}
+      for name, values := range admission.Headers() {
+        w.Header()[name] = values
+      }
+      m.denials.write(w, r, result)
+      return
+    }
+
+    rec := &responseRecorder{ResponseWriter: w}
+    next.ServeHTTP(rec, r)
+
+    // Handlers that write nothing answer with 200
+    status := rec.status
+    if !rec.wroteHeader {
+      status = http.StatusOK
+    }
+
+    failed := matchStatus(m.statuses, status)
+    if _, err := m.limiter.SettleAttempt(ctx, key, failed); err != nil {
+      log.Printf("Error recording attempt: %v", err)
+    }
+    if !failed && m.resetOnSuccess && status < 400 {
+      if err := m.limiter.ResetFailures(ctx, key); err != nil {
+        log.Printf("Error recording attempt: %v", err)
+      }
+    }
+  })
+}
+
+// guards reports whether a request is subject to the failure limit
+func (m *FailureMiddleware) guards(r *http.Request) bool {
+  if len(m.paths) == 0 {
+    return true
+  }
+  for _, prefix := range m.paths {
+    if strings.HasPrefix(r.URL.Path, prefix) {
+      return true
+    }
+  }
+  return false
+}
+
+// failureKey builds the key of an attempt from the client IP and a digest of
+// the username, so keys stay short whatever the client submits
+func failureKey(ip, username string) string {
+  sum := sha256.Sum256([]byte(username))
+  return ip + ":" + hex.EncodeToString(sum[:16])
+}
+
+// username reads the submitted username from a form or JSON body, leaving the
+// body intact for the handler
+func (m *FailureMiddleware) username(r *http.Request) string {
+  if r.Body == nil {
+    return ""
+  }
+
+  body, err := io.ReadAll(io.LimitReader(r.Body, maxCredentialsBody))
+  r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+  if err != nil {
+    return ""
+  }
+
+  var username string
+  mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+  switch {
+  case mediaType == "application/x-www-form-urlencoded":
+    if values, err := url.ParseQuery(string(body)); err == nil {
+      username = values.Get(m.usernameField)
+    }
+  case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+    var fields map[string]any
+    if err := json.Unmarshal(body, &fields); err == nil {
+      username, _ = fields[m.usernameField].(string)
+    }
+  }
+
+  // Usernames are usually case insensitive, so are the keys
+  return strings.ToLower(strings.TrimSpace(username))
+}
@@ -0,0 +1,213 @@
+package middleware
+
+import (
+  "context"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "testing"
+
+  "rate-limiter/interfaces"
+)
+
+// MockFailureLimiter locks keys out after a number of failures
+type MockFailureLimiter struct {
+  mu       sync.Mutex
+  limit    int
+  failures map[string]int
+}
+
+// Locked mocks the lockout check
+func (m *MockFailureLimiter) Locked(ctx context.Context, key string) (interfaces.Result, error) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  return interfaces.Result{Allowed: m.failures[key] < m.limit}, nil
+}
+
+// RecordFailure mocks counting a failure
+func (m *MockFailureLimiter) RecordFailure(ctx context.Context, key string) (interfaces.Result, error) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  m.failures[key]++
+  return interfaces.Result{Allowed: m.failures[key] < m.limit}, nil
+}
+
+// ReserveAttempt mocks counting an attempt as failed while below the limit
+func (m *MockFailureLimiter) ReserveAttempt(ctx context.Context, key string) (interfaces.Result, error) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  if m.failures[key] >= m.limit {
+    return interfaces.Result{}, nil
+  }
+  m.failures[key]++
+  return interfaces.Result{Allowed: true}, nil
+}
+
+// SettleAttempt mocks giving back attempts that did not fail
+func (m *MockFailureLimiter) SettleAttempt(ctx context.Context, key string, failed bool) (interfaces.Result, error) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  if !failed {
+    m.failures[key]--
+  }
+  return interfaces.Result{Allowed: m.failures[key] < m.limit}, nil
+}
+
+// ResetFailures mocks forgetting the failures
+func (m *MockFailureLimiter) ResetFailures(ctx context.Context, key string) error {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  delete(m.failures, key)
+  return nil
+}
+
+// TestFailureMiddleware tests that only failed logins count towards the lockout
+func TestFailureMiddleware(t *testing.T) {
+  mockLimiter := &MockFailureLimiter{limit: 2, failures: make(map[string]int)}
+  m := NewFailureMiddleware(mockLimiter, WithFailurePaths("/login"), WithResetOnSuccess())
+
+  handler := m.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if r.FormValue("password") != "secret" {
+      w.WriteHeader(http.StatusUnauthorized)
+      return
+    }
+    w.WriteHeader(http.StatusOK)
+  }))
+
+  login := func(username, password string) int {
+    body := strings.NewReader("username=" + username + "&password=" + password)
+    req := httptest.NewRequest("POST", "/login", body)
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    req.RemoteAddr = "192.168.1.1:12345"
+    rr := httptest.NewRecorder()
+    handler.ServeHTTP(rr, req)
+    return rr.Code
+  }
+
+  // The handler still sees the submitted form
+  if status := login("alice", "secret"); status != http.StatusOK {
+    t.Fatalf("Expected status 200, got %d", status)
+  }
+
+  // A success resets the failures
+  login("alice", "wrong")
+  login("alice", "secret")
+  if mockLimiter.failures[failureKey("192.168.1.1", "alice")] != 0 {
+    t.Errorf("Expected the failures to be reset, got %d", mockLimiter.failures[failureKey("192.168.1.1", "alice")])
+  }
+
+  // Repeated failures lock the username out from this IP
+  login("Alice", "wrong")
+  login("alice", "wrong")
+  if status := login("alice", "secret"); status != http.StatusTooManyRequests {
+    t.Errorf("Expected status 429, got %d", status)
+  }
+
+  // Other usernames are not affected
+  if status := login("bob", "secret"); status != http.StatusOK {
+    t.Errorf("Expected status 200, got %d", status)
+  }
+}
+
+// TestFailureMiddlewareJSON tests reading the username from a JSON body
+func TestFailureMiddlewareJSON(t *testing.T) {
+  mockLimiter := &MockFailureLimiter{limit: 5, failures: make(map[string]int)}
+  m := NewFailureMiddleware(mockLimiter, WithUsernameField("email"))
+
+  handler := m.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    w.WriteHeader(http.StatusForbidden)
+  }))
+
+  req := httptest.NewRequest("POST", "/otp", strings.NewReader(`{"email": "bob@example.com", "code": "123"}`))
+  req.Header.Set("Content-Type", "application/json")
+  req.RemoteAddr = "192.168.1.1:12345"
+  handler.ServeHTTP(httptest.NewRecorder(), req)
+
+  if mockLimiter.failures[failureKey("192.168.1.1", "bob@example.com")] != 1 {
+    t.Errorf("Expected one failure for the submitted email, got %v", mockLimiter.failures)
+  }
+}
+
+// TestFailureMiddlewareParallel tests that parallel attempts cannot all get past the limit
+func TestFailureMiddlewareParallel(t *testing.T) {
+  mockLimiter := &MockFailureLimiter{limit: 2, failures: make(map[string]int)}
+  m := NewFailureMiddleware(mockLimiter)
+
+  release := make(chan struct{})
+  var handled int32
+  handler := m.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    atomic.AddInt32(&handled, 1)
+    <-release
+    w.WriteHeader(http.StatusUnauthorized)
+  }))
+
+  // Attempts held by the handler keep their reservation, so the rest are denied
+  denied := make(chan int, 5)
+  var wg sync.WaitGroup
+  for i := 0; i < 5; i++ {
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      req := httptest.NewRequest("POST", "/login", strings.NewReader("username=alice"))
+      req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+      req.RemoteAddr = "192.168.1.1:12345"
+      rr := httptest.NewRecorder()
+      handler.ServeHTTP(rr, req)
+      if rr.Code == http.StatusTooManyRequests {
+        denied <- rr.Code
+      }
+    }()
+  }
+  for i := 0; i < 3; i++ {
+    <-denied
+  }
+  close(release)
+  wg.Wait()
+
+  if handled != 2 {
+    t.Errorf("Expected 2 attempts to reach the handler, got %d", handled)
+  }
+  if mockLimiter.failures[failureKey("192.168.1.1", "alice")] != 2 {
+    t.Errorf("Expected 2 failures, got %d", mockLimiter.failures[failureKey("192.168.1.1", "alice")])
+  }
+}
+
+// TestFailureMiddlewareForwardedFor tests that X-Forwarded-For only changes the
+// key when a trusted proxy sends it
+func TestFailureMiddlewareForwardedFor(t *testing.T) {
+  mockLimiter := &MockFailureLimiter{limit: 2, failures: make(map[string]int)}
+  trusted, _ := ParseTrustedProxies([]string{"10.0.0.1"})
+  m := NewFailureMiddleware(mockLimiter, WithFailureTrustedProxies(trusted))
+
+  handler := m.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    w.WriteHeader(http.StatusUnauthorized)
+  }))
+
+  login := func(remoteAddr, forwardedFor string) int {
+    req := httptest.NewRequest("POST", "/login", strings.NewReader("username=alice"))
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    req.Header.Set("X-Forwarded-For", forwardedFor)
+    req.RemoteAddr = remoteAddr
+    rr := httptest.NewRecorder()
+    handler.ServeHTTP(rr, req)
+    return rr.Code
+  }
+
+  // Rotating the header from an untrusted peer still locks its key
+  login("192.168.1.1:12345", "203.0.113.1")
+  login("192.168.1.1:12345", "203.0.113.2")
+  if status := login("192.168.1.1:12345", "203.0.113.3"); status != http.StatusTooManyRequests {
+    t.Errorf("Expected status 429, got %d", status)
+  }
+  if mockLimiter.failures[failureKey("192.168.1.1", "alice")] != 2 {
+    t.Errorf("Expected the failures on the peer address, got %v", mockLimiter.failures)
+  }
+
+  // Trusted proxies forward the client IP
+  login("10.0.0.1:12345", "203.0.113.1")
+  if mockLimiter.failures[failureKey("203.0.113.1", "alice")] != 1 {
+    t.Errorf("Expected a failure for the forwarded client, got %v", mockLimiter.failures)
+  }
+}
@@ -0,0 +1,98 @@
+package middleware
+
+import (
+  "encoding/json"
+  "fmt"
+  "net/http"
+  "os"
+  "strings"
+  "time"
+
+  "rate-limiter/interfaces"
+)
+
+// levelSpec is the JSON form of a level in a hierarchy file
+type levelSpec struct {
+  Name       string   `json:"name"`
+  Source     string   `json:"source"`
+  Routes     []string `json:"routes"`
+  Limit      int      `json:"limit"`
+  Expiration int      `json:"expiration"`
+}
+
+// LoadHierarchy reads a chain of limits from a JSON file, ordered from the
+// narrowest level to the widest. The source of each level picks the value
+// requests are counted by: "token", "ip", "client" (the token, or the IP
+// without one), "header:<Name>", "route" (the first of its route prefixes
+// matching the path) or "global". Levels without a value for a request, such
+// as a token level on anonymous requests, are skipped.
+func LoadHierarchy(path string) (LevelsFunc, error) {
+  data, err := os.ReadFile(path)
+  if err != nil {
+    return nil, fmt.Errorf("failed to read hierarchy: %w", err)
+  }
+
+  var specs []levelSpec
+  if err := json.Unmarshal(data, &specs); err != nil {
+    return nil, fmt.Errorf("failed to parse hierarchy: %w", err)
+  }
+
+  for _, spec := range specs {
+    if spec.Name == "" || strings.Contains(spec.Name, ":") {
+      return nil, fmt.Errorf("invalid level name %q", spec.Name)
+    }
+    if spec.Limit <= 0 || spec.Expiration <= 0 {
+      return nil, fmt.Errorf("level %s: limit and expiration must be positive", spec.Name)
+    }
+    switch {
+    case spec.Source == "token", spec.Source == "ip", spec.Source == "client", spec.Source == "global":
+    case spec.Source == "route" && len(spec.Routes) > 0:
+    case strings.HasPrefix(spec.Source, "header:") && spec.Source != "header:":
+    default:
+      return nil, fmt.Errorf("level %s: invalid source %q", spec.Name, spec.Source)
+    }
+  }
+
+  return func(r *http.Request, ip, token string) []interfaces.Level {
+    levels := make([]interfaces.Level, 0, len(specs))
+    for _, spec := range specs {
+      dimension, value := spec.value(r, ip, token)
+      if value == "" {
+        continue
+      }
+      levels = append(levels, interfaces.Level{
+        Name:       spec.Name,
+        Dimension:  dimension,
+        Value:      value,
+        Limit:      spec.Limit,
+        Expiration: time.Duration(spec.Expiration) * time.Second,
+      })
+    }
+    return levels
+  }, nil
+}
+
+// value returns the dimension and value a request is counted by on the level
+func (spec levelSpec) value(r *http.Request, ip, token string) (string, string) {
+  switch spec.Source {
+  case "token":
+    return "token", token
+  case "ip":
+    return "ip", ip
+  case "client":
+    if token != "" {
+      return "token", token
+    }
+    return "ip", ip
+  case "route":
+    for _, route := range spec.Routes {
+      if strings.HasPrefix(r.URL.Path, route) {
+        return "route", route
+      }
+    }
+    return "route", ""
+  case "global":
+    return "global", "all"
+  }
+  return "header", r.Header.Get(strings.TrimPrefix(spec.Source, "header:"))
+}
@@ -0,0 +1,129 @@
+package middleware
+
+import (
+  "context"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "path/filepath"
+  "testing"
+  "time"
+
+  "rate-limiter/interfaces"
+)
+
+// MockHierarchy denies requests at a fixed level and records the checked levels
+type MockHierarchy struct {
+  deny     string
+  levels   []interfaces.Level
+  refunded int
+}
+
+// CheckLevels mocks the hierarchical check
+func (m *MockHierarchy) CheckLevels(ctx context.Context, levels []interfaces.Level, cost int) (interfaces.Result, error) {
+  m.levels = levels
+  if m.deny != "" {
+    return interfaces.Result{Rule: m.deny, Limit: 10, OverLimit: true, RetryAfter: time.Minute}, nil
+  }
+  return interfaces.Result{Allowed: true, Rule: levels[0].Name, Limit: 10, Remaining: 9}, nil
+}
+
+// RefundLevels mocks the hierarchical refund
+func (m *MockHierarchy) RefundLevels(ctx context.Context, levels []interfaces.Level, cost int) error {
+  m.refunded += cost
+  return nil
+}
+
+// TestLoadHierarchy tests the levels built from a hierarchy file
+func TestLoadHierarchy(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "hierarchy.json")
+  os.WriteFile(path, []byte(`[
+    {"name": "user", "source": "client", "limit": 10, "expiration": 60},
+    {"name": "org", "source": "header:X-Org-ID", "limit": 100, "expiration": 60},
+    {"name": "bulk", "source": "route", "routes": ["/api/bulk"], "limit": 50, "expiration": 3600},
+    {"name": "global", "source": "global", "limit": 1000, "expiration": 60}
+  ]`), 0o600)
+
+  levelsFunc, err := LoadHierarchy(path)
+  if err != nil {
+    t.Fatalf("Unexpected error: %v", err)
+  }
+
+  req := httptest.NewRequest("GET", "/api/test", nil)
+  levels := levelsFunc(req, "192.168.1.1", "")
+  if len(levels) != 2 {
+    t.Fatalf("Expected the user and global levels, got %+v", levels)
+  }
+  if levels[0].Dimension != "ip" || levels[0].Value != "192.168.1.1" || levels[0].Expiration != time.Minute {
+    t.Errorf("Expected the user level to count the IP, got %+v", levels[0])
+  }
+
+  req = httptest.NewRequest("GET", "/api/bulk/import", nil)
+  req.Header.Set("X-Org-ID", "acme")
+  levels = levelsFunc(req, "192.168.1.1", "abc")
+  if len(levels) != 4 {
+    t.Fatalf("Expected every level, got %+v", levels)
+  }
+  if levels[0].Dimension != "token" || levels[0].Value != "abc" {
+    t.Errorf("Expected the user level to count the token, got %+v", levels[0])
+  }
+  if levels[1].Value != "acme" || levels[2].Value != "/api/bulk" {
+    t.Errorf("Expected the organization and route levels, got %+v", levels)
+  }
+
+  for _, invalid := range []string{
+    `[{"name": "user", "source": "cookie", "limit": 10, "expiration": 60}]`,
+    `[{"name": "a:b", "source": "ip", "limit": 10, "expiration": 60}]`,
+    `[{"name": "bulk", "source": "route", "limit": 10, "expiration": 60}]`,
+    `[{"name": "user", "source": "ip", "limit": 0, "expiration": 60}]`,
+  } {
+    os.WriteFile(path, []byte(invalid), 0o600)
+    if _, err := LoadHierarchy(path); err == nil {
+      t.Errorf("Expected an error for %s", invalid)
+    }
+  }
+}
+
+// TestMiddlewareHierarchy tests that denials report the denying level and
+// refunds go back to every level
+func TestMiddlewareHierarchy(t *testing.T) {
+  levels := func(r *http.Request, ip, token string) []interfaces.Level {
+    return []interfaces.Level{
+      {Name: "user", Dimension: "ip", Value: ip, Limit: 10, Expiration: time.Minute},
+      {Name: "org", Dimension: "header", Value: "acme", Limit: 100, Expiration: time.Minute},
+    }
+  }
+
+  hierarchy := &MockHierarchy{deny: "org"}
+  mockLimiter := &MockRateLimiter{allowIP: true, allowToken: true}
+  m := NewRateLimiterMiddleware(mockLimiter,
+    WithHierarchy(hierarchy, levels),
+    WithDenialResponse("org", &DenialResponse{status: http.StatusServiceUnavailable}),
+    WithRefunds(&MockRefunder{refunds: make(map[string]int)}, RefundOnStatus("5xx")),
+  )
+  handler := m.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    w.WriteHeader(http.StatusBadGateway)
+  }))
+
+  req := httptest.NewRequest("GET", "/test", nil)
+  req.RemoteAddr = "192.168.1.1:12345"
+  rr := httptest.NewRecorder()
+  handler.ServeHTTP(rr, req)
+
+  if rr.Code != http.StatusServiceUnavailable {
+    t.Errorf("Expected the organization denial status, got %d", rr.Code)
+  }
+  if len(hierarchy.levels) != 2 || hierarchy.levels[0].Value != "192.168.1.1" {
+    t.Errorf("Expected the request levels to be checked, got %+v", hierarchy.levels)
+  }
+  if mockLimiter.lastKey != "" {
+    t.Errorf("Expected the IP and token limits to be skipped, got %q", mockLimiter.lastKey)
+  }
+
+  hierarchy.deny = ""
+  rr = httptest.NewRecorder()
+  handler.ServeHTTP(rr, req)
+  if rr.Code != http.StatusBadGateway || hierarchy.refunded != 1 {
+    t.Errorf("Expected the failed request to be refunded, got %d and %d", rr.Code, hierarchy.refunded)
+  }
+}
@@ -1,10 +1,12 @@
 package middleware
 
 import (
-  "encoding/json"
+  "context"
   "net"
   "net/http"
+  "strconv"
   "strings"
+  "time"
 
   "rate-limiter/interfaces"
 )
@@ -12,57 +14,250 @@ import (
 const (
   // TokenHeader is the header name for API token
   TokenHeader = "API_KEY"
+
+  // DryRunHeader marks requests that exceeded a dry-run limit
+  DryRunHeader = "X-RateLimit-Dry-Run"
+
+  // LimitHeader reports the number of units allowed per window
+  LimitHeader = "RateLimit-Limit"
+
+  // RemainingHeader reports the number of units left in the window
+  RemainingHeader = "RateLimit-Remaining"
+
+  // ResetHeader reports the seconds until the window frees up
+  ResetHeader = "RateLimit-Reset"
+
+  // DefaultMaxCost caps the cost a cost header may set
+  DefaultMaxCost = 1000
 )
 
+// CostFunc returns the cost of a request, or zero to fall back to the
+// configured costs
+type CostFunc func(r *http.Request) int
+
+// LevelsFunc returns the chain of limits a request is checked against
+type LevelsFunc func(r *http.Request, ip, token string) []interfaces.Level
+
+// Option configures a RateLimiterMiddleware
+type Option func(m *RateLimiterMiddleware)
+
 // RateLimiterMiddleware is a middleware that limits request rates
 type RateLimiterMiddleware struct {
-  limiter interfaces.RateLimiter
+  limiter     interfaces.RateLimiter
+  concurrency interfaces.ConcurrencyLimiter
+  routeCosts  map[string]int
+  costHeader  string
+  maxCost     int
+  costFunc    CostFunc
+  trusted     TrustedProxies
+  queue       *waitQueue
+  refunder    interfaces.Refunder
+  refundFunc  RefundFunc
+  denials     DenialResponses
+  hierarchy   interfaces.HierarchicalLimiter
+  levelsFunc  LevelsFunc
+  load        interfaces.LoadObserver
+  capacity    interfaces.CapacityLimiter
+  priorities  *Priorities
+
+  checkDenyStatus int
 }
 
 // NewRateLimiterMiddleware creates a new rate limiter middleware
-func NewRateLimiterMiddleware(limiter interfaces.RateLimiter) *RateLimiterMiddleware {
-  return &RateLimiterMiddleware{
-    limiter: limiter,
+func NewRateLimiterMiddleware(limiter interfaces.RateLimiter, opts ...Option) *RateLimiterMiddleware {
+  m := &RateLimiterMiddleware{
+    limiter:         limiter,
+    maxCost:         DefaultMaxCost,
+    checkDenyStatus: http.StatusForbidden,
+  }
+  for _, opt := range opts {
+    opt(m)
+  }
+  return m
+}
+
+// WithConcurrencyLimiter limits the number of requests in flight at once
+func WithConcurrencyLimiter(limiter interfaces.ConcurrencyLimiter) Option {
+  return func(m *RateLimiterMiddleware) {
+    m.concurrency = limiter
+  }
+}
+
+// WithWaitMode holds over-limit requests until the limiter allows them, for at
+// most maxWait and with at most maxQueue requests waiting per key. The limiter
+// must only reject over-limit requests without charging them, as it does with
+// a MaxWait configured, or the first check blocks the key.
+func WithWaitMode(maxWait time.Duration, maxQueue int) Option {
+  return func(m *RateLimiterMiddleware) {
+    m.queue = newWaitQueue(maxWait, maxQueue)
+  }
+}
+
+// WithHierarchy checks every request against the chain of limits returned by
+// levels in a single decision, instead of the IP and token limits. The
+// ceiling and quotas of the limiter still apply.
+func WithHierarchy(limiter interfaces.HierarchicalLimiter, levels LevelsFunc) Option {
+  return func(m *RateLimiterMiddleware) {
+    m.hierarchy = limiter
+    m.levelsFunc = levels
+  }
+}
+
+// WithLoadObserver reports the latency of every allowed request and whether
+// it failed with a 5xx status, so adaptive limits can follow the backend
+func WithLoadObserver(observer interfaces.LoadObserver) Option {
+  return func(m *RateLimiterMiddleware) {
+    m.load = observer
+  }
+}
+
+// WithRouteCosts sets the cost of requests whose path starts with each prefix,
+// the longest matching prefix wins
+func WithRouteCosts(costs map[string]int) Option {
+  return func(m *RateLimiterMiddleware) {
+    m.routeCosts = costs
+  }
+}
+
+// WithCostHeader reads the cost of a request from the given header, only
+// honored from trusted proxies and only to raise the route cost
+func WithCostHeader(header string) Option {
+  return func(m *RateLimiterMiddleware) {
+    m.costHeader = header
+  }
+}
+
+// WithMaxCost caps the cost the cost header may set, DefaultMaxCost unless
+// set
+func WithMaxCost(cost int) Option {
+  return func(m *RateLimiterMiddleware) {
+    m.maxCost = cost
+  }
+}
+
+// WithCostFunc computes the cost of a request with a callback
+func WithCostFunc(fn CostFunc) Option {
+  return func(m *RateLimiterMiddleware) {
+    m.costFunc = fn
   }
 }
 
 // Middleware returns a handler function that implements rate limiting
 func (m *RateLimiterMiddleware) Middleware(next http.Handler) http.Handler {
   return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-    ctx := r.Context()
-
-    // Check if a token is provided
-    token := r.Header.Get(TokenHeader)
-    if token != "" {
-      // Token-based rate limiting takes precedence
-      allowed, err := m.limiter.CheckToken(ctx, token)
-      if err != nil {
-        http.Error(w, "Internal server error", http.StatusInternalServerError)
-        return
-      }
-      if !allowed {
-        sendRateLimitExceededResponse(w)
-        return
-      }
-    } else {
-      // IP-based rate limiting
-      ip := getClientIP(r)
-      allowed, err := m.limiter.CheckIP(ctx, ip)
-      if err != nil {
-        http.Error(w, "Internal server error", http.StatusInternalServerError)
-        return
-      }
-      if !allowed {
-        sendRateLimitExceededResponse(w)
-        return
-      }
+    admission, err := m.Admit(r, getClientIP(r), r.Header.Get(TokenHeader))
+    if err != nil {
+      http.Error(w, "Internal server error", http.StatusInternalServerError)
+      return
+    }
+    for name, values := range admission.Headers() {
+      w.Header()[name] = values
     }
+    if !admission.Allowed {
+      m.WriteDenial(w, r, admission.Result)
+      return
+    }
+    defer admission.Release()
 
     // If we get here, the request is allowed
-    next.ServeHTTP(w, r)
+    if m.refunder == nil && m.load == nil {
+      next.ServeHTTP(w, r)
+      return
+    }
+
+    // Watch the response to report the load and refund the request if it
+    // matches
+    rec := &responseRecorder{ResponseWriter: w}
+    next.ServeHTTP(rec, r)
+    admission.Finish(r.Context(), rec.status, rec.Header())
   })
 }
 
+// check runs the rate limit check for a request, after the global capacity of
+// its priority class when priorities are configured
+func (m *RateLimiterMiddleware) check(ctx context.Context, token, ip string, levels []interfaces.Level, class string, cost int) (interfaces.Result, error) {
+  if m.priorities != nil {
+    return m.checkPriority(ctx, class, cost, func() (interfaces.Result, error) {
+      return m.checkLimits(ctx, token, ip, levels, cost)
+    })
+  }
+  return m.checkLimits(ctx, token, ip, levels, cost)
+}
+
+// checkLimits runs the per-client check for a request, against its levels
+// when a hierarchy is configured
+func (m *RateLimiterMiddleware) checkLimits(ctx context.Context, token, ip string, levels []interfaces.Level, cost int) (interfaces.Result, error) {
+  if m.hierarchy != nil {
+    return m.hierarchy.CheckLevels(ctx, levels, cost)
+  }
+
+  // Check if a token is provided
+  if token != "" {
+    // Token-based rate limiting takes precedence
+    return m.limiter.CheckToken(ctx, token, cost)
+  }
+  // IP-based rate limiting
+  return m.limiter.CheckIP(ctx, ip, cost)
+}
+
+// requestLevels returns the chain of limits of a request, nil without a
+// hierarchy
+func (m *RateLimiterMiddleware) requestLevels(r *http.Request, ip, token string) []interfaces.Level {
+  if m.hierarchy == nil {
+    return nil
+  }
+  return m.levelsFunc(r, ip, token)
+}
+
+// requestClass returns the priority class of a request, empty without
+// priorities
+func (m *RateLimiterMiddleware) requestClass(r *http.Request, token string) string {
+  if m.priorities == nil {
+    return ""
+  }
+  return m.priorities.Classify(r, token, m.trusted)
+}
+
+// requestCost returns the number of units a request consumes, preferring the
+// cost callback, otherwise the route cost which the cost header of a trusted
+// proxy may raise up to the maximum cost
+func (m *RateLimiterMiddleware) requestCost(r *http.Request) int {
+  if m.costFunc != nil {
+    if cost := m.costFunc(r); cost > 0 {
+      return cost
+    }
+  }
+
+  cost, longest := 1, -1
+  for prefix, prefixCost := range m.routeCosts {
+    if strings.HasPrefix(r.URL.Path, prefix) && len(prefix) > longest {
+      cost, longest = prefixCost, len(prefix)
+    }
+  }
+
+  // Clients could lower their cost or drain others' budgets with the header
+  if m.costHeader == "" || !m.trusted.Trusted(r) {
+    return cost
+  }
+  if header, err := strconv.Atoi(r.Header.Get(m.costHeader)); err == nil && header > cost {
+    if m.maxCost > 0 && header > m.maxCost {
+      header = m.maxCost
+    }
+    if header > cost {
+      cost = header
+    }
+  }
+  return cost
+}
+
+// Helper function to get the key requests wait on in the queue
+func queueKey(token, ip string) string {
+  if token != "" {
+    return "token:" + token
+  }
+  return "ip:" + ip
+}
+
 // Helper function to get the client's IP address
 func getClientIP(r *http.Request) string {
   // Check for X-Forwarded-For header
@@ -84,15 +279,7 @@ func getClientIP(r *http.Request) string {
   return ip
 }
 
-// Helper function to send a rate limit exceeded response
-func sendRateLimitExceededResponse(w http.ResponseWriter) {
-  w.Header().Set("Content-Type", "application/json")
-  w.WriteHeader(http.StatusTooManyRequests) // 429 Too Many Requests
-
-  response := map[string]string{
-    "error":   "Rate limit exceeded",
-    "message": "you have reached the maximum number of requests or actions allowed within a certain time frame",
-  }
-
-  json.NewEncoder(w).Encode(response)
+// Helper function to round a duration up to whole seconds
+func seconds(d time.Duration) int {
+  return int((d + time.Second - 1) / time.Second)
 }
@@ -5,6 +5,7 @@ import (
   "net/http"
   "net/http/httptest"
   "testing"
+  "time"
 
   "rate-limiter/interfaces"
 )
@@ -13,20 +14,30 @@ import (
 type MockRateLimiter struct {
   allowIP    bool
   allowToken bool
+  overLimit  bool
   err        error
+  lastCost   int
+  lastKey    string
+  result     interfaces.Result
 }
 
 // Garantir que MockRateLimiter implementa a interface interfaces.RateLimiter
 var _ interfaces.RateLimiter = (*MockRateLimiter)(nil)
 
 // CheckIP mocks the IP check
-func (m *MockRateLimiter) CheckIP(ctx context.Context, ip string) (bool, error) {
-  return m.allowIP, m.err
+func (m *MockRateLimiter) CheckIP(ctx context.Context, ip string, cost int) (interfaces.Result, error) {
+  m.lastCost, m.lastKey = cost, ip
+  result := m.result
+  result.Allowed, result.OverLimit = m.allowIP, m.overLimit
+  return result, m.err
 }
 
 // CheckToken mocks the token check
-func (m *MockRateLimiter) CheckToken(ctx context.Context, token string) (bool, error) {
-  return m.allowToken, m.err
+func (m *MockRateLimiter) CheckToken(ctx context.Context, token string, cost int) (interfaces.Result, error) {
+  m.lastCost, m.lastKey = cost, token
+  result := m.result
+  result.Allowed, result.OverLimit = m.allowToken, m.overLimit
+  return result, m.err
 }
 
 // Close mocks the close method
@@ -157,3 +168,326 @@ func TestMiddlewareTokenBlocked(t *testing.T) {
     t.Errorf("Handler returned wrong status code: got %v want %v", status, http.StatusTooManyRequests)
   }
 }
+
+// TestMiddlewareDryRun tests that requests over a dry-run limit pass through marked
+func TestMiddlewareDryRun(t *testing.T) {
+  // Create a mock rate limiter that reports an over-limit request it still allows
+  mockLimiter := &MockRateLimiter{
+    allowIP:   true,
+    overLimit: true,
+  }
+
+  middleware := NewRateLimiterMiddleware(mockLimiter)
+
+  handlerCalled := false
+  testHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    handlerCalled = true
+    w.WriteHeader(http.StatusOK)
+  })
+
+  req := httptest.NewRequest("GET", "/test", nil)
+  req.RemoteAddr = "192.168.1.1:12345"
+  rr := httptest.NewRecorder()
+
+  middleware.Middleware(testHandler).ServeHTTP(rr, req)
+
+  if !handlerCalled {
+    t.Error("Handler should be called in dry-run mode")
+  }
+  if status := rr.Code; status != http.StatusOK {
+    t.Errorf("Handler returned wrong status code: got %v want %v", status, http.StatusOK)
+  }
+  if header := rr.Header().Get(DryRunHeader); header != "over-limit" {
+    t.Errorf("Expected %s header to be set, got %q", DryRunHeader, header)
+  }
+}
+
+// TestTrustedProxies tests that only requests sent by trusted proxies are trusted
+func TestTrustedProxies(t *testing.T) {
+  trusted, err := ParseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.7", "::1"})
+  if err != nil {
+    t.Fatalf("Unexpected error: %v", err)
+  }
+
+  tests := []struct {
+    remoteAddr string
+    want       bool
+  }{
+    {"10.1.2.3:5000", true},
+    {"192.0.2.7:5000", true},
+    {"192.0.2.8:5000", false},
+    {"[::1]:5000", true},
+    {"invalid", false},
+  }
+  for _, tt := range tests {
+    req := httptest.NewRequest("GET", "/", nil)
+    req.RemoteAddr = tt.remoteAddr
+    // Forwarding headers must not make a client trusted
+    req.Header.Set("X-Forwarded-For", "10.0.0.1")
+    if got := trusted.Trusted(req); got != tt.want {
+      t.Errorf("Trusted(%s) = %v, want %v", tt.remoteAddr, got, tt.want)
+    }
+  }
+
+  if _, err := ParseTrustedProxies([]string{"not-an-ip"}); err == nil {
+    t.Error("Expected an invalid proxy to be rejected")
+  }
+}
+
+// TestMiddlewareRequestCost tests how the cost of a request is resolved
+func TestMiddlewareRequestCost(t *testing.T) {
+  // httptest requests come from 192.0.2.1
+  trusted, err := ParseTrustedProxies([]string{"192.0.2.0/24"})
+  if err != nil {
+    t.Fatalf("Unexpected error: %v", err)
+  }
+
+  tests := []struct {
+    name   string
+    opts   []Option
+    path   string
+    header string
+    want   int
+  }{
+    {name: "default", path: "/api/test", want: 1},
+    {name: "route", opts: []Option{WithRouteCosts(map[string]int{"/api": 5, "/api/bulk": 100})}, path: "/api/bulk/items", want: 100},
+    {name: "header", opts: []Option{WithCostHeader("X-Cost"), WithTrustedProxies(trusted)}, path: "/api/test", header: "7", want: 7},
+    {name: "untrusted header", opts: []Option{WithCostHeader("X-Cost")}, path: "/api/test", header: "7", want: 1},
+    {name: "invalid header", opts: []Option{WithCostHeader("X-Cost"), WithTrustedProxies(trusted)}, path: "/api/test", header: "-3", want: 1},
+    {
+      name: "header below route",
+      opts: []Option{WithRouteCosts(map[string]int{"/api/bulk": 100}), WithCostHeader("X-Cost"), WithTrustedProxies(trusted)},
+      path: "/api/bulk", header: "1", want: 100,
+    },
+    {
+      name: "header over maximum",
+      opts: []Option{WithCostHeader("X-Cost"), WithMaxCost(50), WithTrustedProxies(trusted)},
+      path: "/api/test", header: "1000000", want: 50,
+    },
+    {
+      name: "callback",
+      opts: []Option{WithCostHeader("X-Cost"), WithTrustedProxies(trusted), WithCostFunc(func(r *http.Request) int { return 42 })},
+      path: "/api/test", header: "7", want: 42,
+    },
+  }
+
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      mockLimiter := &MockRateLimiter{allowIP: true}
+      middleware := NewRateLimiterMiddleware(mockLimiter, tt.opts...)
+
+      req := httptest.NewRequest("GET", tt.path, nil)
+      if tt.header != "" {
+        req.Header.Set("X-Cost", tt.header)
+      }
+      rr := httptest.NewRecorder()
+
+      middleware.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(rr, req)
+
+      if mockLimiter.lastCost != tt.want {
+        t.Errorf("Request cost = %d, want %d", mockLimiter.lastCost, tt.want)
+      }
+    })
+  }
+}
+
+// MockConcurrencyLimiter is a mock implementation of the interfaces.ConcurrencyLimiter interface
+type MockConcurrencyLimiter struct {
+  allow    bool
+  released int
+}
+
+// AcquireIP mocks acquiring a slot for an IP
+func (m *MockConcurrencyLimiter) AcquireIP(ctx context.Context, ip string) (func(), bool, error) {
+  if !m.allow {
+    return nil, false, nil
+  }
+  return func() { m.released++ }, true, nil
+}
+
+// AcquireToken mocks acquiring a slot for a token
+func (m *MockConcurrencyLimiter) AcquireToken(ctx context.Context, token string) (func(), bool, error) {
+  return m.AcquireIP(ctx, token)
+}
+
+// TestMiddlewareConcurrency tests that slots are held around the handler and released after it
+func TestMiddlewareConcurrency(t *testing.T) {
+  concurrency := &MockConcurrencyLimiter{allow: true}
+  limiter := &MockRateLimiter{allowIP: true}
+  middleware := NewRateLimiterMiddleware(limiter, WithConcurrencyLimiter(concurrency))
+
+  testHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if concurrency.released != 0 {
+      t.Error("Slot should be held while the handler runs")
+    }
+  })
+
+  req := httptest.NewRequest("GET", "/test", nil)
+  rr := httptest.NewRecorder()
+  middleware.Middleware(testHandler).ServeHTTP(rr, req)
+
+  if concurrency.released != 1 {
+    t.Errorf("Slot should be released once, got %d releases", concurrency.released)
+  }
+
+  // Requests are rejected when no slot is available, without being charged
+  concurrency.allow = false
+  limiter.lastCost = 0
+  rr = httptest.NewRecorder()
+  middleware.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    t.Error("Handler should not be called without a slot")
+  })).ServeHTTP(rr, req)
+
+  if status := rr.Code; status != http.StatusTooManyRequests {
+    t.Errorf("Handler returned wrong status code: got %v want %v", status, http.StatusTooManyRequests)
+  }
+  if limiter.lastCost != 0 {
+    t.Errorf("Request without a slot should not be charged, got cost %d", limiter.lastCost)
+  }
+}
+
+// SequenceRateLimiter returns a fixed sequence of results, repeating the last one
+type SequenceRateLimiter struct {
+  results []interfaces.Result
+  calls   int
+}
+
+// CheckIP returns the next result of the sequence
+func (m *SequenceRateLimiter) CheckIP(ctx context.Context, ip string, cost int) (interfaces.Result, error) {
+  result := m.results[len(m.results)-1]
+  if m.calls < len(m.results) {
+    result = m.results[m.calls]
+  }
+  m.calls++
+  return result, nil
+}
+
+// CheckToken returns the next result of the sequence
+func (m *SequenceRateLimiter) CheckToken(ctx context.Context, token string, cost int) (interfaces.Result, error) {
+  return m.CheckIP(ctx, token, cost)
+}
+
+// Close mocks the close method
+func (m *SequenceRateLimiter) Close() error {
+  return nil
+}
+
+// TestMiddlewareWaitMode tests that over-limit requests are held until the limiter allows them
+func TestMiddlewareWaitMode(t *testing.T) {
+  mockLimiter := &SequenceRateLimiter{
+    results: []interfaces.Result{
+      {RetryAfter: 10 * time.Millisecond},
+      {Allowed: true},
+    },
+  }
+  middleware := NewRateLimiterMiddleware(mockLimiter, WithWaitMode(time.Second, 1))
+
+  handlerCalled := false
+  testHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    handlerCalled = true
+  })
+
+  req := httptest.NewRequest("GET", "/test", nil)
+  rr := httptest.NewRecorder()
+  middleware.Middleware(testHandler).ServeHTTP(rr, req)
+
+  if !handlerCalled {
+    t.Error("Handler should be called once the limiter allows the request")
+  }
+  if mockLimiter.calls != 2 {
+    t.Errorf("Expected 2 checks, got %d", mockLimiter.calls)
+  }
+}
+
+// TestMiddlewareWaitModeBound tests that requests are rejected when the wait would exceed the bound
+func TestMiddlewareWaitModeBound(t *testing.T) {
+  mockLimiter := &SequenceRateLimiter{
+    results: []interfaces.Result{{RetryAfter: time.Minute}},
+  }
+  middleware := NewRateLimiterMiddleware(mockLimiter, WithWaitMode(time.Second, 1))
+
+  testHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    t.Error("Handler should not be called when the wait exceeds the bound")
+  })
+
+  req := httptest.NewRequest("GET", "/test", nil)
+  rr := httptest.NewRecorder()
+
+  start := time.Now()
+  middleware.Middleware(testHandler).ServeHTTP(rr, req)
+
+  if status := rr.Code; status != http.StatusTooManyRequests {
+    t.Errorf("Handler returned wrong status code: got %v want %v", status, http.StatusTooManyRequests)
+  }
+  if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+    t.Errorf("Request should be rejected without waiting, took %v", elapsed)
+  }
+}
+
+// TestMiddlewareWaitModeCancel tests that waiting stops when the request is cancelled
+func TestMiddlewareWaitModeCancel(t *testing.T) {
+  mockLimiter := &SequenceRateLimiter{
+    results: []interfaces.Result{{RetryAfter: 500 * time.Millisecond}},
+  }
+  middleware := NewRateLimiterMiddleware(mockLimiter, WithWaitMode(time.Minute, 1))
+
+  testHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    t.Error("Handler should not be called for a cancelled request")
+  })
+
+  ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+  defer cancel()
+  req := httptest.NewRequest("GET", "/test", nil).WithContext(ctx)
+  rr := httptest.NewRecorder()
+
+  start := time.Now()
+  middleware.Middleware(testHandler).ServeHTTP(rr, req)
+
+  if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+    t.Errorf("Request should stop waiting once cancelled, took %v", elapsed)
+  }
+  if mockLimiter.calls != 1 {
+    t.Errorf("Expected 1 check, got %d", mockLimiter.calls)
+  }
+}
+
+// MockLoadObserver records the reported requests
+type MockLoadObserver struct {
+  latencies []time.Duration
+  failures  int
+}
+
+// Observe records the request
+func (m *MockLoadObserver) Observe(latency time.Duration, failed bool) {
+  m.latencies = append(m.latencies, latency)
+  if failed {
+    m.failures++
+  }
+}
+
+// TestMiddlewareLoadObserver tests that allowed requests report their latency
+// and failures, and denied ones are not reported
+func TestMiddlewareLoadObserver(t *testing.T) {
+  observer := &MockLoadObserver{}
+  mockLimiter := &MockRateLimiter{allowIP: true}
+  m := NewRateLimiterMiddleware(mockLimiter, WithLoadObserver(observer))
+
+  status := http.StatusOK
+  handler := m.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    time.Sleep(10 * time.Millisecond)
+    w.WriteHeader(status)
+  }))
+
+  for _, status = range []int{http.StatusOK, http.StatusServiceUnavailable, http.StatusNotFound} {
+    handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/test", nil))
+  }
+  mockLimiter.allowIP = false
+  handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/test", nil))
+
+  if len(observer.latencies) != 3 || observer.failures != 1 {
+    t.Fatalf("Expected 3 requests with 1 failure, got %v and %d", observer.latencies, observer.failures)
+  }
+  if observer.latencies[0] < 10*time.Millisecond {
+    t.Errorf("Expected the handler latency to be measured, got %v", observer.latencies[0])
+  }
+}
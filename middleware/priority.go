@@ -0,0 +1,200 @@
+package middleware
+
+import (
+  "context"
+  "encoding/json"
+  "fmt"
+  "net/http"
+  "os"
+  "strings"
+  "time"
+
+  "rate-limiter/interfaces"
+  "rate-limiter/metrics"
+)
+
+// PriorityClass is a class of traffic and the share of the global capacity,
+// in percent, its requests may fill
+type PriorityClass struct {
+  Name  string `json:"name"`
+  Share int    `json:"share"`
+}
+
+// Priorities assigns requests to priority classes sharing a global capacity.
+// Lower classes may only fill part of the capacity, keeping the rest as
+// headroom for higher ones, so they are shed first under overload.
+type Priorities struct {
+  // Capacity is the number of cost units served per window in total
+  Capacity   int
+  Expiration time.Duration
+
+  // Classes lists the classes with their shares of the capacity
+  Classes []PriorityClass
+
+  // Header names a header carrying the class, honored from trusted proxies
+  Header string
+
+  // Tokens maps token identifiers, as given by hashes, to their class
+  Tokens map[string]string
+
+  // Routes maps path prefixes to their class, the longest prefix wins
+  Routes map[string]string
+
+  // Default is the class of requests no other rule assigns
+  Default string
+
+  hashes func(string) []string
+}
+
+// prioritiesSpec is the JSON form of a priorities file
+type prioritiesSpec struct {
+  Capacity   int               `json:"capacity"`
+  Expiration int               `json:"expiration"`
+  Classes    []PriorityClass   `json:"classes"`
+  Header     string            `json:"header"`
+  Tokens     map[string]string `json:"tokens"`
+  Routes     map[string]string `json:"routes"`
+  Default    string            `json:"default"`
+}
+
+// LoadPriorities reads the priority classes and the rules assigning them from
+// a JSON file, tokens are listed under any of the identifiers given by hashes
+func LoadPriorities(path string, hashes func(string) []string) (*Priorities, error) {
+  data, err := os.ReadFile(path)
+  if err != nil {
+    return nil, fmt.Errorf("failed to read priorities: %w", err)
+  }
+
+  var spec prioritiesSpec
+  if err := json.Unmarshal(data, &spec); err != nil {
+    return nil, fmt.Errorf("failed to parse priorities: %w", err)
+  }
+  if spec.Capacity <= 0 || spec.Expiration <= 0 {
+    return nil, fmt.Errorf("capacity and expiration must be positive")
+  }
+
+  p := &Priorities{
+    Capacity:   spec.Capacity,
+    Expiration: time.Duration(spec.Expiration) * time.Second,
+    Classes:    spec.Classes,
+    Header:     spec.Header,
+    Tokens:     spec.Tokens,
+    Routes:     spec.Routes,
+    Default:    spec.Default,
+    hashes:     hashes,
+  }
+  for _, class := range p.Classes {
+    if class.Name == "" || class.Share <= 0 || class.Share > 100 {
+      return nil, fmt.Errorf("class %q: share must be between 1 and 100", class.Name)
+    }
+  }
+  for _, class := range p.Tokens {
+    if !p.known(class) {
+      return nil, fmt.Errorf("unknown token class %q", class)
+    }
+  }
+  for _, class := range p.Routes {
+    if !p.known(class) {
+      return nil, fmt.Errorf("unknown route class %q", class)
+    }
+  }
+  if !p.known(p.Default) {
+    return nil, fmt.Errorf("unknown default class %q", p.Default)
+  }
+  return p, nil
+}
+
+// Classify returns the class of a request from its header, its token or its
+// route, in that order, and the default class otherwise. The header is only
+// honored on requests sent by one of the trusted proxies.
+func (p *Priorities) Classify(r *http.Request, token string, trusted TrustedProxies) string {
+  // Clients could mark themselves critical to skip load shedding
+  if p.Header != "" && trusted.Trusted(r) {
+    if class := r.Header.Get(p.Header); p.known(class) {
+      return class
+    }
+  }
+
+  if token != "" {
+    hashes := []string{token}
+    if p.hashes != nil {
+      hashes = p.hashes(token)
+    }
+    for _, hash := range hashes {
+      if class, ok := p.Tokens[hash]; ok {
+        return class
+      }
+    }
+  }
+
+  class, longest := p.Default, -1
+  for prefix, prefixClass := range p.Routes {
+    if strings.HasPrefix(r.URL.Path, prefix) && len(prefix) > longest {
+      class, longest = prefixClass, len(prefix)
+    }
+  }
+  return class
+}
+
+// level returns the global capacity as seen by a class
+func (p *Priorities) level(class string) interfaces.Level {
+  share := 100
+  for _, c := range p.Classes {
+    if c.Name == class {
+      share = c.Share
+    }
+  }
+  return interfaces.Level{
+    Name:       "capacity",
+    Dimension:  "global",
+    Value:      "all",
+    Limit:      p.Capacity * share / 100,
+    Expiration: p.Expiration,
+  }
+}
+
+// known reports whether a class is configured
+func (p *Priorities) known(class string) bool {
+  for _, c := range p.Classes {
+    if c.Name == class {
+      return true
+    }
+  }
+  return false
+}
+
+// WithPriorities sheds requests once the global capacity left to their
+// priority class is used up, before checking the per-client limits
+func WithPriorities(limiter interfaces.CapacityLimiter, priorities *Priorities) Option {
+  return func(m *RateLimiterMiddleware) {
+    m.capacity = limiter
+    m.priorities = priorities
+  }
+}
+
+// checkPriority charges a request to the global capacity of its class and
+// then runs the per-client check, giving the capacity back when the client
+// is denied
+func (m *RateLimiterMiddleware) checkPriority(ctx context.Context, class string, cost int, check func() (interfaces.Result, error)) (interfaces.Result, error) {
+  level := m.priorities.level(class)
+  capacity, err := m.capacity.CheckCapacity(ctx, level, cost)
+  if err != nil {
+    return capacity, err
+  }
+  capacity.Class, capacity.ClassRemaining = class, capacity.Remaining
+  if !capacity.Allowed {
+    metrics.Priorities.Add(class+".shed", 1)
+    return capacity, nil
+  }
+
+  result, err := check()
+  if err != nil || !result.Allowed {
+    if refundErr := m.capacity.RefundCapacity(ctx, level, cost); err == nil {
+      err = refundErr
+    }
+    return result, err
+  }
+  metrics.Priorities.Add(class+".allowed", 1)
+  result.Class, result.ClassRemaining = class, capacity.Remaining
+  return result, nil
+}
@@ -0,0 +1,180 @@
+package middleware
+
+import (
+  "context"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+  "time"
+
+  "rate-limiter/interfaces"
+)
+
+// MockCapacity counts the units charged to each level against its limit
+type MockCapacity struct {
+  counts map[string]int
+}
+
+// CheckCapacity charges the level if it allows it
+func (m *MockCapacity) CheckCapacity(ctx context.Context, level interfaces.Level, cost int) (interfaces.Result, error) {
+  if m.counts[level.Name]+cost > level.Limit {
+    return interfaces.Result{Rule: level.Name, Limit: level.Limit, OverLimit: true, RetryAfter: level.Expiration}, nil
+  }
+  m.counts[level.Name] += cost
+  return interfaces.Result{Allowed: true, Rule: level.Name, Limit: level.Limit, Remaining: level.Limit - m.counts[level.Name]}, nil
+}
+
+// RefundCapacity gives the units back
+func (m *MockCapacity) RefundCapacity(ctx context.Context, level interfaces.Level, cost int) error {
+  m.counts[level.Name] -= cost
+  return nil
+}
+
+// writePriorities writes a priorities file and loads it
+func writePriorities(t *testing.T, content string) (*Priorities, error) {
+  path := filepath.Join(t.TempDir(), "priorities.json")
+  os.WriteFile(path, []byte(content), 0o600)
+  // Tokens are listed under the current or a previous identifier
+  return LoadPriorities(path, func(token string) []string {
+    return []string{strings.ToUpper(token), "OLD-" + strings.ToUpper(token)}
+  })
+}
+
+// TestPrioritiesClassify tests the class assigned to requests
+func TestPrioritiesClassify(t *testing.T) {
+  priorities, err := writePriorities(t, `{
+    "capacity": 10,
+    "expiration": 1,
+    "header": "X-Priority",
+    "default": "normal",
+    "classes": [{"name": "critical", "share": 100}, {"name": "normal", "share": 80}, {"name": "low", "share": 50}],
+    "tokens": {"PREMIUM": "critical", "OLD-GOLD": "critical"},
+    "routes": {"/api/export": "low", "/api/export/status": "normal"}
+  }`)
+  if err != nil {
+    t.Fatalf("Unexpected error: %v", err)
+  }
+
+  trusted, _ := ParseTrustedProxies([]string{"10.0.0.0/8"})
+  tests := []struct {
+    path      string
+    header    string
+    token     string
+    untrusted bool
+    want      string
+  }{
+    {path: "/api/test", want: "normal"},
+    {path: "/api/export/csv", want: "low"},
+    {path: "/api/export/status", want: "normal"},
+    {path: "/api/export/csv", token: "premium", want: "critical"},
+    {path: "/api/export/csv", token: "gold", want: "critical"},
+    {path: "/api/test", token: "other", want: "normal"},
+    {path: "/api/test", token: "premium", header: "low", want: "low"},
+    {path: "/api/export/csv", header: "unknown", want: "low"},
+    {path: "/api/export/csv", header: "critical", untrusted: true, want: "low"},
+    {path: "/api/test", token: "other", header: "critical", untrusted: true, want: "normal"},
+  }
+
+  for _, tt := range tests {
+    req := httptest.NewRequest("GET", tt.path, nil)
+    req.RemoteAddr = "10.0.0.1:1234"
+    if tt.untrusted {
+      req.RemoteAddr = "192.168.1.1:1234"
+    }
+    if tt.header != "" {
+      req.Header.Set("X-Priority", tt.header)
+    }
+    if class := priorities.Classify(req, tt.token, trusted); class != tt.want {
+      t.Errorf("%s %q %q: expected class %s, got %s", tt.path, tt.header, tt.token, tt.want, class)
+    }
+  }
+
+  for _, invalid := range []string{
+    `{"capacity": 0, "expiration": 1, "default": "normal", "classes": [{"name": "normal", "share": 100}]}`,
+    `{"capacity": 10, "expiration": 1, "default": "normal", "classes": [{"name": "normal", "share": 120}]}`,
+    `{"capacity": 10, "expiration": 1, "default": "bulk", "classes": [{"name": "normal", "share": 100}]}`,
+    `{"capacity": 10, "expiration": 1, "default": "normal", "classes": [{"name": "normal", "share": 100}], "routes": {"/": "low"}}`,
+  } {
+    if _, err := writePriorities(t, invalid); err == nil {
+      t.Errorf("Expected an error for %s", invalid)
+    }
+  }
+}
+
+// TestMiddlewarePriorities tests that low priority requests are shed first and
+// that the class is reported in the result
+func TestMiddlewarePriorities(t *testing.T) {
+  priorities := &Priorities{
+    Capacity:   10,
+    Expiration: time.Second,
+    Classes:    []PriorityClass{{Name: "critical", Share: 100}, {Name: "low", Share: 50}},
+    Header:     "X-Priority",
+    Default:    "low",
+  }
+  capacity := &MockCapacity{counts: make(map[string]int)}
+  mockLimiter := &MockRateLimiter{allowIP: true, result: interfaces.Result{Limit: 100, Remaining: 50}}
+  trusted, _ := ParseTrustedProxies([]string{"10.0.0.1"})
+  m := NewRateLimiterMiddleware(mockLimiter, WithPriorities(capacity, priorities), WithTrustedProxies(trusted))
+
+  admit := func(class string) *Admission {
+    req := httptest.NewRequest("GET", "/test", nil)
+    req.RemoteAddr = "10.0.0.1:1234"
+    req.Header.Set("X-Priority", class)
+    admission, err := m.Admit(req, "192.168.1.1", "")
+    if err != nil {
+      t.Fatalf("Unexpected error: %v", err)
+    }
+    return admission
+  }
+
+  // Low priority requests only fill half of the capacity
+  for i := 0; i < 5; i++ {
+    admission := admit("low")
+    if !admission.Allowed || admission.Result.Class != "low" || admission.Result.ClassRemaining != 4-i {
+      t.Errorf("Expected low request %d to be allowed, got %+v", i+1, admission.Result)
+    }
+  }
+  admission := admit("low")
+  if admission.Allowed || admission.Result.Rule != "capacity" || admission.Result.Class != "low" {
+    t.Errorf("Expected the low request to be shed, got %+v", admission.Result)
+  }
+
+  // The headroom is kept for critical requests
+  for i := 0; i < 5; i++ {
+    if admission := admit("critical"); !admission.Allowed {
+      t.Errorf("Expected critical request %d to be allowed, got %+v", i+1, admission.Result)
+    }
+  }
+  if admission := admit("critical"); admission.Allowed {
+    t.Errorf("Expected the critical request over the capacity to be shed")
+  }
+
+  // Requests denied by their own limit give the capacity back
+  capacity.counts["capacity"] = 0
+  mockLimiter.allowIP = false
+  if admission := admit("critical"); admission.Allowed {
+    t.Errorf("Expected the request to be denied by its own limit")
+  }
+  if capacity.counts["capacity"] != 0 {
+    t.Errorf("Expected the capacity to be given back, got %d", capacity.counts["capacity"])
+  }
+}
+
+// TestPrioritiesRejectRequest tests the denial response of shed requests
+func TestPrioritiesRejectRequest(t *testing.T) {
+  priorities := &Priorities{Capacity: 1, Expiration: time.Second, Classes: []PriorityClass{{Name: "low", Share: 100}}, Default: "low"}
+  m := NewRateLimiterMiddleware(&MockRateLimiter{allowIP: true},
+    WithPriorities(&MockCapacity{counts: map[string]int{"capacity": 1}}, priorities),
+    WithDenialResponse("capacity", &DenialResponse{status: http.StatusServiceUnavailable}),
+  )
+  handler := m.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+  rr := httptest.NewRecorder()
+  handler.ServeHTTP(rr, httptest.NewRequest("GET", "/test", nil))
+  if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") != "1" {
+    t.Errorf("Expected a 503 with Retry-After, got %d %v", rr.Code, rr.Header())
+  }
+}
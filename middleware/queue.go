@@ -0,0 +1,71 @@
+package middleware
+
+import (
+  "context"
+  "sync"
+  "time"
+)
+
+// waitQueue holds over-limit requests until the limiter may allow them again
+type waitQueue struct {
+  maxWait   time.Duration
+  maxLength int
+  mutex     sync.Mutex
+  waiting   map[string]int
+}
+
+// newWaitQueue creates a queue bounded by the total wait per request and the
+// number of requests waiting per key
+func newWaitQueue(maxWait time.Duration, maxLength int) *waitQueue {
+  return &waitQueue{
+    maxWait:   maxWait,
+    maxLength: maxLength,
+    waiting:   make(map[string]int),
+  }
+}
+
+// wait blocks for retryAfter and reports whether the request should be
+// checked again, it gives up straight away when the request would wait past
+// maxWait since start or the queue for the key is full
+func (q *waitQueue) wait(ctx context.Context, key string, start time.Time, retryAfter time.Duration) bool {
+  if retryAfter <= 0 || time.Since(start)+retryAfter > q.maxWait {
+    return false
+  }
+  if !q.enter(key) {
+    return false
+  }
+  defer q.leave(key)
+
+  timer := time.NewTimer(retryAfter)
+  defer timer.Stop()
+
+  select {
+  case <-ctx.Done():
+    return false
+  case <-timer.C:
+    return true
+  }
+}
+
+// enter takes a place in the queue for the key
+func (q *waitQueue) enter(key string) bool {
+  q.mutex.Lock()
+  defer q.mutex.Unlock()
+
+  if q.waiting[key] >= q.maxLength {
+    return false
+  }
+  q.waiting[key]++
+  return true
+}
+
+// leave gives back a place in the queue for the key
+func (q *waitQueue) leave(key string) {
+  q.mutex.Lock()
+  defer q.mutex.Unlock()
+
+  q.waiting[key]--
+  if q.waiting[key] <= 0 {
+    delete(q.waiting, key)
+  }
+}
@@ -0,0 +1,138 @@
+package middleware
+
+import (
+  "bufio"
+  "context"
+  "fmt"
+  "log"
+  "net"
+  "net/http"
+  "strconv"
+  "strings"
+
+  "rate-limiter/interfaces"
+)
+
+// RefundFunc reports whether the units consumed by a request should be given
+// back, given the status and headers of its response
+type RefundFunc func(status int, header http.Header) bool
+
+// WithRefunds gives back the units consumed by requests whose response
+// matches the refund rule, such as server errors or cache hits
+func WithRefunds(refunder interfaces.Refunder, refund RefundFunc) Option {
+  return func(m *RateLimiterMiddleware) {
+    m.refunder = refunder
+    m.refundFunc = refund
+  }
+}
+
+// RefundOnStatus matches responses by status code, patterns are either exact
+// codes such as "503" or classes such as "5xx"
+func RefundOnStatus(patterns ...string) RefundFunc {
+  return func(status int, header http.Header) bool {
+    return matchStatus(patterns, status)
+  }
+}
+
+// RefundOnHeader matches responses carrying a header with the given value,
+// case insensitively
+func RefundOnHeader(name, value string) RefundFunc {
+  return func(status int, header http.Header) bool {
+    return strings.EqualFold(header.Get(name), value)
+  }
+}
+
+// AnyRefund matches responses matched by any of the refund rules
+func AnyRefund(refunds ...RefundFunc) RefundFunc {
+  return func(status int, header http.Header) bool {
+    for _, refund := range refunds {
+      if refund(status, header) {
+        return true
+      }
+    }
+    return false
+  }
+}
+
+// refund gives back the units consumed by an admitted request
+func (m *RateLimiterMiddleware) refund(ctx context.Context, admission *Admission) {
+  // The request may be cancelled by now, the refund must still go through
+  ctx = context.WithoutCancel(ctx)
+
+  var err error
+  if m.hierarchy != nil {
+    err = m.hierarchy.RefundLevels(ctx, admission.levels, admission.cost)
+  } else if admission.token != "" {
+    err = m.refunder.RefundToken(ctx, admission.token, admission.cost)
+  } else {
+    err = m.refunder.RefundIP(ctx, admission.ip, admission.cost)
+  }
+  if err != nil {
+    log.Printf("Error refunding request: %v", err)
+  }
+}
+
+// Helper function to match a status code against exact codes such as "503"
+// or classes such as "5xx"
+func matchStatus(patterns []string, status int) bool {
+  code := strconv.Itoa(status)
+  for _, pattern := range patterns {
+    pattern = strings.ToLower(strings.TrimSpace(pattern))
+    if pattern == code || (len(pattern) == 3 && strings.HasSuffix(pattern, "xx") && pattern[0] == code[0]) {
+      return true
+    }
+  }
+  return false
+}
+
+// responseRecorder captures the status of a response while passing it
+// through, keeping the optional interfaces of the underlying writer reachable
+type responseRecorder struct {
+  http.ResponseWriter
+  status      int
+  wroteHeader bool
+}
+
+// WriteHeader records the status code before sending it
+func (rec *responseRecorder) WriteHeader(status int) {
+  // Informational responses are followed by the final one
+  if !rec.wroteHeader && (status >= 200 || status == http.StatusSwitchingProtocols) {
+    rec.status = status
+    rec.wroteHeader = true
+  }
+  rec.ResponseWriter.WriteHeader(status)
+}
+
+// Write sends an implicit 200 status if none was written
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+  if !rec.wroteHeader {
+    rec.status = http.StatusOK
+    rec.wroteHeader = true
+  }
+  return rec.ResponseWriter.Write(b)
+}
+
+// Flush sends buffered data to the client, as streaming responses need
+func (rec *responseRecorder) Flush() {
+  if !rec.wroteHeader {
+    rec.status = http.StatusOK
+    rec.wroteHeader = true
+  }
+  if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+    flusher.Flush()
+  }
+}
+
+// Hijack takes over the connection, as WebSocket upgrades need
+func (rec *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+  hijacker, ok := rec.ResponseWriter.(http.Hijacker)
+  if !ok {
+    return nil, nil, fmt.Errorf("response writer does not support hijacking")
+  }
+  return hijacker.Hijack()
+}
+
+// Unwrap returns the underlying writer for http.ResponseController
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+  return rec.ResponseWriter
+}
@@ -0,0 +1,93 @@
+package middleware
+
+import (
+  "context"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+)
+
+// MockRefunder records the refunds made by the middleware
+type MockRefunder struct {
+  refunds map[string]int
+}
+
+// RefundIP mocks the IP refund
+func (m *MockRefunder) RefundIP(ctx context.Context, ip string, cost int) error {
+  m.refunds["ip:"+ip] += cost
+  return nil
+}
+
+// RefundToken mocks the token refund
+func (m *MockRefunder) RefundToken(ctx context.Context, token string, cost int) error {
+  m.refunds["token:"+token] += cost
+  return nil
+}
+
+// TestMiddlewareRefund tests that matching responses give back their units
+func TestMiddlewareRefund(t *testing.T) {
+  tests := []struct {
+    name   string
+    status int
+    header string
+    token  string
+    want   map[string]int
+  }{
+    {name: "server error", status: http.StatusBadGateway, want: map[string]int{"ip:192.168.1.1": 5}},
+    {name: "exact status", status: http.StatusNotModified, token: "abc", want: map[string]int{"token:abc": 5}},
+    {name: "cache hit", status: http.StatusOK, header: "HIT", want: map[string]int{"ip:192.168.1.1": 5}},
+    {name: "charged", status: http.StatusOK, header: "MISS", want: map[string]int{}},
+    {name: "client error", status: http.StatusNotFound, want: map[string]int{}},
+  }
+
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      refunder := &MockRefunder{refunds: make(map[string]int)}
+      mockLimiter := &MockRateLimiter{allowIP: true, allowToken: true}
+      m := NewRateLimiterMiddleware(mockLimiter,
+        WithRouteCosts(map[string]int{"/": 5}),
+        WithRefunds(refunder, AnyRefund(RefundOnStatus("5xx", "304"), RefundOnHeader("X-Cache", "hit"))),
+      )
+
+      handler := m.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if tt.header != "" {
+          w.Header().Set("X-Cache", tt.header)
+        }
+        w.WriteHeader(tt.status)
+      }))
+
+      req := httptest.NewRequest("GET", "/test", nil)
+      req.RemoteAddr = "192.168.1.1:12345"
+      if tt.token != "" {
+        req.Header.Set(TokenHeader, tt.token)
+      }
+      rr := httptest.NewRecorder()
+      handler.ServeHTTP(rr, req)
+
+      if rr.Code != tt.status {
+        t.Errorf("Expected status %d, got %d", tt.status, rr.Code)
+      }
+      if len(refunder.refunds) != len(tt.want) {
+        t.Fatalf("Expected refunds %v, got %v", tt.want, refunder.refunds)
+      }
+      for key, cost := range tt.want {
+        if refunder.refunds[key] != cost {
+          t.Errorf("Expected refund of %d for %s, got %d", cost, key, refunder.refunds[key])
+        }
+      }
+    })
+  }
+}
+
+// TestResponseRecorderFlush tests that streaming handlers can still flush
+func TestResponseRecorderFlush(t *testing.T) {
+  rr := httptest.NewRecorder()
+  rec := &responseRecorder{ResponseWriter: rr}
+
+  if err := http.NewResponseController(rec).Flush(); err != nil {
+    t.Fatalf("Unexpected error: %v", err)
+  }
+  if !rr.Flushed || rec.status != http.StatusOK {
+    t.Errorf("Expected the flush to reach the underlying writer with status 200")
+  }
+}
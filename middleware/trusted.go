@@ -0,0 +1,79 @@
+package middleware
+
+import (
+  "fmt"
+  "net"
+  "net/http"
+  "strings"
+)
+
+// TrustedProxies are the networks allowed to send headers that change how a
+// request is limited, such as its cost, priority class or tenant
+type TrustedProxies []*net.IPNet
+
+// ParseTrustedProxies parses a list of addresses and CIDR ranges
+func ParseTrustedProxies(values []string) (TrustedProxies, error) {
+  var proxies TrustedProxies
+  for _, value := range values {
+    if !strings.Contains(value, "/") {
+      ip := net.ParseIP(value)
+      if ip == nil {
+        return nil, fmt.Errorf("invalid trusted proxy %q", value)
+      }
+      bits := 8 * len(ip.To16())
+      if ip.To4() != nil {
+        ip, bits = ip.To4(), 32
+      }
+      proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+      continue
+    }
+
+    _, network, err := net.ParseCIDR(value)
+    if err != nil {
+      return nil, fmt.Errorf("invalid trusted proxy %q", value)
+    }
+    proxies = append(proxies, network)
+  }
+  return proxies, nil
+}
+
+// Trusted reports whether the request was sent directly by a trusted proxy,
+// forwarding headers are ignored since any client can set them
+func (t TrustedProxies) Trusted(r *http.Request) bool {
+  host, _, err := net.SplitHostPort(r.RemoteAddr)
+  if err != nil {
+    host = r.RemoteAddr
+  }
+  ip := net.ParseIP(host)
+  if ip == nil {
+    return false
+  }
+
+  for _, network := range t {
+    if network.Contains(ip) {
+      return true
+    }
+  }
+  return false
+}
+
+// trustedClientIP returns the client IP from X-Forwarded-For on requests
+// sent by a trusted proxy and the peer address otherwise
+func trustedClientIP(r *http.Request, trusted TrustedProxies) string {
+  if trusted.Trusted(r) {
+    return getClientIP(r)
+  }
+  ip, _, err := net.SplitHostPort(r.RemoteAddr)
+  if err != nil {
+    return r.RemoteAddr
+  }
+  return ip
+}
+
+// WithTrustedProxies only honors the cost and priority headers of requests
+// sent by the given proxies
+func WithTrustedProxies(proxies TrustedProxies) Option {
+  return func(m *RateLimiterMiddleware) {
+    m.trusted = proxies
+  }
+}
@@ -0,0 +1,159 @@
+package outbound
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "net/http"
+  "strconv"
+  "time"
+
+  "rate-limiter/limiter"
+)
+
+// ErrQuotaExceeded is returned when an outgoing request is over quota
+var ErrQuotaExceeded = errors.New("outbound quota exceeded")
+
+// KeyFunc returns the quota key of an outgoing request
+type KeyFunc func(r *http.Request) string
+
+// Option configures a Transport
+type Option func(t *Transport)
+
+// Transport is an http.RoundTripper that throttles outgoing requests so the
+// caller stays within third-party quotas
+type Transport struct {
+  base    http.RoundTripper
+  limiter *limiter.RateLimiter
+  rule    limiter.Rule
+  keyFunc KeyFunc
+  maxWait time.Duration
+}
+
+// NewTransport creates a new transport limiting requests with the given rule,
+// by default per destination host and failing fast when over quota. Requests
+// over quota are only rejected, so a destination is never blocked past its
+// window and waiting callers do not consume its quota.
+func NewTransport(rl *limiter.RateLimiter, rule limiter.Rule, opts ...Option) *Transport {
+  rule.Mode = limiter.ModeReject
+  rule.SkipDenied = true
+
+  t := &Transport{
+    base:    http.DefaultTransport,
+    limiter: rl,
+    rule:    rule,
+    keyFunc: func(r *http.Request) string { return r.URL.Host },
+  }
+  for _, opt := range opts {
+    opt(t)
+  }
+  return t
+}
+
+// WithBase sets the transport that sends the requests
+func WithBase(base http.RoundTripper) Option {
+  return func(t *Transport) {
+    t.base = base
+  }
+}
+
+// WithKeyFunc sets how the quota key of a request is computed
+func WithKeyFunc(fn KeyFunc) Option {
+  return func(t *Transport) {
+    t.keyFunc = fn
+  }
+}
+
+// WithMaxWait waits up to maxWait for quota instead of failing fast
+func WithMaxWait(maxWait time.Duration) Option {
+  return func(t *Transport) {
+    t.maxWait = maxWait
+  }
+}
+
+// RoundTrip sends the request once it fits in the quota
+func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+  ctx := r.Context()
+  key := t.keyFunc(r)
+
+  // Round trippers must close the body even when the request is not sent
+  if err := t.wait(ctx, key); err != nil {
+    if r.Body != nil {
+      r.Body.Close()
+    }
+    return nil, err
+  }
+
+  resp, err := t.base.RoundTrip(r)
+  if err != nil {
+    return nil, err
+  }
+
+  // Back off for as long as the upstream asks
+  if backoff := upstreamBackoff(resp); backoff > 0 {
+    if err := t.limiter.Throttle(ctx, t.rule, key, backoff); err != nil {
+      resp.Body.Close()
+      return nil, err
+    }
+  }
+  return resp, nil
+}
+
+// wait returns once a request for the key fits in the quota, or fails when it
+// would wait longer than allowed
+func (t *Transport) wait(ctx context.Context, key string) error {
+  start := time.Now()
+  for {
+    result, err := t.limiter.Check(ctx, t.rule, key, 1)
+    if err != nil {
+      return err
+    }
+    if result.Allowed {
+      return nil
+    }
+
+    retryAfter := result.RetryAfter
+    if retryAfter <= 0 || time.Since(start)+retryAfter > t.maxWait {
+      return fmt.Errorf("%w for %s, retry after %v", ErrQuotaExceeded, key, retryAfter)
+    }
+
+    timer := time.NewTimer(retryAfter)
+    select {
+    case <-ctx.Done():
+      timer.Stop()
+      return ctx.Err()
+    case <-timer.C:
+    }
+  }
+}
+
+// upstreamBackoff returns how long the upstream asked callers to wait, from
+// Retry-After on throttled responses or from an exhausted RateLimit quota
+func upstreamBackoff(resp *http.Response) time.Duration {
+  if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+    if retryAfter := parseRetryAfter(resp.Header.Get("Retry-After")); retryAfter > 0 {
+      return retryAfter
+    }
+  }
+
+  if resp.Header.Get("RateLimit-Remaining") == "0" {
+    if reset, err := strconv.Atoi(resp.Header.Get("RateLimit-Reset")); err == nil && reset > 0 {
+      return time.Duration(reset) * time.Second
+    }
+  }
+  return 0
+}
+
+// Helper function to parse a Retry-After header given in seconds or as a date
+func parseRetryAfter(value string) time.Duration {
+  if value == "" {
+    return 0
+  }
+  if seconds, err := strconv.Atoi(value); err == nil {
+    return time.Duration(seconds) * time.Second
+  }
+  if date, err := http.ParseTime(value); err == nil {
+    return time.Until(date)
+  }
+  return 0
+}
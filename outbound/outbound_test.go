@@ -0,0 +1,252 @@
+package outbound
+
+import (
+  "context"
+  "errors"
+  "io"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+  "time"
+
+  "rate-limiter/config"
+  "rate-limiter/limiter"
+  "rate-limiter/storage"
+)
+
+// newLimiter creates a rate limiter on memory storage blocking for blockDuration seconds
+func newLimiter(blockDuration int) *limiter.RateLimiter {
+  return limiter.NewRateLimiter(&config.Config{BlockDuration: blockDuration}, storage.NewMemoryStorage())
+}
+
+// TestTransportFailFast tests that requests over quota fail without reaching the upstream
+func TestTransportFailFast(t *testing.T) {
+  calls := 0
+  upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    calls++
+  }))
+  defer upstream.Close()
+
+  rule := limiter.Rule{Name: "outbound", Limit: 2, Expiration: time.Minute}
+  client := &http.Client{Transport: NewTransport(newLimiter(60), rule)}
+
+  for i := 0; i < 2; i++ {
+    resp, err := client.Get(upstream.URL)
+    if err != nil {
+      t.Fatalf("Request %d should be sent: %v", i+1, err)
+    }
+    resp.Body.Close()
+  }
+
+  _, err := client.Get(upstream.URL)
+  if !errors.Is(err, ErrQuotaExceeded) {
+    t.Errorf("Expected ErrQuotaExceeded, got %v", err)
+  }
+  if calls != 2 {
+    t.Errorf("Expected 2 upstream calls, got %d", calls)
+  }
+}
+
+// TestTransportKeyFunc tests that quotas are tracked per configured key
+func TestTransportKeyFunc(t *testing.T) {
+  upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+  defer upstream.Close()
+
+  rule := limiter.Rule{Name: "outbound", Limit: 1, Expiration: time.Minute}
+  transport := NewTransport(newLimiter(60), rule, WithKeyFunc(func(r *http.Request) string {
+    return r.URL.Query().Get("account")
+  }))
+  client := &http.Client{Transport: transport}
+
+  for _, account := range []string{"a", "b"} {
+    resp, err := client.Get(upstream.URL + "?account=" + account)
+    if err != nil {
+      t.Fatalf("First request for account %s should be sent: %v", account, err)
+    }
+    resp.Body.Close()
+  }
+
+  if _, err := client.Get(upstream.URL + "?account=a"); !errors.Is(err, ErrQuotaExceeded) {
+    t.Errorf("Expected ErrQuotaExceeded, got %v", err)
+  }
+}
+
+// TestTransportWait tests that requests wait for quota when a maximum wait is set
+func TestTransportWait(t *testing.T) {
+  upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+  defer upstream.Close()
+
+  rule := limiter.Rule{Name: "outbound", Limit: 1, Expiration: 500 * time.Millisecond}
+  client := &http.Client{Transport: NewTransport(newLimiter(1), rule, WithMaxWait(3*time.Second))}
+
+  resp, err := client.Get(upstream.URL)
+  if err != nil {
+    t.Fatalf("First request should be sent: %v", err)
+  }
+  resp.Body.Close()
+
+  // The request waits until the window of the host ends
+  start := time.Now()
+  resp, err = client.Get(upstream.URL)
+  if err != nil {
+    t.Fatalf("Second request should be sent after waiting: %v", err)
+  }
+  resp.Body.Close()
+  if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+    t.Errorf("Second request should wait for quota, took %v", elapsed)
+  }
+}
+
+// TestTransportNoBlock tests that requests over quota neither block the host nor consume its quota
+func TestTransportNoBlock(t *testing.T) {
+  calls := 0
+  upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    calls++
+  }))
+  defer upstream.Close()
+
+  rule := limiter.Rule{Name: "outbound", Limit: 1, Expiration: 300 * time.Millisecond}
+  client := &http.Client{Transport: NewTransport(newLimiter(60), rule)}
+
+  resp, err := client.Get(upstream.URL)
+  if err != nil {
+    t.Fatalf("First request should be sent: %v", err)
+  }
+  resp.Body.Close()
+
+  for i := 0; i < 3; i++ {
+    if _, err := client.Get(upstream.URL); !errors.Is(err, ErrQuotaExceeded) {
+      t.Fatalf("Expected ErrQuotaExceeded, got %v", err)
+    }
+  }
+
+  time.Sleep(350 * time.Millisecond)
+  resp, err = client.Get(upstream.URL)
+  if err != nil {
+    t.Fatalf("Request should be sent once the window ends: %v", err)
+  }
+  resp.Body.Close()
+  if calls != 2 {
+    t.Errorf("Expected 2 upstream calls, got %d", calls)
+  }
+}
+
+// TestTransportWaitCancel tests that waiting stops when the request is cancelled
+func TestTransportWaitCancel(t *testing.T) {
+  upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+  defer upstream.Close()
+
+  rule := limiter.Rule{Name: "outbound", Limit: 1, Expiration: 2 * time.Second}
+  client := &http.Client{Transport: NewTransport(newLimiter(60), rule, WithMaxWait(3*time.Second))}
+
+  resp, err := client.Get(upstream.URL)
+  if err != nil {
+    t.Fatalf("First request should be sent: %v", err)
+  }
+  resp.Body.Close()
+
+  start := time.Now()
+  ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+  defer cancel()
+  req, _ := http.NewRequestWithContext(ctx, "GET", upstream.URL, nil)
+  if _, err := client.Do(req); !errors.Is(err, context.DeadlineExceeded) {
+    t.Errorf("Expected the wait to stop at the deadline, got %v", err)
+  }
+  if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+    t.Errorf("Request should stop waiting once cancelled, took %v", elapsed)
+  }
+}
+
+// TestTransportRetryAfter tests that the transport backs off when the upstream asks it to
+func TestTransportRetryAfter(t *testing.T) {
+  calls := 0
+  upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    calls++
+    w.Header().Set("Retry-After", "120")
+    w.WriteHeader(http.StatusTooManyRequests)
+  }))
+  defer upstream.Close()
+
+  rule := limiter.Rule{Name: "outbound", Limit: 100, Expiration: time.Minute}
+  client := &http.Client{Transport: NewTransport(newLimiter(60), rule)}
+
+  resp, err := client.Get(upstream.URL)
+  if err != nil {
+    t.Fatalf("First request should be sent: %v", err)
+  }
+  resp.Body.Close()
+
+  if _, err := client.Get(upstream.URL); !errors.Is(err, ErrQuotaExceeded) {
+    t.Errorf("Expected ErrQuotaExceeded while backing off, got %v", err)
+  }
+  if calls != 1 {
+    t.Errorf("Expected 1 upstream call, got %d", calls)
+  }
+}
+
+// TestUpstreamBackoff tests how the backoff is read from upstream headers
+func TestUpstreamBackoff(t *testing.T) {
+  tests := []struct {
+    name   string
+    status int
+    header map[string]string
+    want   time.Duration
+  }{
+    {name: "ok", status: http.StatusOK, want: 0},
+    {name: "retry after", status: http.StatusTooManyRequests, header: map[string]string{"Retry-After": "30"}, want: 30 * time.Second},
+    {name: "retry after on success", status: http.StatusOK, header: map[string]string{"Retry-After": "30"}, want: 0},
+    {name: "exhausted quota", status: http.StatusOK, header: map[string]string{"RateLimit-Remaining": "0", "RateLimit-Reset": "15"}, want: 15 * time.Second},
+    {name: "remaining quota", status: http.StatusOK, header: map[string]string{"RateLimit-Remaining": "3", "RateLimit-Reset": "15"}, want: 0},
+  }
+
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      resp := &http.Response{StatusCode: tt.status, Header: make(http.Header)}
+      for name, value := range tt.header {
+        resp.Header.Set(name, value)
+      }
+      if got := upstreamBackoff(resp); got != tt.want {
+        t.Errorf("Backoff = %v, want %v", got, tt.want)
+      }
+    })
+  }
+}
+
+// closeRecorder is a request body recording whether it was closed
+type closeRecorder struct {
+  closed bool
+}
+
+// Read reports an empty body
+func (b *closeRecorder) Read(p []byte) (int, error) {
+  return 0, io.EOF
+}
+
+// Close records that the body was closed
+func (b *closeRecorder) Close() error {
+  b.closed = true
+  return nil
+}
+
+// TestTransportClosesBody tests that requests turned away still have their body closed
+func TestTransportClosesBody(t *testing.T) {
+  upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+  defer upstream.Close()
+
+  rule := limiter.Rule{Name: "outbound", Limit: 1, Expiration: time.Minute}
+  transport := NewTransport(newLimiter(60), rule)
+
+  for i := 0; i < 2; i++ {
+    body := &closeRecorder{}
+    req, _ := http.NewRequest("POST", upstream.URL, body)
+    resp, err := transport.RoundTrip(req)
+    if err == nil {
+      resp.Body.Close()
+    } else if !errors.Is(err, ErrQuotaExceeded) {
+      t.Fatalf("Unexpected error: %v", err)
+    }
+    if !body.closed {
+      t.Errorf("Expected the body of request %d to be closed", i+1)
+    }
+  }
+}
@@ -0,0 +1,209 @@
+package proxy
+
+import (
+  "context"
+  "encoding/json"
+  "fmt"
+  "log"
+  "net"
+  "net/http"
+  "net/http/httputil"
+  "net/url"
+  "os"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "time"
+)
+
+// healthTimeout bounds each health check, so a slow upstream is reported
+// unhealthy instead of holding up the next round
+const healthTimeout = 5 * time.Second
+
+// Route maps requests for a host and path prefix to an upstream
+type Route struct {
+  // Host matches the request host, empty matches any host
+  Host string `json:"host"`
+
+  // PathPrefix matches the start of the request path
+  PathPrefix string `json:"path_prefix"`
+
+  // Upstream is the base URL requests are forwarded to
+  Upstream string `json:"upstream"`
+
+  // StripPrefix removes PathPrefix from the path sent upstream
+  StripPrefix bool `json:"strip_prefix"`
+
+  // HealthPath is polled on the upstream, empty disables health checks
+  HealthPath string `json:"health_path"`
+}
+
+// upstream is a route with its reverse proxy and health state
+type upstream struct {
+  route   Route
+  target  *url.URL
+  proxy   *httputil.ReverseProxy
+  healthy atomic.Bool
+}
+
+// Gateway is a reverse proxy that forwards requests to upstreams by route
+type Gateway struct {
+  upstreams []*upstream
+  client    *http.Client
+}
+
+// LoadRoutes reads the gateway routes from a JSON file
+func LoadRoutes(path string) ([]Route, error) {
+  data, err := os.ReadFile(path)
+  if err != nil {
+    return nil, fmt.Errorf("failed to read gateway routes: %w", err)
+  }
+
+  var routes []Route
+  if err := json.Unmarshal(data, &routes); err != nil {
+    return nil, fmt.Errorf("failed to parse gateway routes: %w", err)
+  }
+  return routes, nil
+}
+
+// NewGateway creates a new gateway for the given routes
+func NewGateway(routes []Route) (*Gateway, error) {
+  g := &Gateway{
+    client: &http.Client{},
+  }
+
+  for _, route := range routes {
+    target, err := url.Parse(route.Upstream)
+    if err != nil || target.Scheme == "" || target.Host == "" {
+      return nil, fmt.Errorf("invalid upstream %q for route %s%s", route.Upstream, route.Host, route.PathPrefix)
+    }
+
+    u := &upstream{route: route, target: target}
+    u.healthy.Store(true)
+    u.proxy = &httputil.ReverseProxy{
+      Rewrite: u.rewrite,
+      // Flush immediately so streamed responses reach the client as they arrive
+      FlushInterval: -1,
+      ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+        log.Printf("Upstream %s failed: %v", target, err)
+        writeError(w, http.StatusBadGateway, "Bad gateway")
+      },
+    }
+    g.upstreams = append(g.upstreams, u)
+  }
+
+  return g, nil
+}
+
+// ServeHTTP forwards the request to the upstream of the matching route
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+  u := g.match(r)
+  if u == nil {
+    writeError(w, http.StatusNotFound, "No route for request")
+    return
+  }
+  if !u.healthy.Load() {
+    writeError(w, http.StatusServiceUnavailable, "Upstream unavailable")
+    return
+  }
+  u.proxy.ServeHTTP(w, r)
+}
+
+// StartHealthChecks starts a background task that polls upstream health, a
+// non-positive interval disables health checks
+func (g *Gateway) StartHealthChecks(interval time.Duration) {
+  if interval <= 0 {
+    return
+  }
+  go func() {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for range ticker.C {
+      g.checkHealth()
+    }
+  }()
+}
+
+// checkHealth polls every upstream with a health path once, concurrently so
+// a slow upstream does not delay the others
+func (g *Gateway) checkHealth() {
+  var wg sync.WaitGroup
+  for _, u := range g.upstreams {
+    if u.route.HealthPath == "" {
+      continue
+    }
+    wg.Add(1)
+    go func(u *upstream) {
+      defer wg.Done()
+      g.probe(u)
+    }(u)
+  }
+  wg.Wait()
+}
+
+// probe polls the health path of an upstream and records its health
+func (g *Gateway) probe(u *upstream) {
+  ctx, cancel := context.WithTimeout(context.Background(), healthTimeout)
+  defer cancel()
+
+  healthy := false
+  req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.target.JoinPath(u.route.HealthPath).String(), nil)
+  if err == nil {
+    var resp *http.Response
+    if resp, err = g.client.Do(req); err == nil {
+      resp.Body.Close()
+      healthy = resp.StatusCode < http.StatusInternalServerError
+    }
+  }
+
+  if u.healthy.Swap(healthy) != healthy {
+    log.Printf("Upstream %s healthy: %t", u.target, healthy)
+  }
+}
+
+// match returns the upstream of the route with the longest matching prefix,
+// routes for a specific host win over catch-all routes with the same prefix
+func (g *Gateway) match(r *http.Request) *upstream {
+  host := r.Host
+  if h, _, err := net.SplitHostPort(host); err == nil {
+    host = h
+  }
+
+  var matched *upstream
+  for _, u := range g.upstreams {
+    if u.route.Host != "" && !strings.EqualFold(u.route.Host, host) {
+      continue
+    }
+    if !strings.HasPrefix(r.URL.Path, u.route.PathPrefix) {
+      continue
+    }
+    if matched == nil || len(u.route.PathPrefix) > len(matched.route.PathPrefix) ||
+      (len(u.route.PathPrefix) == len(matched.route.PathPrefix) && matched.route.Host == "") {
+      matched = u
+    }
+  }
+  return matched
+}
+
+// rewrite points the outgoing request at the upstream
+func (u *upstream) rewrite(pr *httputil.ProxyRequest) {
+  if u.route.StripPrefix {
+    pr.Out.URL.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(pr.In.URL.Path, u.route.PathPrefix), "/")
+    pr.Out.URL.RawPath = ""
+  }
+  pr.SetURL(u.target)
+
+  // Keep the forwarding chain of proxies in front of the gateway
+  if prior := pr.In.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+    pr.Out.Header["X-Forwarded-For"] = prior
+  }
+  pr.SetXForwarded()
+}
+
+// Helper function to write a JSON error response
+func writeError(w http.ResponseWriter, status int, message string) {
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(status)
+  json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
@@ -0,0 +1,206 @@
+package proxy
+
+import (
+  "bufio"
+  "fmt"
+  "io"
+  "net"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+  "time"
+)
+
+// newUpstream starts an upstream that echoes its name and the request path
+func newUpstream(t *testing.T, name string) *httptest.Server {
+  upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    fmt.Fprintf(w, "%s %s", name, r.URL.Path)
+  }))
+  t.Cleanup(upstream.Close)
+  return upstream
+}
+
+// get sends a request through the gateway and returns the status and body
+func get(t *testing.T, handler http.Handler, host, path string) (int, string) {
+  req := httptest.NewRequest("GET", path, nil)
+  req.Host = host
+  rr := httptest.NewRecorder()
+  handler.ServeHTTP(rr, req)
+  return rr.Code, rr.Body.String()
+}
+
+// TestGatewayRouting tests that requests reach the upstream of the best matching route
+func TestGatewayRouting(t *testing.T) {
+  api := newUpstream(t, "api")
+  users := newUpstream(t, "users")
+  admin := newUpstream(t, "admin")
+
+  gateway, err := NewGateway([]Route{
+    {PathPrefix: "/", Upstream: api.URL},
+    {PathPrefix: "/users", Upstream: users.URL, StripPrefix: true},
+    {Host: "admin.example.com", PathPrefix: "/", Upstream: admin.URL},
+  })
+  if err != nil {
+    t.Fatalf("Error creating gateway: %v", err)
+  }
+
+  tests := []struct {
+    host string
+    path string
+    want string
+  }{
+    {host: "example.com", path: "/api/test", want: "api /api/test"},
+    {host: "example.com", path: "/users/42", want: "users /42"},
+    {host: "admin.example.com:8080", path: "/dashboard", want: "admin /dashboard"},
+  }
+
+  for _, tt := range tests {
+    status, body := get(t, gateway, tt.host, tt.path)
+    if status != http.StatusOK {
+      t.Errorf("%s%s returned wrong status code: got %v want %v", tt.host, tt.path, status, http.StatusOK)
+    }
+    if body != tt.want {
+      t.Errorf("%s%s returned %q, want %q", tt.host, tt.path, body, tt.want)
+    }
+  }
+}
+
+// TestGatewayNoRoute tests that requests without a route are rejected
+func TestGatewayNoRoute(t *testing.T) {
+  api := newUpstream(t, "api")
+
+  gateway, err := NewGateway([]Route{{Host: "api.example.com", PathPrefix: "/", Upstream: api.URL}})
+  if err != nil {
+    t.Fatalf("Error creating gateway: %v", err)
+  }
+
+  if status, _ := get(t, gateway, "other.example.com", "/"); status != http.StatusNotFound {
+    t.Errorf("Gateway returned wrong status code: got %v want %v", status, http.StatusNotFound)
+  }
+}
+
+// TestGatewayHealthChecks tests that unhealthy upstreams are taken out of rotation
+func TestGatewayHealthChecks(t *testing.T) {
+  healthy := true
+  upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if r.URL.Path == "/healthz" && !healthy {
+      w.WriteHeader(http.StatusServiceUnavailable)
+      return
+    }
+    io.WriteString(w, "ok")
+  }))
+  defer upstream.Close()
+
+  gateway, err := NewGateway([]Route{{PathPrefix: "/", Upstream: upstream.URL, HealthPath: "/healthz"}})
+  if err != nil {
+    t.Fatalf("Error creating gateway: %v", err)
+  }
+
+  healthy = false
+  gateway.checkHealth()
+  if status, _ := get(t, gateway, "example.com", "/"); status != http.StatusServiceUnavailable {
+    t.Errorf("Gateway returned wrong status code: got %v want %v", status, http.StatusServiceUnavailable)
+  }
+
+  healthy = true
+  gateway.checkHealth()
+  if status, _ := get(t, gateway, "example.com", "/"); status != http.StatusOK {
+    t.Errorf("Gateway returned wrong status code: got %v want %v", status, http.StatusOK)
+  }
+}
+
+// TestGatewayHealthChecksConcurrent tests that upstreams are polled at once
+// and that a non-positive interval disables health checks
+func TestGatewayHealthChecksConcurrent(t *testing.T) {
+  slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    time.Sleep(300 * time.Millisecond)
+  })
+  first, second := httptest.NewServer(slow), httptest.NewServer(slow)
+  defer first.Close()
+  defer second.Close()
+
+  gateway, err := NewGateway([]Route{
+    {PathPrefix: "/a", Upstream: first.URL, HealthPath: "/healthz"},
+    {PathPrefix: "/b", Upstream: second.URL, HealthPath: "/healthz"},
+  })
+  if err != nil {
+    t.Fatalf("Error creating gateway: %v", err)
+  }
+
+  start := time.Now()
+  gateway.checkHealth()
+  if elapsed := time.Since(start); elapsed > 550*time.Millisecond {
+    t.Errorf("Expected the upstreams to be polled concurrently, took %v", elapsed)
+  }
+
+  gateway.StartHealthChecks(0)
+}
+
+// TestGatewayUpstreamDown tests that connection failures are reported as bad gateway
+func TestGatewayUpstreamDown(t *testing.T) {
+  upstream := httptest.NewServer(http.NotFoundHandler())
+  upstream.Close()
+
+  gateway, err := NewGateway([]Route{{PathPrefix: "/", Upstream: upstream.URL}})
+  if err != nil {
+    t.Fatalf("Error creating gateway: %v", err)
+  }
+
+  if status, _ := get(t, gateway, "example.com", "/"); status != http.StatusBadGateway {
+    t.Errorf("Gateway returned wrong status code: got %v want %v", status, http.StatusBadGateway)
+  }
+}
+
+// TestGatewayWebSocket tests that connection upgrades are tunnelled to the upstream
+func TestGatewayWebSocket(t *testing.T) {
+  upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    conn, rw, err := w.(http.Hijacker).Hijack()
+    if err != nil {
+      t.Errorf("Error hijacking connection: %v", err)
+      return
+    }
+    defer conn.Close()
+
+    rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+    rw.Flush()
+
+    // Echo a single line back to the client
+    line, _ := rw.ReadString('\n')
+    rw.WriteString("echo " + line)
+    rw.Flush()
+  }))
+  defer upstream.Close()
+
+  gateway, err := NewGateway([]Route{{PathPrefix: "/", Upstream: upstream.URL}})
+  if err != nil {
+    t.Fatalf("Error creating gateway: %v", err)
+  }
+  server := httptest.NewServer(gateway)
+  defer server.Close()
+
+  conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+  if err != nil {
+    t.Fatalf("Error connecting to gateway: %v", err)
+  }
+  defer conn.Close()
+
+  fmt.Fprint(conn, "GET /ws HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+  reader := bufio.NewReader(conn)
+  resp, err := http.ReadResponse(reader, nil)
+  if err != nil {
+    t.Fatalf("Error reading upgrade response: %v", err)
+  }
+  if resp.StatusCode != http.StatusSwitchingProtocols {
+    t.Fatalf("Gateway returned wrong status code: got %v want %v", resp.StatusCode, http.StatusSwitchingProtocols)
+  }
+
+  fmt.Fprint(conn, "hello\n")
+  line, err := reader.ReadString('\n')
+  if err != nil {
+    t.Fatalf("Error reading from tunnel: %v", err)
+  }
+  if line != "echo hello\n" {
+    t.Errorf("Tunnel returned %q, want %q", line, "echo hello\n")
+  }
+}
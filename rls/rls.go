@@ -0,0 +1,232 @@
+package rls
+
+import (
+  "context"
+  "encoding/json"
+  "fmt"
+  "os"
+  "strings"
+  "time"
+
+  commonv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+  ratelimitv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+  typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+  "google.golang.org/grpc/codes"
+  "google.golang.org/grpc/status"
+  "google.golang.org/protobuf/types/known/durationpb"
+  "rate-limiter/limiter"
+)
+
+// units maps the configured rate limit units to their window length
+var units = map[string]time.Duration{
+  "second": time.Second,
+  "minute": time.Minute,
+  "hour":   time.Hour,
+  "day":    24 * time.Hour,
+}
+
+// overrideUnits maps the units of descriptor limit overrides to unit names
+var overrideUnits = map[typev3.RateLimitUnit]string{
+  typev3.RateLimitUnit_SECOND: "second",
+  typev3.RateLimitUnit_MINUTE: "minute",
+  typev3.RateLimitUnit_HOUR:   "hour",
+  typev3.RateLimitUnit_DAY:    "day",
+}
+
+// responseUnits maps unit names to the units reported back to Envoy
+var responseUnits = map[string]ratelimitv3.RateLimitResponse_RateLimit_Unit{
+  "second": ratelimitv3.RateLimitResponse_RateLimit_SECOND,
+  "minute": ratelimitv3.RateLimitResponse_RateLimit_MINUTE,
+  "hour":   ratelimitv3.RateLimitResponse_RateLimit_HOUR,
+  "day":    ratelimitv3.RateLimitResponse_RateLimit_DAY,
+}
+
+// Domain holds the descriptors limited within an Envoy rate limit domain
+type Domain struct {
+  Domain      string       `json:"domain"`
+  Descriptors []Descriptor `json:"descriptors"`
+}
+
+// Descriptor describes the limit applied to matching Envoy descriptors
+type Descriptor struct {
+  // Entries must match the descriptor entries in order, an empty value
+  // matches any value for the key
+  Entries []Entry `json:"entries"`
+
+  // RateLimit is the limit applied to each distinct set of values
+  RateLimit RateLimit `json:"rate_limit"`
+
+  // DryRun accounts for requests without ever denying them
+  DryRun bool `json:"dry_run"`
+}
+
+// Entry is a single key/value pair of a descriptor
+type Entry struct {
+  Key   string `json:"key"`
+  Value string `json:"value"`
+}
+
+// RateLimit is a number of requests allowed per unit of time
+type RateLimit struct {
+  Unit            string `json:"unit"`
+  RequestsPerUnit int    `json:"requests_per_unit"`
+}
+
+// Service implements the Envoy rate limit service on top of the rate limiter
+type Service struct {
+  ratelimitv3.UnimplementedRateLimitServiceServer
+
+  limiter *limiter.RateLimiter
+  domains map[string][]Descriptor
+}
+
+// LoadDomains reads the domain configuration from a JSON file
+func LoadDomains(path string) ([]Domain, error) {
+  data, err := os.ReadFile(path)
+  if err != nil {
+    return nil, fmt.Errorf("failed to read rate limit domains: %w", err)
+  }
+
+  var domains []Domain
+  if err := json.Unmarshal(data, &domains); err != nil {
+    return nil, fmt.Errorf("failed to parse rate limit domains: %w", err)
+  }
+  return domains, nil
+}
+
+// NewService creates a new rate limit service for the given domains
+func NewService(rl *limiter.RateLimiter, domains []Domain) (*Service, error) {
+  s := &Service{
+    limiter: rl,
+    domains: make(map[string][]Descriptor),
+  }
+
+  for _, domain := range domains {
+    // Domains are part of rule names, which must not contain colons
+    if domain.Domain == "" || strings.Contains(domain.Domain, ":") {
+      return nil, fmt.Errorf("invalid domain %q", domain.Domain)
+    }
+    for _, descriptor := range domain.Descriptors {
+      if _, ok := units[descriptor.RateLimit.Unit]; !ok {
+        return nil, fmt.Errorf("invalid unit %q in domain %s", descriptor.RateLimit.Unit, domain.Domain)
+      }
+    }
+    s.domains[domain.Domain] = append(s.domains[domain.Domain], domain.Descriptors...)
+  }
+
+  return s, nil
+}
+
+// ShouldRateLimit checks every descriptor of the request against its limit
+func (s *Service) ShouldRateLimit(ctx context.Context, req *ratelimitv3.RateLimitRequest) (*ratelimitv3.RateLimitResponse, error) {
+  if req.GetDomain() == "" {
+    return nil, status.Error(codes.InvalidArgument, "rate limit domain must not be empty")
+  }
+
+  hits := int(req.GetHitsAddend())
+  if hits == 0 {
+    hits = 1
+  }
+
+  resp := &ratelimitv3.RateLimitResponse{OverallCode: ratelimitv3.RateLimitResponse_OK}
+  for _, descriptor := range req.GetDescriptors() {
+    descriptorStatus, err := s.check(ctx, req.GetDomain(), descriptor, hits)
+    if err != nil {
+      return nil, status.Errorf(codes.Unavailable, "failed to check rate limit: %v", err)
+    }
+    if descriptorStatus.Code == ratelimitv3.RateLimitResponse_OVER_LIMIT {
+      resp.OverallCode = ratelimitv3.RateLimitResponse_OVER_LIMIT
+    }
+    resp.Statuses = append(resp.Statuses, descriptorStatus)
+  }
+
+  return resp, nil
+}
+
+// check counts the hits against the limit of a single descriptor, descriptors
+// without a configured limit are always allowed
+func (s *Service) check(ctx context.Context, domain string, descriptor *commonv3.RateLimitDescriptor, hits int) (*ratelimitv3.RateLimitResponse_DescriptorStatus, error) {
+  config, ok := s.match(domain, descriptor)
+  if !ok {
+    return &ratelimitv3.RateLimitResponse_DescriptorStatus{Code: ratelimitv3.RateLimitResponse_OK}, nil
+  }
+
+  unit := config.RateLimit.Unit
+  requests := config.RateLimit.RequestsPerUnit
+
+  // Envoy may override the configured limit for a descriptor
+  if override := descriptor.GetLimit(); override != nil {
+    if name, ok := overrideUnits[override.GetUnit()]; ok {
+      unit, requests = name, int(override.GetRequestsPerUnit())
+    }
+  }
+
+  // Descriptors are denied until their unit ends, like in the reference
+  // implementation, rather than blocked like clients
+  rule := limiter.Rule{
+    Name:       fmt.Sprintf("rls.%s", domain),
+    Limit:      requests,
+    Expiration: units[unit],
+    DryRun:     config.DryRun,
+    Mode:       limiter.ModeReject,
+    SkipDenied: true,
+    Aligned:    true,
+  }
+  result, err := s.limiter.Check(ctx, rule, descriptorKey(descriptor), hits)
+  if err != nil {
+    return nil, err
+  }
+
+  code := ratelimitv3.RateLimitResponse_OK
+  if !result.Allowed {
+    code = ratelimitv3.RateLimitResponse_OVER_LIMIT
+  }
+
+  return &ratelimitv3.RateLimitResponse_DescriptorStatus{
+    Code: code,
+    CurrentLimit: &ratelimitv3.RateLimitResponse_RateLimit{
+      Name:            rule.Name,
+      RequestsPerUnit: uint32(requests),
+      Unit:            responseUnits[unit],
+    },
+    LimitRemaining:     uint32(result.Remaining),
+    DurationUntilReset: durationpb.New(result.Reset),
+  }, nil
+}
+
+// match returns the configured descriptor matching an Envoy descriptor
+func (s *Service) match(domain string, descriptor *commonv3.RateLimitDescriptor) (Descriptor, bool) {
+  entries := descriptor.GetEntries()
+
+  for _, config := range s.domains[domain] {
+    if len(config.Entries) != len(entries) {
+      continue
+    }
+
+    matched := true
+    for i, entry := range config.Entries {
+      if entry.Key != entries[i].GetKey() || (entry.Value != "" && entry.Value != entries[i].GetValue()) {
+        matched = false
+        break
+      }
+    }
+    if matched {
+      return config, true
+    }
+  }
+
+  return Descriptor{}, false
+}
+
+// keyEscaper escapes the separators of descriptor keys, so distinct
+// descriptors never share a key
+var keyEscaper = strings.NewReplacer("%", "%25", "=", "%3D", ",", "%2C", ":", "%3A")
+
+// descriptorKey returns the storage key for the values of a descriptor
+func descriptorKey(descriptor *commonv3.RateLimitDescriptor) string {
+  parts := make([]string, 0, len(descriptor.GetEntries()))
+  for _, entry := range descriptor.GetEntries() {
+    parts = append(parts, keyEscaper.Replace(entry.GetKey())+"="+keyEscaper.Replace(entry.GetValue()))
+  }
+  return strings.Join(parts, ",")
+}
@@ -0,0 +1,228 @@
+package rls
+
+import (
+  "context"
+  "net"
+  "testing"
+  "time"
+
+  commonv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+  ratelimitv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+  typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+  "google.golang.org/grpc"
+  "google.golang.org/grpc/codes"
+  "google.golang.org/grpc/credentials/insecure"
+  "google.golang.org/grpc/status"
+  "rate-limiter/config"
+  "rate-limiter/limiter"
+  "rate-limiter/storage"
+)
+
+// startService serves the rate limit service on a local port and returns a client for it
+func startService(t *testing.T, domains []Domain) ratelimitv3.RateLimitServiceClient {
+  rl := limiter.NewRateLimiter(&config.Config{BlockDuration: 60}, storage.NewMemoryStorage())
+  service, err := NewService(rl, domains)
+  if err != nil {
+    t.Fatalf("Error creating service: %v", err)
+  }
+
+  listener, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatalf("Error listening: %v", err)
+  }
+  server := grpc.NewServer()
+  ratelimitv3.RegisterRateLimitServiceServer(server, service)
+  go server.Serve(listener)
+  t.Cleanup(server.Stop)
+
+  conn, err := grpc.Dial(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+  if err != nil {
+    t.Fatalf("Error dialing service: %v", err)
+  }
+  t.Cleanup(func() { conn.Close() })
+
+  return ratelimitv3.NewRateLimitServiceClient(conn)
+}
+
+// descriptor builds an Envoy descriptor from key/value pairs
+func descriptor(pairs ...string) *commonv3.RateLimitDescriptor {
+  d := &commonv3.RateLimitDescriptor{}
+  for i := 0; i+1 < len(pairs); i += 2 {
+    d.Entries = append(d.Entries, &commonv3.RateLimitDescriptor_Entry{Key: pairs[i], Value: pairs[i+1]})
+  }
+  return d
+}
+
+var testDomains = []Domain{
+  {
+    Domain: "edge",
+    Descriptors: []Descriptor{
+      {Entries: []Entry{{Key: "remote_address"}}, RateLimit: RateLimit{Unit: "minute", RequestsPerUnit: 2}},
+      {Entries: []Entry{{Key: "path", Value: "/api/bulk"}}, RateLimit: RateLimit{Unit: "hour", RequestsPerUnit: 10}},
+    },
+  },
+}
+
+// TestShouldRateLimit tests that descriptors are limited independently with per-descriptor statuses
+func TestShouldRateLimit(t *testing.T) {
+  client := startService(t, testDomains)
+  ctx := context.Background()
+
+  req := &ratelimitv3.RateLimitRequest{
+    Domain: "edge",
+    Descriptors: []*commonv3.RateLimitDescriptor{
+      descriptor("remote_address", "203.0.113.7"),
+      descriptor("path", "/api/bulk"),
+      descriptor("user_agent", "curl"),
+    },
+  }
+
+  for i := 0; i < 2; i++ {
+    resp, err := client.ShouldRateLimit(ctx, req)
+    if err != nil {
+      t.Fatalf("Error calling service: %v", err)
+    }
+    if resp.OverallCode != ratelimitv3.RateLimitResponse_OK {
+      t.Errorf("Request %d should be allowed, got %v", i+1, resp.OverallCode)
+    }
+    if len(resp.Statuses) != 3 {
+      t.Fatalf("Expected 3 statuses, got %d", len(resp.Statuses))
+    }
+    if remaining := resp.Statuses[0].LimitRemaining; remaining != uint32(1-i) {
+      t.Errorf("Request %d: remaining %d, want %d", i+1, remaining, 1-i)
+    }
+    if limit := resp.Statuses[1].CurrentLimit; limit.RequestsPerUnit != 10 || limit.Unit != ratelimitv3.RateLimitResponse_RateLimit_HOUR {
+      t.Errorf("Unexpected limit for path descriptor: %v", limit)
+    }
+    if resp.Statuses[2].CurrentLimit != nil {
+      t.Error("Unconfigured descriptors should have no limit")
+    }
+  }
+
+  resp, err := client.ShouldRateLimit(ctx, req)
+  if err != nil {
+    t.Fatalf("Error calling service: %v", err)
+  }
+  if resp.OverallCode != ratelimitv3.RateLimitResponse_OVER_LIMIT {
+    t.Errorf("Third request should be over limit, got %v", resp.OverallCode)
+  }
+  if resp.Statuses[0].Code != ratelimitv3.RateLimitResponse_OVER_LIMIT || resp.Statuses[1].Code != ratelimitv3.RateLimitResponse_OK {
+    t.Errorf("Only the remote address descriptor should be over limit: %v", resp.Statuses)
+  }
+
+  // Other addresses have their own budget
+  req.Descriptors = []*commonv3.RateLimitDescriptor{descriptor("remote_address", "203.0.113.8")}
+  resp, err = client.ShouldRateLimit(ctx, req)
+  if err != nil {
+    t.Fatalf("Error calling service: %v", err)
+  }
+  if resp.OverallCode != ratelimitv3.RateLimitResponse_OK {
+    t.Errorf("Another address should be allowed, got %v", resp.OverallCode)
+  }
+}
+
+// TestShouldRateLimitWindow tests that descriptors over the limit are denied until their unit ends instead of blocked
+func TestShouldRateLimitWindow(t *testing.T) {
+  client := startService(t, testDomains)
+  req := &ratelimitv3.RateLimitRequest{
+    Domain:      "edge",
+    Descriptors: []*commonv3.RateLimitDescriptor{descriptor("path", "/api/bulk")},
+    HitsAddend:  9,
+  }
+
+  resp, err := client.ShouldRateLimit(context.Background(), req)
+  if err != nil {
+    t.Fatalf("Error calling service: %v", err)
+  }
+  if resp.OverallCode != ratelimitv3.RateLimitResponse_OK {
+    t.Fatalf("Request within the limit should be allowed, got %v", resp.OverallCode)
+  }
+  if reset := resp.Statuses[0].DurationUntilReset.AsDuration(); reset <= 0 || reset > time.Hour {
+    t.Errorf("Reset should be the rest of the hour, got %v", reset)
+  }
+
+  resp, err = client.ShouldRateLimit(context.Background(), req)
+  if err != nil {
+    t.Fatalf("Error calling service: %v", err)
+  }
+  if resp.OverallCode != ratelimitv3.RateLimitResponse_OVER_LIMIT {
+    t.Errorf("Request over the limit should be denied, got %v", resp.OverallCode)
+  }
+
+  // A denied descriptor is not blocked and keeps the budget left in its window
+  req.HitsAddend = 1
+  resp, err = client.ShouldRateLimit(context.Background(), req)
+  if err != nil {
+    t.Fatalf("Error calling service: %v", err)
+  }
+  if resp.OverallCode != ratelimitv3.RateLimitResponse_OK || resp.Statuses[0].LimitRemaining != 0 {
+    t.Errorf("Denied hits should not be charged nor block the descriptor: %v", resp.Statuses[0])
+  }
+}
+
+// TestShouldRateLimitOverride tests hits addend and descriptor limit overrides
+func TestShouldRateLimitOverride(t *testing.T) {
+  client := startService(t, testDomains)
+
+  d := descriptor("remote_address", "203.0.113.7")
+  d.Limit = &commonv3.RateLimitDescriptor_RateLimitOverride{RequestsPerUnit: 5, Unit: typev3.RateLimitUnit_SECOND}
+
+  resp, err := client.ShouldRateLimit(context.Background(), &ratelimitv3.RateLimitRequest{
+    Domain:      "edge",
+    Descriptors: []*commonv3.RateLimitDescriptor{d},
+    HitsAddend:  3,
+  })
+  if err != nil {
+    t.Fatalf("Error calling service: %v", err)
+  }
+
+  descriptorStatus := resp.Statuses[0]
+  if descriptorStatus.Code != ratelimitv3.RateLimitResponse_OK || descriptorStatus.LimitRemaining != 2 {
+    t.Errorf("Unexpected status: %v", descriptorStatus)
+  }
+  if descriptorStatus.CurrentLimit.Unit != ratelimitv3.RateLimitResponse_RateLimit_SECOND {
+    t.Errorf("Override unit should be reported, got %v", descriptorStatus.CurrentLimit.Unit)
+  }
+}
+
+// TestShouldRateLimitEmptyDomain tests that requests without a domain are rejected
+func TestShouldRateLimitEmptyDomain(t *testing.T) {
+  client := startService(t, testDomains)
+
+  _, err := client.ShouldRateLimit(context.Background(), &ratelimitv3.RateLimitRequest{})
+  if status.Code(err) != codes.InvalidArgument {
+    t.Errorf("Expected InvalidArgument, got %v", err)
+  }
+}
+
+// TestDescriptorKey tests that distinct descriptors never share a key
+func TestDescriptorKey(t *testing.T) {
+  pairs := [][]string{
+    {"a", "b:c"},
+    {"a:b", "c"},
+    {"a", "b=c"},
+    {"a=b", "c"},
+    {"a", "b,c=d"},
+    {"a", "b", "c", "d"},
+    {"a", "b%3Ac"},
+  }
+
+  seen := make(map[string]int)
+  for i, p := range pairs {
+    key := descriptorKey(descriptor(p...))
+    if j, ok := seen[key]; ok {
+      t.Errorf("Descriptors %v and %v share the key %q", pairs[j], p, key)
+    }
+    seen[key] = i
+  }
+}
+
+// TestNewServiceInvalidDomain tests that domains which would break rule names are rejected
+func TestNewServiceInvalidDomain(t *testing.T) {
+  rl := limiter.NewRateLimiter(&config.Config{BlockDuration: 60}, storage.NewMemoryStorage())
+  for _, domain := range []string{"", "edge:internal"} {
+    if _, err := NewService(rl, []Domain{{Domain: domain}}); err == nil {
+      t.Errorf("Expected an error for domain %q", domain)
+    }
+  }
+}
@@ -12,10 +12,19 @@ type Item struct {
 	Expiration time.Time
 }
 
+// seenItem records the first sighting of a key
+type seenItem struct {
+	First      time.Time
+	Expiration time.Time
+}
+
 // MemoryStorage implements the Storage interface using in-memory storage
 type MemoryStorage struct {
 	counters    map[string]*Item
 	blockedKeys map[string]time.Time
+	leases      map[string]int
+	seen        map[string]*seenItem
+	usage       map[int64]map[string]*Usage
 	mutex       sync.RWMutex
 }
 
@@ -24,6 +33,9 @@ func NewMemoryStorage() *MemoryStorage {
 	return &MemoryStorage{
 		counters:    make(map[string]*Item),
 		blockedKeys: make(map[string]time.Time),
+		leases:      make(map[string]int),
+		seen:        make(map[string]*seenItem),
+		usage:       make(map[int64]map[string]*Usage),
 	}
 }
 
@@ -47,6 +59,11 @@ func (s *MemoryStorage) Get(ctx context.Context, key string) (int, error) {
 
 // Increment increments the counter for a key and returns the new value
 func (s *MemoryStorage) Increment(ctx context.Context, key string, expiration time.Duration) (int, error) {
+	return s.IncrementBy(ctx, key, 1, expiration)
+}
+
+// IncrementBy adds n to the counter for a key and returns the new value
+func (s *MemoryStorage) IncrementBy(ctx context.Context, key string, n int, expiration time.Duration) (int, error) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
@@ -55,18 +72,75 @@ func (s *MemoryStorage) Increment(ctx context.Context, key string, expiration ti
 	if !exists || time.Now().After(item.Expiration) {
 		// Create a new item or reset an expired one
 		s.counters[key] = &Item{
-			Value:      1,
+			Value:      n,
 			Expiration: time.Now().Add(expiration),
 		}
-		return 1, nil
+		return n, nil
 	}
 
 	// Increment the existing item
-	item.Value++
+	item.Value += n
 	item.Expiration = time.Now().Add(expiration)
 	return item.Value, nil
 }
 
+// IncrementFixed increments a counter without extending its expiration
+func (s *MemoryStorage) IncrementFixed(ctx context.Context, key string, expiration time.Duration) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	item, exists := s.counters[key]
+	if !exists || time.Now().After(item.Expiration) {
+		s.counters[key] = &Item{Value: 1, Expiration: time.Now().Add(expiration)}
+		return 1, nil
+	}
+
+	item.Value++
+	return item.Value, nil
+}
+
+// IncrementAll adds n to every counter only if none of them would exceed its
+// limit, all or nothing
+func (s *MemoryStorage) IncrementAll(ctx context.Context, keys []string, n int, limits []int, expirations []time.Duration) ([]int, int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	counts := make([]int, len(keys))
+	denied := -1
+	for i, key := range keys {
+		if item, exists := s.counters[key]; exists && !now.After(item.Expiration) {
+			counts[i] = item.Value
+		}
+		if denied < 0 && counts[i]+n > limits[i] {
+			denied = i
+		}
+	}
+	if denied >= 0 {
+		return counts, denied, nil
+	}
+
+	for i, key := range keys {
+		counts[i] += n
+		s.counters[key] = &Item{Value: counts[i], Expiration: now.Add(expirations[i])}
+	}
+	return counts, -1, nil
+}
+
+// Decrement subtracts n from an existing counter and returns the new value
+func (s *MemoryStorage) Decrement(ctx context.Context, key string, n int) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	item, exists := s.counters[key]
+	if !exists || time.Now().After(item.Expiration) {
+		return 0, nil
+	}
+
+	item.Value -= n
+	return item.Value, nil
+}
+
 // IsBlocked checks if a key is blocked
 func (s *MemoryStorage) IsBlocked(ctx context.Context, key string) (bool, error) {
 	s.mutex.RLock()
@@ -77,16 +151,37 @@ func (s *MemoryStorage) IsBlocked(ctx context.Context, key string) (bool, error)
 		return false, nil
 	}
 
-	// Check if the block has expired
-	if time.Now().After(expirationTime) {
+	// Check if the block has expired, a zero time never expires
+	if !expirationTime.IsZero() && time.Now().After(expirationTime) {
 		return false, nil
 	}
 
 	return true, nil
 }
 
+// BlockTTL returns how long a key remains blocked
+func (s *MemoryStorage) BlockTTL(ctx context.Context, key string) (time.Duration, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	expirationTime, exists := s.blockedKeys[key]
+	if !exists || expirationTime.IsZero() {
+		return 0, nil
+	}
+
+	ttl := time.Until(expirationTime)
+	if ttl < 0 {
+		return 0, nil
+	}
+	return ttl, nil
+}
+
 // Block blocks a key for the specified duration
 func (s *MemoryStorage) Block(ctx context.Context, key string, duration time.Duration) error {
+	if duration <= 0 {
+		return nil
+	}
+
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
@@ -94,6 +189,136 @@ func (s *MemoryStorage) Block(ctx context.Context, key string, duration time.Dur
 	return nil
 }
 
+// Ban blocks a key without expiry, marked by a zero expiration time
+func (s *MemoryStorage) Ban(ctx context.Context, key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.blockedKeys[key] = time.Time{}
+	return nil
+}
+
+// Unblock removes any block on a key
+func (s *MemoryStorage) Unblock(ctx context.Context, key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.blockedKeys, key)
+	return nil
+}
+
+// TTL returns how long until a counter expires
+func (s *MemoryStorage) TTL(ctx context.Context, key string) (time.Duration, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	item, exists := s.counters[key]
+	if !exists {
+		return 0, nil
+	}
+
+	ttl := time.Until(item.Expiration)
+	if ttl < 0 {
+		return 0, nil
+	}
+	return ttl, nil
+}
+
+// FirstSeen returns when a key was first seen, recording now for new keys
+func (s *MemoryStorage) FirstSeen(ctx context.Context, key string, ttl time.Duration) (time.Time, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	item, exists := s.seen[key]
+	if !exists || now.After(item.Expiration) {
+		item = &seenItem{First: now}
+		s.seen[key] = item
+	}
+	item.Expiration = now.Add(ttl)
+	return item.First, nil
+}
+
+// Merge moves the counters and first sightings of the from keys to the
+// matching to keys
+func (s *MemoryStorage) Merge(ctx context.Context, from, to []string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	moved := false
+	for i := range from {
+		if item, exists := s.counters[from[i]]; exists {
+			delete(s.counters, from[i])
+			if now.Before(item.Expiration) && item.Value != 0 {
+				moved = true
+				if current, exists := s.counters[to[i]]; exists && now.Before(current.Expiration) {
+					current.Value += item.Value
+					if item.Expiration.After(current.Expiration) {
+						current.Expiration = item.Expiration
+					}
+				} else {
+					s.counters[to[i]] = item
+				}
+			}
+		}
+
+		if item, exists := s.seen[from[i]]; exists {
+			delete(s.seen, from[i])
+			if now.Before(item.Expiration) {
+				moved = true
+				if current, exists := s.seen[to[i]]; !exists || now.After(current.Expiration) || item.First.Before(current.First) {
+					s.seen[to[i]] = item
+				}
+			}
+		}
+	}
+	return moved, nil
+}
+
+// Reset removes the counter for a key
+func (s *MemoryStorage) Reset(ctx context.Context, key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.counters, key)
+	return nil
+}
+
+// AcquireLease takes one of limit concurrent leases on a key, acting as a
+// local semaphore since leases cannot outlive the process
+func (s *MemoryStorage) AcquireLease(ctx context.Context, key string, limit int, ttl time.Duration) (string, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.leases[key] >= limit {
+		return "", false, nil
+	}
+	s.leases[key]++
+	return key, true, nil
+}
+
+// RenewLease keeps a lease, in memory leases never expire
+func (s *MemoryStorage) RenewLease(ctx context.Context, key, lease string, ttl time.Duration) (bool, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.leases[key] > 0, nil
+}
+
+// ReleaseLease gives back a lease taken with AcquireLease
+func (s *MemoryStorage) ReleaseLease(ctx context.Context, key, lease string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.leases[key] <= 1 {
+		delete(s.leases, key)
+		return nil
+	}
+	s.leases[key]--
+	return nil
+}
+
 // Close closes the storage connection (no-op for memory storage)
 func (s *MemoryStorage) Close() error {
 	return nil
@@ -125,10 +350,17 @@ func (s *MemoryStorage) cleanup() {
 		}
 	}
 
-	// Clean up expired blocks
+	// Clean up expired blocks, permanent bans are kept
 	for key, expiration := range s.blockedKeys {
-		if now.After(expiration) {
+		if !expiration.IsZero() && now.After(expiration) {
 			delete(s.blockedKeys, key)
 		}
 	}
+
+	// Clean up keys unseen for longer than their memory
+	for key, item := range s.seen {
+		if now.After(item.Expiration) {
+			delete(s.seen, key)
+		}
+	}
 }
@@ -0,0 +1,51 @@
+package storage
+
+import (
+  "context"
+  "fmt"
+  "strings"
+)
+
+// legacyBlockedPattern matches blocks written before keys were prefixed
+const legacyBlockedPattern = "blocked:*"
+
+// MigrateLegacyBlocks moves blocks written before keys were prefixed, stored
+// flat as blocked:<key>, under the prefix with the key returned by rename.
+// Remaining block times, including permanent bans, are preserved and an empty
+// key from rename leaves the block in place. Legacy counters, offenses and
+// leases are short-lived and simply expire. It returns the number of moved
+// blocks.
+func (s *RedisStorage) MigrateLegacyBlocks(ctx context.Context, rename func(legacy string) string) (int, error) {
+  migrated := 0
+  iter := s.client.Scan(ctx, 0, legacyBlockedPattern, 100).Iterator()
+  for iter.Next(ctx) {
+    legacyKey := iter.Val()
+    key := rename(strings.TrimPrefix(legacyKey, "blocked:"))
+    if key == "" {
+      continue
+    }
+
+    ttl, err := s.client.PTTL(ctx, legacyKey).Result()
+    if err != nil {
+      return migrated, err
+    }
+    // The block expired since it was listed
+    if ttl == -2 {
+      continue
+    }
+    // Blocks without expiry are permanent bans
+    if ttl < 0 {
+      err = s.Ban(ctx, key)
+    } else {
+      err = s.Block(ctx, key, ttl)
+    }
+    if err != nil {
+      return migrated, fmt.Errorf("failed to migrate %s: %w", legacyKey, err)
+    }
+    if err := s.client.Del(ctx, legacyKey).Err(); err != nil {
+      return migrated, fmt.Errorf("failed to migrate %s: %w", legacyKey, err)
+    }
+    migrated++
+  }
+  return migrated, iter.Err()
+}
@@ -2,6 +2,8 @@ package storage
 
 import (
   "context"
+  "crypto/rand"
+  "encoding/hex"
   "fmt"
   "time"
 
@@ -9,9 +11,134 @@ import (
   "rate-limiter/config"
 )
 
-// RedisStorage implements the Storage interface using Redis
+// acquireLeaseScript drops expired leases and adds a new one if the key holds
+// fewer than the limit, scores are lease expiry times in milliseconds
+var acquireLeaseScript = redis.NewScript(`
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])
+if redis.call('ZCARD', KEYS[1]) >= tonumber(ARGV[2]) then
+  return 0
+end
+redis.call('ZADD', KEYS[1], tonumber(ARGV[1]) + tonumber(ARGV[3]), ARGV[4])
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+return 1
+`)
+
+// renewLeaseScript pushes the expiry of the lease ARGV[3] to ARGV[2]
+// milliseconds after ARGV[1] unless it already expired
+var renewLeaseScript = redis.NewScript(`
+local expiry = redis.call('ZSCORE', KEYS[1], ARGV[3])
+if not expiry or tonumber(expiry) <= tonumber(ARGV[1]) then
+  return 0
+end
+redis.call('ZADD', KEYS[1], tonumber(ARGV[1]) + tonumber(ARGV[2]), ARGV[3])
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+return 1
+`)
+
+// incrementAllScript adds ARGV[1] to every key only if none would exceed its
+// limit, limits and expirations in milliseconds follow in ARGV. It returns the
+// 1-based index of the denying key, or 0, followed by the counters.
+var incrementAllScript = redis.NewScript(`
+local n = tonumber(ARGV[1])
+local count = #KEYS
+local values = {}
+local denied = 0
+for i = 1, count do
+  values[i] = tonumber(redis.call('GET', KEYS[i]) or '0')
+  if denied == 0 and values[i] + n > tonumber(ARGV[1 + i]) then
+    denied = i
+  end
+end
+if denied == 0 then
+  for i = 1, count do
+    values[i] = redis.call('INCRBY', KEYS[i], n)
+    redis.call('PEXPIRE', KEYS[i], ARGV[1 + count + i])
+  end
+end
+table.insert(values, 1, denied)
+return values
+`)
+
+// incrementFixedScript increments a counter and sets its expiration to
+// ARGV[1] milliseconds only when the increment creates it
+var incrementFixedScript = redis.NewScript(`
+local count = redis.call('INCR', KEYS[1])
+if count == 1 then
+  redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return count
+`)
+
+// decrementScript subtracts from a counter only if it still exists, so an
+// expired counter is not recreated without a TTL
+var decrementScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+  return 0
+end
+return redis.call('DECRBY', KEYS[1], ARGV[1])
+`)
+
+// firstSeenScript records ARGV[1] as the first sighting of a key unless one
+// is stored, pushes its expiration to ARGV[2] milliseconds and returns it
+var firstSeenScript = redis.NewScript(`
+local first = redis.call('GET', KEYS[1])
+if not first then
+  first = ARGV[1]
+  redis.call('SET', KEYS[1], first)
+end
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+return tonumber(first)
+`)
+
+// mergeScript moves the counter and first sighting of every pair of keys
+// KEYS[4i-3] and KEYS[4i-1] to KEYS[4i-2] and KEYS[4i]. Counters are added
+// keeping the later expiration, the earlier sighting is kept. It returns 1 if
+// anything was moved.
+var mergeScript = redis.NewScript(`
+local moved = 0
+for i = 1, #KEYS, 4 do
+  local n = tonumber(redis.call('GET', KEYS[i]) or '0')
+  if n ~= 0 then
+    local ttl = redis.call('PTTL', KEYS[i])
+    local current = redis.call('PTTL', KEYS[i + 1])
+    redis.call('DEL', KEYS[i])
+    redis.call('INCRBY', KEYS[i + 1], n)
+    if ttl > 0 and current < ttl then
+      redis.call('PEXPIRE', KEYS[i + 1], ttl)
+    end
+    moved = 1
+  end
+
+  local first = redis.call('GET', KEYS[i + 2])
+  if first then
+    local ttl = redis.call('PTTL', KEYS[i + 2])
+    local current = redis.call('GET', KEYS[i + 3])
+    redis.call('DEL', KEYS[i + 2])
+    if not current or tonumber(first) < tonumber(current) then
+      redis.call('SET', KEYS[i + 3], first)
+      if ttl > 0 then
+        redis.call('PEXPIRE', KEYS[i + 3], ttl)
+      end
+    end
+    moved = 1
+  end
+end
+return moved
+`)
+
+// Kinds of data stored under the key prefix
+const (
+  counterKind = "counter"
+  blockedKind = "blocked"
+  leasesKind  = "leases"
+  seenKind    = "seen"
+)
+
+// RedisStorage implements the Storage interface using Redis, every key lives
+// under the configured prefix so several applications can share a database
 type RedisStorage struct {
   client *redis.Client
+  prefix string
 }
 
 // NewRedisStorage creates a new Redis storage instance
@@ -32,12 +159,18 @@ func NewRedisStorage(cfg *config.Config) (*RedisStorage, error) {
 
   return &RedisStorage{
     client: client,
+    prefix: cfg.RedisKeyPrefix,
   }, nil
 }
 
+// redisKey returns the Redis key holding the given kind of data for a key
+func (s *RedisStorage) redisKey(kind, key string) string {
+  return fmt.Sprintf("%s:%s:%s", s.prefix, kind, key)
+}
+
 // Get returns the current count for a key
 func (s *RedisStorage) Get(ctx context.Context, key string) (int, error) {
-  val, err := s.client.Get(ctx, key).Int()
+  val, err := s.client.Get(ctx, s.redisKey(counterKind, key)).Int()
   if err == redis.Nil {
     return 0, nil
   }
@@ -46,8 +179,14 @@ func (s *RedisStorage) Get(ctx context.Context, key string) (int, error) {
 
 // Increment increments the counter for a key and returns the new value
 func (s *RedisStorage) Increment(ctx context.Context, key string, expiration time.Duration) (int, error) {
+  return s.IncrementBy(ctx, key, 1, expiration)
+}
+
+// IncrementBy adds n to the counter for a key and returns the new value
+func (s *RedisStorage) IncrementBy(ctx context.Context, key string, n int, expiration time.Duration) (int, error) {
+  key = s.redisKey(counterKind, key)
   pipe := s.client.Pipeline()
-  incr := pipe.Incr(ctx, key)
+  incr := pipe.IncrBy(ctx, key, int64(n))
   pipe.Expire(ctx, key, expiration)
   _, err := pipe.Exec(ctx)
   if err != nil {
@@ -56,9 +195,57 @@ func (s *RedisStorage) Increment(ctx context.Context, key string, expiration tim
   return int(incr.Val()), nil
 }
 
+// IncrementAll adds n to every counter only if none of them would exceed its
+// limit, all or nothing
+func (s *RedisStorage) IncrementAll(ctx context.Context, keys []string, n int, limits []int, expirations []time.Duration) ([]int, int, error) {
+  redisKeys := make([]string, len(keys))
+  args := []interface{}{n}
+  for i, key := range keys {
+    redisKeys[i] = s.redisKey(counterKind, key)
+    args = append(args, limits[i])
+  }
+  for _, expiration := range expirations {
+    args = append(args, expiration.Milliseconds())
+  }
+
+  reply, err := incrementAllScript.Run(ctx, s.client, redisKeys, args...).Int64Slice()
+  if err != nil {
+    return nil, -1, err
+  }
+
+  counts := make([]int, len(keys))
+  for i := range counts {
+    counts[i] = int(reply[i+1])
+  }
+  return counts, int(reply[0]) - 1, nil
+}
+
+// IncrementFixed increments a counter without extending its expiration
+func (s *RedisStorage) IncrementFixed(ctx context.Context, key string, expiration time.Duration) (int, error) {
+  return incrementFixedScript.Run(ctx, s.client, []string{s.redisKey(counterKind, key)}, expiration.Milliseconds()).Int()
+}
+
+// Decrement subtracts n from an existing counter and returns the new value
+func (s *RedisStorage) Decrement(ctx context.Context, key string, n int) (int, error) {
+  return decrementScript.Run(ctx, s.client, []string{s.redisKey(counterKind, key)}, n).Int()
+}
+
+// TTL returns how long until a counter expires
+func (s *RedisStorage) TTL(ctx context.Context, key string) (time.Duration, error) {
+  ttl, err := s.client.PTTL(ctx, s.redisKey(counterKind, key)).Result()
+  if err != nil {
+    return 0, err
+  }
+  // Negative values mean the key is missing or has no expiry
+  if ttl < 0 {
+    return 0, nil
+  }
+  return ttl, nil
+}
+
 // IsBlocked checks if a key is blocked
 func (s *RedisStorage) IsBlocked(ctx context.Context, key string) (bool, error) {
-  blockedKey := fmt.Sprintf("blocked:%s", key)
+  blockedKey := s.redisKey(blockedKind, key)
   exists, err := s.client.Exists(ctx, blockedKey).Result()
   if err != nil {
     return false, err
@@ -66,12 +253,107 @@ func (s *RedisStorage) IsBlocked(ctx context.Context, key string) (bool, error)
   return exists > 0, nil
 }
 
+// BlockTTL returns how long a key remains blocked
+func (s *RedisStorage) BlockTTL(ctx context.Context, key string) (time.Duration, error) {
+  blockedKey := s.redisKey(blockedKind, key)
+  ttl, err := s.client.PTTL(ctx, blockedKey).Result()
+  if err != nil {
+    return 0, err
+  }
+  // Negative values mean the key is missing or has no expiry
+  if ttl < 0 {
+    return 0, nil
+  }
+  return ttl, nil
+}
+
 // Block blocks a key for the specified duration
 func (s *RedisStorage) Block(ctx context.Context, key string, duration time.Duration) error {
-  blockedKey := fmt.Sprintf("blocked:%s", key)
+  // A zero expiration would make the block permanent
+  if duration <= 0 {
+    return nil
+  }
+  blockedKey := s.redisKey(blockedKind, key)
   return s.client.Set(ctx, blockedKey, 1, duration).Err()
 }
 
+// Ban blocks a key without expiry
+func (s *RedisStorage) Ban(ctx context.Context, key string) error {
+  blockedKey := s.redisKey(blockedKind, key)
+  return s.client.Set(ctx, blockedKey, 1, 0).Err()
+}
+
+// Unblock removes any block on a key
+func (s *RedisStorage) Unblock(ctx context.Context, key string) error {
+  blockedKey := s.redisKey(blockedKind, key)
+  return s.client.Del(ctx, blockedKey).Err()
+}
+
+// FirstSeen returns when a key was first seen, recording now for new keys
+func (s *RedisStorage) FirstSeen(ctx context.Context, key string, ttl time.Duration) (time.Time, error) {
+  now := time.Now().UnixMilli()
+  first, err := firstSeenScript.Run(ctx, s.client, []string{s.redisKey(seenKind, key)}, now, ttl.Milliseconds()).Int64()
+  if err != nil {
+    return time.Time{}, err
+  }
+  return time.UnixMilli(first), nil
+}
+
+// Merge moves the counters and first sightings of the from keys to the
+// matching to keys
+func (s *RedisStorage) Merge(ctx context.Context, from, to []string) (bool, error) {
+  keys := make([]string, 0, 4*len(from))
+  for i := range from {
+    keys = append(keys,
+      s.redisKey(counterKind, from[i]), s.redisKey(counterKind, to[i]),
+      s.redisKey(seenKind, from[i]), s.redisKey(seenKind, to[i]))
+  }
+  moved, err := mergeScript.Run(ctx, s.client, keys).Int()
+  return moved == 1, err
+}
+
+// Reset removes the counter for a key
+func (s *RedisStorage) Reset(ctx context.Context, key string) error {
+  return s.client.Del(ctx, s.redisKey(counterKind, key)).Err()
+}
+
+// AcquireLease takes one of limit concurrent leases on a key
+func (s *RedisStorage) AcquireLease(ctx context.Context, key string, limit int, ttl time.Duration) (string, bool, error) {
+  id := make([]byte, 16)
+  if _, err := rand.Read(id); err != nil {
+    return "", false, err
+  }
+  lease := hex.EncodeToString(id)
+
+  leasesKey := s.redisKey(leasesKind, key)
+  now := time.Now().UnixMilli()
+  acquired, err := acquireLeaseScript.Run(ctx, s.client, []string{leasesKey}, now, limit, ttl.Milliseconds(), lease).Int()
+  if err != nil {
+    return "", false, err
+  }
+  if acquired == 0 {
+    return "", false, nil
+  }
+  return lease, true, nil
+}
+
+// RenewLease pushes the expiry of a lease to ttl from now
+func (s *RedisStorage) RenewLease(ctx context.Context, key, lease string, ttl time.Duration) (bool, error) {
+  leasesKey := s.redisKey(leasesKind, key)
+  now := time.Now().UnixMilli()
+  renewed, err := renewLeaseScript.Run(ctx, s.client, []string{leasesKey}, now, ttl.Milliseconds(), lease).Int()
+  if err != nil {
+    return false, err
+  }
+  return renewed == 1, nil
+}
+
+// ReleaseLease gives back a lease taken with AcquireLease
+func (s *RedisStorage) ReleaseLease(ctx context.Context, key, lease string) error {
+  leasesKey := s.redisKey(leasesKind, key)
+  return s.client.ZRem(ctx, leasesKey, lease).Err()
+}
+
 // Close closes the Redis connection
 func (s *RedisStorage) Close() error {
   return s.client.Close()
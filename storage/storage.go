@@ -13,12 +13,67 @@ type Storage interface {
   // Increment increments the counter for a key and returns the new value
   Increment(ctx context.Context, key string, expiration time.Duration) (int, error)
 
+  // IncrementBy adds n to the counter for a key and returns the new value
+  IncrementBy(ctx context.Context, key string, n int, expiration time.Duration) (int, error)
+
+  // IncrementFixed increments a counter whose expiration is only set when it
+  // is created, so it counts over a fixed window from the first increment
+  IncrementFixed(ctx context.Context, key string, expiration time.Duration) (int, error)
+
+  // IncrementAll adds n to every counter only if none of them would exceed
+  // its limit, all or nothing. It returns the counters after the operation
+  // and the index of the first counter that would exceed its limit, or -1.
+  IncrementAll(ctx context.Context, keys []string, n int, limits []int, expirations []time.Duration) ([]int, int, error)
+
+  // Decrement subtracts n from an existing counter without touching its
+  // expiration and returns the new value, missing counters are left alone
+  Decrement(ctx context.Context, key string, n int) (int, error)
+
+  // TTL returns how long until a counter expires, zero if it is missing
+  TTL(ctx context.Context, key string) (time.Duration, error)
+
+  // FirstSeen returns when a key was first seen, recording now for new keys.
+  // Every call pushes the expiration of the record to ttl from now, so keys
+  // unseen for ttl are new again.
+  FirstSeen(ctx context.Context, key string, ttl time.Duration) (time.Time, error)
+
+  // Merge moves the counter and first sighting stored under every key of
+  // from to the matching key of to, all at once. Counters are added keeping
+  // the later expiration and the earlier first sighting is kept. It reports
+  // whether anything was moved.
+  Merge(ctx context.Context, from, to []string) (bool, error)
+
   // IsBlocked checks if a key is blocked
   IsBlocked(ctx context.Context, key string) (bool, error)
 
-  // Block blocks a key for the specified duration
+  // BlockTTL returns how long a key remains blocked, zero if it is not blocked
+  // or the block has no expiry
+  BlockTTL(ctx context.Context, key string) (time.Duration, error)
+
+  // Block blocks a key for the specified duration, a duration that is not
+  // positive does not block it
   Block(ctx context.Context, key string, duration time.Duration) error
 
+  // Ban blocks a key until it is explicitly unblocked
+  Ban(ctx context.Context, key string) error
+
+  // Unblock removes any block on a key
+  Unblock(ctx context.Context, key string) error
+
+  // Reset removes the counter for a key
+  Reset(ctx context.Context, key string) error
+
+  // AcquireLease takes one of limit concurrent leases on a key and returns its
+  // identifier, leases expire after ttl so crashed holders cannot leak them
+  AcquireLease(ctx context.Context, key string, limit int, ttl time.Duration) (string, bool, error)
+
+  // RenewLease pushes the expiry of a lease to ttl from now, it reports false
+  // when the lease already expired
+  RenewLease(ctx context.Context, key, lease string, ttl time.Duration) (bool, error)
+
+  // ReleaseLease gives back a lease taken with AcquireLease
+  ReleaseLease(ctx context.Context, key, lease string) error
+
   // Close closes the storage connection
   Close() error
 }
@@ -0,0 +1,224 @@
+package storage
+
+import (
+  "context"
+  "fmt"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+
+  "github.com/go-redis/redis/v8"
+)
+
+// usageKind holds the usage totals of each interval
+const usageKind = "usage"
+
+// mergeUsageScript moves the totals of the key ARGV[1] to the key ARGV[2] in
+// every interval hash of KEYS
+var mergeUsageScript = redis.NewScript(`
+for _, key in ipairs(KEYS) do
+  for _, stat in ipairs({'allowed', 'denied', 'units'}) do
+    local n = redis.call('HGET', key, stat .. ':' .. ARGV[1])
+    if n then
+      redis.call('HINCRBY', key, stat .. ':' .. ARGV[2], n)
+      redis.call('HDEL', key, stat .. ':' .. ARGV[1])
+    end
+  end
+end
+return 0
+`)
+
+// Usage holds the decisions taken for a key during one interval
+type Usage struct {
+  Start   time.Time `json:"start"`
+  Key     string    `json:"key"`
+  Allowed int64     `json:"allowed"`
+  Denied  int64     `json:"denied"`
+  Units   int64     `json:"units"`
+}
+
+// UsageStorage persists usage totals for reporting
+type UsageStorage interface {
+  // AddUsage adds the totals to the ones stored for their key and interval,
+  // keeping them for the retention period after the interval starts
+  AddUsage(ctx context.Context, usage []Usage, retention time.Duration) error
+
+  // Usage returns the totals of the intervals starting within [from, to),
+  // ordered by interval and key
+  Usage(ctx context.Context, from, to time.Time) ([]Usage, error)
+
+  // MergeUsage adds the totals stored for one key to those of another key in
+  // every interval and removes them, such as when a key is renamed
+  MergeUsage(ctx context.Context, from, to string) error
+}
+
+// Ensure both storages keep usage totals
+var (
+  _ UsageStorage = (*RedisStorage)(nil)
+  _ UsageStorage = (*MemoryStorage)(nil)
+)
+
+// AddUsage adds the totals to a hash per interval, indexed by a sorted set of
+// interval starts
+func (s *RedisStorage) AddUsage(ctx context.Context, usage []Usage, retention time.Duration) error {
+  index := s.redisKey(usageKind, "intervals")
+  pipe := s.client.Pipeline()
+  for _, u := range usage {
+    start := u.Start.Unix()
+    key := s.redisKey(usageKind, strconv.FormatInt(start, 10))
+    pipe.HIncrBy(ctx, key, "allowed:"+u.Key, u.Allowed)
+    pipe.HIncrBy(ctx, key, "denied:"+u.Key, u.Denied)
+    pipe.HIncrBy(ctx, key, "units:"+u.Key, u.Units)
+    pipe.ExpireAt(ctx, key, u.Start.Add(retention))
+    pipe.ZAdd(ctx, index, &redis.Z{Score: float64(start), Member: start})
+  }
+  pipe.ZRemRangeByScore(ctx, index, "-inf", "("+strconv.FormatInt(time.Now().Add(-retention).Unix(), 10))
+  _, err := pipe.Exec(ctx)
+  return err
+}
+
+// Usage returns the totals of the intervals starting within [from, to)
+func (s *RedisStorage) Usage(ctx context.Context, from, to time.Time) ([]Usage, error) {
+  starts, err := s.client.ZRangeByScore(ctx, s.redisKey(usageKind, "intervals"), &redis.ZRangeBy{
+    Min: strconv.FormatInt(from.Unix(), 10),
+    Max: "(" + strconv.FormatInt(to.Unix(), 10),
+  }).Result()
+  if err != nil {
+    return nil, err
+  }
+
+  var usage []Usage
+  for _, start := range starts {
+    unix, err := strconv.ParseInt(start, 10, 64)
+    if err != nil {
+      return nil, fmt.Errorf("invalid usage interval %q: %w", start, err)
+    }
+    fields, err := s.client.HGetAll(ctx, s.redisKey(usageKind, start)).Result()
+    if err != nil {
+      return nil, err
+    }
+
+    totals := make(map[string]*Usage)
+    for field, value := range fields {
+      stat, key, _ := strings.Cut(field, ":")
+      n, err := strconv.ParseInt(value, 10, 64)
+      if err != nil {
+        return nil, fmt.Errorf("invalid usage total %q: %w", field, err)
+      }
+      u, ok := totals[key]
+      if !ok {
+        u = &Usage{Start: time.Unix(unix, 0).UTC(), Key: key}
+        totals[key] = u
+      }
+      switch stat {
+      case "allowed":
+        u.Allowed = n
+      case "denied":
+        u.Denied = n
+      case "units":
+        u.Units = n
+      }
+    }
+    usage = append(usage, sortedUsage(totals)...)
+  }
+  return usage, nil
+}
+
+// AddUsage adds the totals to the ones kept in memory, which are lost when the
+// process exits
+func (s *MemoryStorage) AddUsage(ctx context.Context, usage []Usage, retention time.Duration) error {
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+
+  for _, u := range usage {
+    start := u.Start.Unix()
+    if s.usage[start] == nil {
+      s.usage[start] = make(map[string]*Usage)
+    }
+    total, ok := s.usage[start][u.Key]
+    if !ok {
+      total = &Usage{Start: time.Unix(start, 0).UTC(), Key: u.Key}
+      s.usage[start][u.Key] = total
+    }
+    total.Allowed += u.Allowed
+    total.Denied += u.Denied
+    total.Units += u.Units
+  }
+
+  // Drop the intervals past their retention
+  oldest := time.Now().Add(-retention).Unix()
+  for start := range s.usage {
+    if start < oldest {
+      delete(s.usage, start)
+    }
+  }
+  return nil
+}
+
+// Usage returns the totals of the intervals starting within [from, to)
+func (s *MemoryStorage) Usage(ctx context.Context, from, to time.Time) ([]Usage, error) {
+  s.mutex.RLock()
+  defer s.mutex.RUnlock()
+
+  var starts []int64
+  for start := range s.usage {
+    if start >= from.Unix() && start < to.Unix() {
+      starts = append(starts, start)
+    }
+  }
+  sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+
+  var usage []Usage
+  for _, start := range starts {
+    usage = append(usage, sortedUsage(s.usage[start])...)
+  }
+  return usage, nil
+}
+
+// MergeUsage moves the totals of a key to another key in every interval
+func (s *RedisStorage) MergeUsage(ctx context.Context, from, to string) error {
+  starts, err := s.client.ZRange(ctx, s.redisKey(usageKind, "intervals"), 0, -1).Result()
+  if err != nil || len(starts) == 0 {
+    return err
+  }
+
+  keys := make([]string, len(starts))
+  for i, start := range starts {
+    keys[i] = s.redisKey(usageKind, start)
+  }
+  return mergeUsageScript.Run(ctx, s.client, keys, from, to).Err()
+}
+
+// MergeUsage moves the totals of a key to another key in every interval
+func (s *MemoryStorage) MergeUsage(ctx context.Context, from, to string) error {
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+
+  for start, totals := range s.usage {
+    u, ok := totals[from]
+    if !ok {
+      continue
+    }
+    delete(totals, from)
+    total, ok := totals[to]
+    if !ok {
+      total = &Usage{Start: time.Unix(start, 0).UTC(), Key: to}
+      totals[to] = total
+    }
+    total.Allowed += u.Allowed
+    total.Denied += u.Denied
+    total.Units += u.Units
+  }
+  return nil
+}
+
+// Helper function to list the totals of an interval ordered by key
+func sortedUsage(totals map[string]*Usage) []Usage {
+  usage := make([]Usage, 0, len(totals))
+  for _, u := range totals {
+    usage = append(usage, *u)
+  }
+  sort.Slice(usage, func(i, j int) bool { return usage[i].Key < usage[j].Key })
+  return usage
+}
@@ -0,0 +1,198 @@
+package tenant
+
+import (
+  "context"
+  "encoding/json"
+  "fmt"
+  "net"
+  "net/http"
+  "os"
+  "strings"
+  "time"
+
+  "rate-limiter/middleware"
+)
+
+// Tenant describes a tenant sharing the limiter, zero limits fall back to
+// the global configuration
+type Tenant struct {
+  // Name identifies the tenant in keys, metrics and the admin API
+  Name string `json:"name"`
+
+  // Hosts are the request hosts served for the tenant
+  Hosts []string `json:"hosts"`
+
+  // Tokens are the API tokens of the tenant, given as their identifiers
+  // under one of the token hash secrets
+  Tokens []string `json:"tokens"`
+
+  // Per-client limits of the tenant
+  IPLimit         int `json:"ip_limit"`
+  IPExpiration    int `json:"ip_expiration"`
+  TokenLimit      int `json:"token_limit"`
+  TokenExpiration int `json:"token_expiration"`
+  IPBurst         int `json:"ip_burst"`
+  TokenBurst      int `json:"token_burst"`
+
+  // IPMode and TokenMode choose between "block" and "reject" for the
+  // tenant's clients over their limits
+  IPMode    string `json:"ip_mode"`
+  TokenMode string `json:"token_mode"`
+
+  // Limit and Expiration set the ceiling shared by every client of the
+  // tenant, a zero limit disables it
+  Limit      int `json:"limit"`
+  Expiration int `json:"expiration"`
+
+  // Quotas replace the global quotas of the tenant's clients, keyed by
+  // period, and Timezone sets when they reset
+  Quotas   map[string]int `json:"quotas"`
+  Timezone string         `json:"timezone"`
+
+  // AdminToken grants access to the tenant's admin routes
+  AdminToken string `json:"admin_token"`
+}
+
+// Default is the tenant of requests that match no configured tenant
+const Default = "default"
+
+// contextKey is the type of the context key holding the tenant name
+type contextKey struct{}
+
+// Load reads the tenants from a JSON file
+func Load(path string) ([]Tenant, error) {
+  data, err := os.ReadFile(path)
+  if err != nil {
+    return nil, fmt.Errorf("failed to read tenants: %w", err)
+  }
+
+  var tenants []Tenant
+  if err := json.Unmarshal(data, &tenants); err != nil {
+    return nil, fmt.Errorf("failed to parse tenants: %w", err)
+  }
+
+  seen := make(map[string]bool)
+  for _, t := range tenants {
+    if t.Name == "" || t.Name == Default || strings.ContainsAny(t.Name, ":/") {
+      return nil, fmt.Errorf("invalid tenant name %q", t.Name)
+    }
+    if seen[t.Name] {
+      return nil, fmt.Errorf("duplicate tenant %q", t.Name)
+    }
+    seen[t.Name] = true
+
+    if _, err := time.LoadLocation(t.Timezone); err != nil {
+      return nil, fmt.Errorf("tenant %s: %w", t.Name, err)
+    }
+    for _, mode := range []string{t.IPMode, t.TokenMode} {
+      if mode != "" && mode != "block" && mode != "reject" {
+        return nil, fmt.Errorf("tenant %s: invalid mode %q", t.Name, mode)
+      }
+    }
+  }
+  return tenants, nil
+}
+
+// NewContext returns a context carrying the tenant name
+func NewContext(ctx context.Context, name string) context.Context {
+  return context.WithValue(ctx, contextKey{}, name)
+}
+
+// FromContext returns the tenant name carried by the context, or an empty
+// string when there is none
+func FromContext(ctx context.Context) string {
+  name, _ := ctx.Value(contextKey{}).(string)
+  return name
+}
+
+// ResolverOption configures a Resolver
+type ResolverOption func(r *Resolver)
+
+// Resolver finds the tenant of a request from a header, its host or its
+// token, in that order
+type Resolver struct {
+  header  string
+  names   map[string]bool
+  hosts   map[string]string
+  tokens  map[string]string
+  hashes  func(token string) []string
+  trusted middleware.TrustedProxies
+}
+
+// NewResolver creates a resolver for the tenants. The header is ignored when
+// empty, and hashes maps a token to the identifiers it may be listed under in
+// the tenants, one per accepted secret.
+func NewResolver(tenants []Tenant, header string, hashes func(token string) []string, opts ...ResolverOption) *Resolver {
+  r := &Resolver{
+    header: header,
+    names:  make(map[string]bool),
+    hosts:  make(map[string]string),
+    tokens: make(map[string]string),
+    hashes: hashes,
+  }
+  for _, opt := range opts {
+    opt(r)
+  }
+  for _, t := range tenants {
+    r.names[t.Name] = true
+    for _, host := range t.Hosts {
+      r.hosts[strings.ToLower(host)] = t.Name
+    }
+    for _, token := range t.Tokens {
+      r.tokens[token] = t.Name
+    }
+  }
+  return r
+}
+
+// WithTrustedProxies only honors the tenant header and X-Forwarded-Host of
+// requests sent by the given proxies, without it both are ignored
+func WithTrustedProxies(proxies middleware.TrustedProxies) ResolverOption {
+  return func(r *Resolver) {
+    r.trusted = proxies
+  }
+}
+
+// Resolve returns the tenant of a request, or an empty string when no tenant
+// matches. Clients could move themselves to another tenant with the tenant
+// header or X-Forwarded-Host, so both only count from trusted proxies.
+func (r *Resolver) Resolve(req *http.Request) string {
+  trusted := r.trusted.Trusted(req)
+  if r.header != "" && trusted {
+    if name := req.Header.Get(r.header); r.names[name] {
+      return name
+    }
+  }
+
+  // Check endpoints are asked about the host the proxy received
+  host := req.Host
+  if forwarded := req.Header.Get("X-Forwarded-Host"); forwarded != "" && trusted {
+    host = forwarded
+  }
+  if h, _, err := net.SplitHostPort(host); err == nil {
+    host = h
+  }
+  if name, ok := r.hosts[strings.ToLower(host)]; ok {
+    return name
+  }
+
+  if token := req.Header.Get(middleware.TokenHeader); token != "" {
+    for _, hash := range r.hashes(token) {
+      if name, ok := r.tokens[hash]; ok {
+        return name
+      }
+    }
+  }
+  return ""
+}
+
+// Middleware returns a handler function that stores the tenant of each
+// request in its context
+func (r *Resolver) Middleware(next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+    if name := r.Resolve(req); name != "" {
+      req = req.WithContext(NewContext(req.Context(), name))
+    }
+    next.ServeHTTP(w, req)
+  })
+}
@@ -0,0 +1,99 @@
+package tenant
+
+import (
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+
+  "rate-limiter/middleware"
+)
+
+// TestResolve tests the resolution order of the header, host and token
+func TestResolve(t *testing.T) {
+  tenants := []Tenant{
+    {Name: "acme", Hosts: []string{"api.acme.com"}},
+    {Name: "globex", Tokens: []string{"hashed-globex-token"}},
+    {Name: "umbrella", Tokens: []string{"old-umbrella-token"}},
+  }
+  // Tokens match under the current and the previous secret
+  hashes := func(token string) []string { return []string{"hashed-" + token, "old-" + token} }
+  trusted, _ := middleware.ParseTrustedProxies([]string{"10.0.0.0/8"})
+  resolver := NewResolver(tenants, "X-Tenant", hashes, WithTrustedProxies(trusted))
+
+  tests := []struct {
+    name    string
+    remote  string
+    host    string
+    headers map[string]string
+    want    string
+  }{
+    {name: "host", host: "api.acme.com:8080", want: "acme"},
+    {name: "forwarded host", remote: "10.0.0.1:1234", host: "limiter", headers: map[string]string{"X-Forwarded-Host": "API.acme.com"}, want: "acme"},
+    {name: "token", host: "shared.example.com", headers: map[string]string{"API_KEY": "globex-token"}, want: "globex"},
+    {name: "previous token", host: "shared.example.com", headers: map[string]string{"API_KEY": "umbrella-token"}, want: "umbrella"},
+    {name: "header", remote: "10.0.0.1:1234", host: "api.acme.com", headers: map[string]string{"X-Tenant": "globex"}, want: "globex"},
+    {name: "unknown header", remote: "10.0.0.1:1234", host: "api.acme.com", headers: map[string]string{"X-Tenant": "initech"}, want: "acme"},
+    {name: "none", host: "shared.example.com", headers: map[string]string{"API_KEY": "other"}, want: ""},
+    {name: "untrusted header", host: "api.acme.com", headers: map[string]string{"X-Tenant": "globex"}, want: "acme"},
+    {name: "untrusted forwarded host", host: "api.acme.com", headers: map[string]string{"X-Forwarded-Host": "shared.example.com"}, want: "acme"},
+  }
+
+  for _, tt := range tests {
+    req := httptest.NewRequest("GET", "/", nil)
+    req.Host = tt.host
+    if tt.remote != "" {
+      req.RemoteAddr = tt.remote
+    }
+    for name, value := range tt.headers {
+      req.Header.Set(name, value)
+    }
+    if got := resolver.Resolve(req); got != tt.want {
+      t.Errorf("%s: got tenant %q want %q", tt.name, got, tt.want)
+    }
+  }
+}
+
+// TestMiddleware tests that the tenant reaches the request context
+func TestMiddleware(t *testing.T) {
+  resolver := NewResolver([]Tenant{{Name: "acme", Hosts: []string{"api.acme.com"}}}, "", func(token string) []string { return []string{token} })
+
+  var got string
+  handler := resolver.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    got = FromContext(r.Context())
+  }))
+
+  req := httptest.NewRequest("GET", "http://api.acme.com/", nil)
+  handler.ServeHTTP(httptest.NewRecorder(), req)
+  if got != "acme" {
+    t.Errorf("Expected tenant acme in the context, got %q", got)
+  }
+}
+
+// TestLoad tests that invalid tenant files are rejected
+func TestLoad(t *testing.T) {
+  dir := t.TempDir()
+  write := func(content string) string {
+    path := filepath.Join(dir, "tenants.json")
+    os.WriteFile(path, []byte(content), 0o644)
+    return path
+  }
+
+  tenants, err := Load(write(`[{"name": "acme", "hosts": ["api.acme.com"], "limit": 1000, "expiration": 60}]`))
+  if err != nil || len(tenants) != 1 || tenants[0].Limit != 1000 {
+    t.Errorf("Unexpected tenants %+v, error %v", tenants, err)
+  }
+
+  for _, content := range []string{
+    `[{"name": "a:b"}]`,
+    `[{"name": ""}]`,
+    `[{"name": "acme"}, {"name": "acme"}]`,
+    `[{"name": "default"}]`,
+  } {
+    if _, err := Load(write(content)); err == nil || !strings.Contains(err.Error(), "tenant") {
+      t.Errorf("Expected %s to be rejected, got %v", content, err)
+    }
+  }
+}
@@ -0,0 +1,89 @@
+package usage
+
+import (
+  "encoding/csv"
+  "encoding/json"
+  "fmt"
+  "io"
+  "strconv"
+  "time"
+
+  "rate-limiter/storage"
+)
+
+// Export formats
+const (
+  // FormatCSV writes one row per key and interval after a header row
+  FormatCSV = "csv"
+  // FormatJSONLines writes one JSON object per key and interval
+  FormatJSONLines = "jsonl"
+)
+
+// dateLayout is the layout of dates accepted in ranges
+const dateLayout = "2006-01-02"
+
+// Write writes usage totals in the given format
+func Write(w io.Writer, format string, usage []storage.Usage) error {
+  switch format {
+  case FormatCSV:
+    cw := csv.NewWriter(w)
+    cw.Write([]string{"start", "key", "allowed", "denied", "units"})
+    for _, u := range usage {
+      cw.Write([]string{
+        u.Start.UTC().Format(time.RFC3339),
+        u.Key,
+        strconv.FormatInt(u.Allowed, 10),
+        strconv.FormatInt(u.Denied, 10),
+        strconv.FormatInt(u.Units, 10),
+      })
+    }
+    cw.Flush()
+    return cw.Error()
+  case FormatJSONLines:
+    encoder := json.NewEncoder(w)
+    for _, u := range usage {
+      if err := encoder.Encode(u); err != nil {
+        return err
+      }
+    }
+    return nil
+  }
+  return fmt.Errorf("unknown usage format %q", format)
+}
+
+// ParseRange parses the bounds of an export given as dates or RFC 3339 times.
+// A date as the upper bound includes the whole day, an empty lower bound
+// starts at the beginning of time and an empty upper bound ends now.
+func ParseRange(from, to string) (time.Time, time.Time, error) {
+  start := time.Unix(0, 0)
+  if from != "" {
+    var err error
+    if start, err = parseTime(from); err != nil {
+      return time.Time{}, time.Time{}, fmt.Errorf("invalid start %q: %w", from, err)
+    }
+  }
+
+  end := time.Now()
+  if to != "" {
+    var err error
+    if end, err = parseTime(to); err != nil {
+      return time.Time{}, time.Time{}, fmt.Errorf("invalid end %q: %w", to, err)
+    }
+    if len(to) == len(dateLayout) {
+      end = end.AddDate(0, 0, 1)
+    }
+  }
+
+  if !start.Before(end) {
+    return time.Time{}, time.Time{}, fmt.Errorf("start %q is not before end %q", from, to)
+  }
+  return start, end, nil
+}
+
+// Helper function to parse a date in UTC or an RFC 3339 time
+func parseTime(value string) (time.Time, error) {
+  if len(value) == len(dateLayout) {
+    return time.Parse(dateLayout, value)
+  }
+  return time.Parse(time.RFC3339, value)
+}
@@ -0,0 +1,234 @@
+package usage
+
+import (
+  "context"
+  "log"
+  "sync"
+  "time"
+
+  "rate-limiter/storage"
+)
+
+// bucket identifies the totals of a key in one interval
+type bucket struct {
+  start int64
+  key   string
+}
+
+// Recorder aggregates limiter decisions per key and interval in memory and
+// flushes the totals to storage
+type Recorder struct {
+  store     storage.UsageStorage
+  interval  time.Duration
+  retention time.Duration
+  now       func() time.Time
+
+  mutex  sync.Mutex
+  totals map[bucket]*storage.Usage
+  merged sync.Map
+
+  // recorded keeps the allowed requests and units of every key in the
+  // current interval, flushed or not, so refunds never take back more than
+  // was recorded in the interval
+  recorded      map[string]*storage.Usage
+  recordedStart int64
+  stop   chan struct{}
+  done   chan struct{}
+}
+
+// NewRecorder creates a recorder counting decisions in intervals of the given
+// length, aligned to UTC, and keeping the totals for the retention period
+func NewRecorder(store storage.UsageStorage, interval, retention time.Duration) *Recorder {
+  return &Recorder{
+    store:     store,
+    interval:  interval,
+    retention: retention,
+    now:       time.Now,
+    totals:    make(map[bucket]*storage.Usage),
+    recorded:  make(map[string]*storage.Usage),
+  }
+}
+
+// Record counts a decision for a key, allowed decisions also add their cost
+// units
+func (r *Recorder) Record(key string, allowed bool, cost int) {
+  // Requests always cost at least one unit
+  if cost < 1 {
+    cost = 1
+  }
+
+  start := r.now().Truncate(r.interval)
+  b := bucket{start: start.Unix(), key: key}
+
+  r.mutex.Lock()
+  defer r.mutex.Unlock()
+
+  u, ok := r.totals[b]
+  if !ok {
+    u = &storage.Usage{Start: start.UTC(), Key: key}
+    r.totals[b] = u
+  }
+  if allowed {
+    u.Allowed++
+    u.Units += int64(cost)
+
+    current := r.current(b.start, key)
+    current.Allowed++
+    current.Units += int64(cost)
+  } else {
+    u.Denied++
+  }
+}
+
+// Merge moves the totals recorded for a key to another key, such as when the
+// identifier of a token changes with its hash secret. Stored totals are only
+// moved the first time a key is merged.
+func (r *Recorder) Merge(ctx context.Context, from, to string) error {
+  r.mutex.Lock()
+  for b, u := range r.totals {
+    if b.key == from {
+      delete(r.totals, b)
+      r.add(bucket{start: b.start, key: to}, u)
+    }
+  }
+  if u, ok := r.recorded[from]; ok {
+    delete(r.recorded, from)
+    current := r.current(r.recordedStart, to)
+    current.Allowed += u.Allowed
+    current.Units += u.Units
+  }
+  r.mutex.Unlock()
+
+  if _, done := r.merged.LoadOrStore(from, struct{}{}); done {
+    return nil
+  }
+  if err := r.store.MergeUsage(ctx, from, to); err != nil {
+    r.merged.Delete(from)
+    return err
+  }
+  return nil
+}
+
+// Refund takes back the decision and cost units recorded for an allowed
+// request that was refunded. Only requests recorded in the current interval
+// are taken back, a refund crossing an interval boundary is dropped rather
+// than taken from an interval that did not count the request.
+func (r *Recorder) Refund(key string, cost int) {
+  // Requests always cost at least one unit
+  if cost < 1 {
+    cost = 1
+  }
+  b := bucket{start: r.now().Truncate(r.interval).Unix(), key: key}
+
+  r.mutex.Lock()
+  defer r.mutex.Unlock()
+
+  current := r.current(b.start, key)
+  if current.Allowed < 1 {
+    return
+  }
+  units := int64(cost)
+  if units > current.Units {
+    units = current.Units
+  }
+  current.Allowed--
+  current.Units -= units
+  r.add(b, &storage.Usage{Allowed: -1, Units: -units})
+}
+
+// Flush writes the totals recorded since the last flush to storage, they are
+// kept for the next flush when storage fails
+func (r *Recorder) Flush(ctx context.Context) error {
+  r.mutex.Lock()
+  totals := r.totals
+  r.totals = make(map[bucket]*storage.Usage)
+  r.mutex.Unlock()
+
+  if len(totals) == 0 {
+    return nil
+  }
+
+  usage := make([]storage.Usage, 0, len(totals))
+  for _, u := range totals {
+    usage = append(usage, *u)
+  }
+  if err := r.store.AddUsage(ctx, usage, r.retention); err != nil {
+    r.merge(totals)
+    return err
+  }
+  return nil
+}
+
+// StartFlushTask starts a background task flushing the totals periodically
+// until the recorder is closed
+func (r *Recorder) StartFlushTask(interval time.Duration) {
+  r.stop = make(chan struct{})
+  r.done = make(chan struct{})
+  go func() {
+    defer close(r.done)
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+      select {
+      case <-ticker.C:
+        if err := r.Flush(context.Background()); err != nil {
+          log.Printf("Error flushing usage: %v", err)
+        }
+      case <-r.stop:
+        return
+      }
+    }
+  }()
+}
+
+// Close stops the flush task and flushes the remaining totals
+func (r *Recorder) Close() error {
+  if r.stop != nil {
+    close(r.stop)
+    <-r.done
+  }
+  return r.Flush(context.Background())
+}
+
+// merge adds totals that could not be flushed back to the pending ones
+func (r *Recorder) merge(totals map[bucket]*storage.Usage) {
+  r.mutex.Lock()
+  defer r.mutex.Unlock()
+
+  for b, u := range totals {
+    r.add(b, u)
+  }
+}
+
+// current returns the totals recorded for a key in the interval starting at
+// start, the totals of earlier intervals are dropped once a later one
+// starts. The caller holds the mutex.
+func (r *Recorder) current(start int64, key string) *storage.Usage {
+  if start != r.recordedStart {
+    if start < r.recordedStart {
+      return &storage.Usage{}
+    }
+    r.recorded = make(map[string]*storage.Usage)
+    r.recordedStart = start
+  }
+  u, ok := r.recorded[key]
+  if !ok {
+    u = &storage.Usage{}
+    r.recorded[key] = u
+  }
+  return u
+}
+
+// add adds totals to the pending ones of a bucket, the caller holds the mutex
+func (r *Recorder) add(b bucket, u *storage.Usage) {
+  pending, ok := r.totals[b]
+  if !ok {
+    u.Start, u.Key = time.Unix(b.start, 0).UTC(), b.key
+    r.totals[b] = u
+    return
+  }
+  pending.Allowed += u.Allowed
+  pending.Denied += u.Denied
+  pending.Units += u.Units
+}
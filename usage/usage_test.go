@@ -0,0 +1,240 @@
+package usage
+
+import (
+  "bytes"
+  "context"
+  "errors"
+  "strings"
+  "testing"
+  "time"
+
+  "rate-limiter/storage"
+)
+
+// FailingStorage fails every write
+type FailingStorage struct {
+  *storage.MemoryStorage
+}
+
+// AddUsage always fails
+func (s FailingStorage) AddUsage(ctx context.Context, usage []storage.Usage, retention time.Duration) error {
+  return errors.New("unavailable")
+}
+
+func TestRecorderFlush(t *testing.T) {
+  ctx := context.Background()
+  store := storage.NewMemoryStorage()
+  recorder := NewRecorder(store, time.Hour, 24*time.Hour)
+
+  now := time.Now().Truncate(time.Hour).Add(10 * time.Minute)
+  recorder.now = func() time.Time { return now }
+
+  recorder.Record("default:token:token:abc", true, 5)
+  recorder.Record("default:token:token:abc", true, 0)
+  recorder.Record("default:token:token:abc", false, 5)
+  recorder.Record("default:ip:ip:192.168.1.1", true, 1)
+
+  // The next interval is counted apart
+  now = now.Add(time.Hour)
+  recorder.Record("default:token:token:abc", true, 2)
+
+  if err := recorder.Flush(ctx); err != nil {
+    t.Fatalf("Unexpected error: %v", err)
+  }
+  // Totals are added to the stored ones
+  recorder.Record("default:token:token:abc", true, 1)
+  if err := recorder.Close(); err != nil {
+    t.Fatalf("Unexpected error: %v", err)
+  }
+
+  totals, err := store.Usage(ctx, now.Add(-2*time.Hour), now.Add(time.Hour))
+  if err != nil {
+    t.Fatalf("Unexpected error: %v", err)
+  }
+  if len(totals) != 3 {
+    t.Fatalf("Expected 3 totals, got %+v", totals)
+  }
+
+  first := now.Add(-time.Hour).Truncate(time.Hour)
+  want := []storage.Usage{
+    {Start: first, Key: "default:ip:ip:192.168.1.1", Allowed: 1, Units: 1},
+    {Start: first, Key: "default:token:token:abc", Allowed: 2, Denied: 1, Units: 6},
+    {Start: first.Add(time.Hour), Key: "default:token:token:abc", Allowed: 2, Units: 3},
+  }
+  for i, u := range want {
+    if !totals[i].Start.Equal(u.Start) || totals[i].Key != u.Key || totals[i].Allowed != u.Allowed ||
+      totals[i].Denied != u.Denied || totals[i].Units != u.Units {
+      t.Errorf("Expected %+v, got %+v", u, totals[i])
+    }
+  }
+
+  // Only intervals starting within the range are returned
+  totals, _ = store.Usage(ctx, first.Add(time.Minute), now.Add(time.Hour))
+  if len(totals) != 1 {
+    t.Errorf("Expected only the second interval, got %+v", totals)
+  }
+}
+
+func TestRecorderFlushFailure(t *testing.T) {
+  ctx := context.Background()
+  recorder := NewRecorder(FailingStorage{storage.NewMemoryStorage()}, time.Hour, time.Hour)
+
+  recorder.Record("default:ip:ip:192.168.1.1", true, 1)
+  if err := recorder.Flush(ctx); err == nil {
+    t.Fatal("Expected the flush to fail")
+  }
+  recorder.Record("default:ip:ip:192.168.1.1", true, 1)
+
+  // Totals that could not be flushed are kept for the next flush
+  store := storage.NewMemoryStorage()
+  recorder.store = store
+  if err := recorder.Flush(ctx); err != nil {
+    t.Fatalf("Unexpected error: %v", err)
+  }
+  totals, _ := store.Usage(ctx, time.Now().Add(-2*time.Hour), time.Now().Add(time.Hour))
+  if len(totals) != 1 || totals[0].Allowed != 2 {
+    t.Errorf("Expected 2 allowed requests, got %+v", totals)
+  }
+}
+
+func TestWrite(t *testing.T) {
+  totals := []storage.Usage{
+    {Start: time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC), Key: "acme:token:token:abc", Allowed: 10, Denied: 2, Units: 25},
+  }
+
+  var buf bytes.Buffer
+  if err := Write(&buf, FormatCSV, totals); err != nil {
+    t.Fatalf("Unexpected error: %v", err)
+  }
+  want := "start,key,allowed,denied,units\n2024-03-01T10:00:00Z,acme:token:token:abc,10,2,25\n"
+  if buf.String() != want {
+    t.Errorf("Expected %q, got %q", want, buf.String())
+  }
+
+  buf.Reset()
+  if err := Write(&buf, FormatJSONLines, totals); err != nil {
+    t.Fatalf("Unexpected error: %v", err)
+  }
+  want = `{"start":"2024-03-01T10:00:00Z","key":"acme:token:token:abc","allowed":10,"denied":2,"units":25}` + "\n"
+  if buf.String() != want {
+    t.Errorf("Expected %q, got %q", want, buf.String())
+  }
+
+  if err := Write(&buf, "xml", totals); err == nil {
+    t.Error("Expected an error for an unknown format")
+  }
+}
+
+func TestParseRange(t *testing.T) {
+  from, to, err := ParseRange("2024-03-01", "2024-03-31")
+  if err != nil {
+    t.Fatalf("Unexpected error: %v", err)
+  }
+  if !from.Equal(time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)) || !to.Equal(time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)) {
+    t.Errorf("Expected the whole of March, got %v to %v", from, to)
+  }
+
+  _, to, err = ParseRange("", "2024-03-01T12:00:00Z")
+  if err != nil || !to.Equal(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)) {
+    t.Errorf("Expected the exact end time, got %v (%v)", to, err)
+  }
+
+  for _, r := range [][2]string{{"yesterday", ""}, {"2024-03-02", "2024-03-01"}} {
+    if _, _, err := ParseRange(r[0], r[1]); err == nil || !strings.Contains(err.Error(), r[0]) {
+      t.Errorf("Expected an error for %v, got %v", r, err)
+    }
+  }
+}
+
+func TestRecorderMerge(t *testing.T) {
+  ctx := context.Background()
+  store := storage.NewMemoryStorage()
+  recorder := NewRecorder(store, time.Hour, 24*time.Hour)
+
+  now := time.Now().Truncate(time.Hour).Add(10 * time.Minute)
+  recorder.now = func() time.Time { return now }
+
+  // Stored and pending totals of the old key both move to the new one
+  recorder.Record("default:token:token:old", true, 2)
+  if err := recorder.Flush(ctx); err != nil {
+    t.Fatalf("Error flushing usage: %v", err)
+  }
+  recorder.Record("default:token:token:old", false, 1)
+  if err := recorder.Merge(ctx, "default:token:token:old", "default:token:token:new"); err != nil {
+    t.Fatalf("Error merging usage: %v", err)
+  }
+  recorder.Record("default:token:token:new", true, 1)
+  if err := recorder.Flush(ctx); err != nil {
+    t.Fatalf("Error flushing usage: %v", err)
+  }
+
+  totals, err := store.Usage(ctx, now.Add(-time.Hour), now.Add(time.Hour))
+  if err != nil {
+    t.Fatalf("Error reading usage: %v", err)
+  }
+  if len(totals) != 1 {
+    t.Fatalf("Expected the totals of a single key, got %+v", totals)
+  }
+  if u := totals[0]; u.Key != "default:token:token:new" || u.Allowed != 2 || u.Denied != 1 || u.Units != 3 {
+    t.Errorf("Unexpected merged totals: %+v", u)
+  }
+}
+
+func TestRecorderRefund(t *testing.T) {
+  ctx := context.Background()
+  store := storage.NewMemoryStorage()
+  recorder := NewRecorder(store, time.Hour, 24*time.Hour)
+
+  now := time.Now().Truncate(time.Hour).Add(10 * time.Minute)
+  recorder.now = func() time.Time { return now }
+
+  // A refunded request is taken back from pending and stored totals
+  recorder.Record("default:token:token:abc", true, 3)
+  recorder.Record("default:token:token:abc", true, 2)
+  if err := recorder.Flush(ctx); err != nil {
+    t.Fatalf("Error flushing usage: %v", err)
+  }
+  recorder.Refund("default:token:token:abc", 2)
+  recorder.Record("default:token:token:abc", true, 1)
+  recorder.Refund("default:token:token:abc", 0)
+  if err := recorder.Flush(ctx); err != nil {
+    t.Fatalf("Error flushing usage: %v", err)
+  }
+
+  totals, err := store.Usage(ctx, now.Add(-time.Hour), now.Add(time.Hour))
+  if err != nil {
+    t.Fatalf("Error reading usage: %v", err)
+  }
+  if len(totals) != 1 {
+    t.Fatalf("Expected the totals of a single key, got %+v", totals)
+  }
+  if u := totals[0]; !u.Start.Equal(now.Truncate(time.Hour)) || u.Allowed != 1 || u.Units != 3 {
+    t.Errorf("Unexpected totals after refunds: %+v", u)
+  }
+
+  // Refunds in the next interval, or beyond what was recorded, are dropped
+  now = now.Add(time.Hour)
+  recorder.Refund("default:token:token:abc", 3)
+  recorder.Record("default:token:token:abc", true, 1)
+  recorder.Refund("default:token:token:abc", 5)
+  recorder.Refund("default:token:token:abc", 1)
+  if err := recorder.Flush(ctx); err != nil {
+    t.Fatalf("Error flushing usage: %v", err)
+  }
+
+  totals, err = store.Usage(ctx, now.Add(-2*time.Hour), now.Add(time.Hour))
+  if err != nil {
+    t.Fatalf("Error reading usage: %v", err)
+  }
+  if len(totals) != 2 {
+    t.Fatalf("Expected the totals of two intervals, got %+v", totals)
+  }
+  for _, u := range totals {
+    if u.Allowed < 0 || u.Units < 0 {
+      t.Errorf("Unexpected negative totals: %+v", u)
+    }
+    if u.Start.Equal(now.Add(-time.Hour).Truncate(time.Hour)) && (u.Allowed != 1 || u.Units != 3) {
+      t.Errorf("Unexpected totals of the previous interval: %+v", u)
+    }
+  }
+}